@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/bajdzun/go-url-shortener/internal/bloom"
+	"github.com/bajdzun/go-url-shortener/internal/cachekey"
+	"github.com/bajdzun/go-url-shortener/internal/clickinfo"
+	"github.com/bajdzun/go-url-shortener/internal/config"
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"github.com/bajdzun/go-url-shortener/internal/repository"
+	"github.com/bajdzun/go-url-shortener/internal/service"
+	"github.com/bajdzun/go-url-shortener/internal/shortcode"
+	"github.com/bajdzun/go-url-shortener/internal/transfer"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+const usage = `Usage: admin <command> [flags]
+
+Commands:
+  export        Write every link to a file or stdout
+  import        Load links from a file or stdin
+  flush-cache   Invalidate every cached link on all instances
+  warm-cache    Load the most clicked links into the cache
+  backfill-clicks
+                Derive browser, OS, device and referrer of older clicks
+
+Run "admin <command> -h" for the flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		fail("failed to load config: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	switch os.Args[1] {
+	case "export":
+		err = runExport(ctx, cfg, os.Args[2:])
+	case "import":
+		err = runImport(ctx, cfg, os.Args[2:])
+	case "flush-cache":
+		err = runFlushCache(ctx, cfg, os.Args[2:])
+	case "warm-cache":
+		err = runWarmCache(ctx, cfg, os.Args[2:])
+	case "backfill-clicks":
+		err = runBackfillClicks(ctx, cfg, os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fail("%s failed: %v", os.Args[1], err)
+	}
+}
+
+func runExport(ctx context.Context, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "ndjson", "output format: csv or ndjson")
+	output := flags.String("out", "-", "output file, - for stdout")
+	flags.Parse(args)
+
+	urlService, cleanup, err := newURLService(cfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	return urlService.ExportURLs(ctx, w, transfer.Format(*format))
+}
+
+func runImport(ctx context.Context, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "ndjson", "input format: csv, ndjson or bitly")
+	input := flags.String("in", "-", "input file, - for stdin")
+	conflict := flags.String("conflict", string(domain.ConflictSkip), "what to do with existing codes: skip, overwrite or fail")
+	flags.Parse(args)
+
+	urlService, cleanup, err := newURLService(cfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	var r io.Reader = os.Stdin
+	if *input != "-" {
+		file, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	result, err := urlService.ImportURLs(ctx, r, transfer.Format(*format), domain.ConflictPolicy(*conflict))
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stderr)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(result)
+}
+
+func runFlushCache(ctx context.Context, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("flush-cache", flag.ExitOnError)
+	flags.Parse(args)
+
+	urlService, cleanup, err := newURLService(cfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	generation, err := urlService.FlushCache(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "cache generation is now %d\n", generation)
+
+	return nil
+}
+
+func runWarmCache(ctx context.Context, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("warm-cache", flag.ExitOnError)
+	limit := flags.Int("limit", cfg.Cache.WarmupSize, "number of links to load, 0 for the default")
+	flags.Parse(args)
+
+	urlService, cleanup, err := newURLService(cfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	result, err := urlService.WarmCache(ctx, *limit)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stderr)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(result)
+}
+
+func runBackfillClicks(ctx context.Context, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("backfill-clicks", flag.ExitOnError)
+	batchSize := flags.Int("batch-size", 1000, "clicks updated per statement")
+	flags.Parse(args)
+
+	if *batchSize <= 0 {
+		return fmt.Errorf("batch size must be positive")
+	}
+
+	urlService, cleanup, err := newURLService(cfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	updated, err := urlService.BackfillClickDetails(ctx, *batchSize, func(updated int) {
+		fmt.Fprintf(os.Stderr, "\rupdated %d clicks", updated)
+	})
+	fmt.Fprintf(os.Stderr, "\rupdated %d clicks\n", updated)
+
+	return err
+}
+
+func newURLService(cfg *config.Config) (*service.URLService, func(), error) {
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	poolConfig, err := pgxpool.ParseConfig(cfg.Database.DSN())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dbPool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := dbPool.Ping(ctx); err != nil {
+		dbPool.Close()
+
+		return nil, nil, fmt.Errorf("connect to database: %w", err)
+	}
+
+	// Redis is needed so overwritten links are evicted from the cache.
+	redisClient, err := repository.NewRedisClient(repository.RedisClientOptions{
+		Mode:             cfg.Redis.Mode,
+		Addrs:            cfg.Redis.Addresses(),
+		MasterName:       cfg.Redis.MasterName,
+		Username:         cfg.Redis.Username,
+		Password:         cfg.Redis.Password,
+		SentinelPassword: cfg.Redis.SentinelPassword,
+		DB:               cfg.Redis.DB,
+		TLS:              cfg.Redis.TLS,
+		TLSCAFile:        cfg.Redis.TLSCAFile,
+		ReadFromReplica:  cfg.Redis.ReadFromReplica,
+	})
+	if err != nil {
+		dbPool.Close()
+
+		return nil, nil, err
+	}
+	if err := redisClient.Ping(ctx).Err(); err != nil {
+		dbPool.Close()
+		redisClient.Close()
+
+		return nil, nil, fmt.Errorf("connect to Redis: %w", err)
+	}
+
+	// Evictions must target the generation the API instances are using.
+	cacheKeys := cachekey.New(cfg.Cache.KeyPrefix)
+	generationStore := repository.NewRedisGenerationStore(redisClient, cacheKeys.GenerationKey())
+	generation, err := generationStore.Current(ctx)
+	if err != nil {
+		dbPool.Close()
+		redisClient.Close()
+
+		return nil, nil, fmt.Errorf("load cache generation: %w", err)
+	}
+	cacheKeys.SetGeneration(generation)
+
+	// Imports keep their own codes, so the generator only has to be valid.
+	codeGenerator := shortcode.NewRandom(shortcode.Base62, cfg.ShortCode.Length)
+
+	// Deletes go through the tiered cache so that API instances also drop
+	// their in-process copies.
+	invalidator := repository.NewRedisBroadcaster(redisClient, repository.CacheInvalidationChannel)
+	cacheRepo := repository.NewTieredCache(nil, repository.NewRedisCache(redisClient, cfg.Redis.TTL), invalidator, logger)
+
+	// Imported codes are broadcast to the API instances' code filters. The
+	// local filter is never loaded, as nothing here looks codes up.
+	codeFilter := repository.NewSyncedCodeFilter(
+		bloom.New(1, 0),
+		repository.NewRedisBroadcaster(redisClient, repository.CodeFilterAddChannel),
+		repository.NewRedisBroadcaster(redisClient, repository.CodeFilterRemoveChannel),
+		logger,
+	)
+
+	// Backfilled clicks are classified like new ones.
+	botClassifier, err := clickinfo.NewClassifier(cfg.Analytics.BotPatterns, cfg.Analytics.BotNetworks)
+	if err != nil {
+		dbPool.Close()
+		redisClient.Close()
+
+		return nil, nil, err
+	}
+
+	urlService := service.NewURLService(
+		repository.NewPostgresURLRepository(dbPool),
+		cacheRepo,
+		repository.NewPostgresAnalyticsRepository(dbPool),
+		codeGenerator,
+		logger,
+		service.Config{
+			BaseURL: cfg.App.BaseURL,
+			CodeValidator: shortcode.NewValidator(shortcode.Rules{
+				MinLength: cfg.ShortCode.MinLength,
+				MaxLength: cfg.ShortCode.MaxLength,
+				Alphabet:  cfg.ShortCode.CustomAlphabet,
+				// Top-level route segments of cmd/api, which reserves them from its router.
+				Reserved: append([]string{"health", "ready", "metrics", "api"}, cfg.ShortCode.Reserved...),
+				Denied:   cfg.ShortCode.DenyList,
+			}),
+			DefaultRedirectType: cfg.Redirect.DefaultType,
+			CacheTTL:            cfg.Redis.TTL,
+			CodeFilter:          codeFilter,
+			CacheKeys:           cacheKeys,
+			CacheGenerations:    generationStore,
+			WarmupWindow:        cfg.Cache.WarmupWindow,
+			BotClassifier:       botClassifier,
+		},
+	)
+
+	cleanup := func() {
+		redisClient.Close()
+		dbPool.Close()
+		logger.Sync()
+	}
+
+	return urlService, cleanup, nil
+}
+
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
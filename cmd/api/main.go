@@ -6,14 +6,26 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
+	// Time series accept IANA time zones, which the image may not ship
+	_ "time/tzdata"
 
+	"github.com/bajdzun/go-url-shortener/internal/analytics"
+	"github.com/bajdzun/go-url-shortener/internal/bloom"
+	"github.com/bajdzun/go-url-shortener/internal/cachekey"
+	"github.com/bajdzun/go-url-shortener/internal/clickinfo"
 	"github.com/bajdzun/go-url-shortener/internal/config"
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"github.com/bajdzun/go-url-shortener/internal/geoip"
 	"github.com/bajdzun/go-url-shortener/internal/handler"
 	custommiddleware "github.com/bajdzun/go-url-shortener/internal/middleware"
+	"github.com/bajdzun/go-url-shortener/internal/privacy"
 	"github.com/bajdzun/go-url-shortener/internal/repository"
 	"github.com/bajdzun/go-url-shortener/internal/service"
+	"github.com/bajdzun/go-url-shortener/internal/shortcode"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
@@ -23,6 +35,17 @@ import (
 	"go.uber.org/zap"
 )
 
+const (
+	shortCodeSequence = "short_code_seq"
+
+	// restartDelay is how long failed background listeners wait before
+	// trying again.
+	restartDelay = 5 * time.Second
+
+	defaultGenerationPollInterval = 5 * time.Second
+	defaultCodeFilterRebuild      = time.Hour
+)
+
 func main() {
 	// Load configuration
 	cfg, err := config.Load()
@@ -50,39 +73,218 @@ func main() {
 	defer dbPool.Close()
 	logger.Info("connected to PostgreSQL")
 
-	// Initialize Redis connection
-	redisClient := initRedis(cfg.Redis)
-	defer redisClient.Close()
+	// Background work shares one context, cancelled on the way out
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
 
-	// Test Redis connection
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	if err := redisClient.Ping(ctx).Err(); err != nil {
-		logger.Fatal("failed to connect to Redis", zap.Error(err))
+	// Initialize the cache; Redis failures degrade it instead of stopping us
+	cacheKeys := cachekey.New(cfg.Cache.KeyPrefix)
+	cacheRepo, redisClient, cacheHealth, err := initCache(backgroundCtx, cfg, cacheKeys, logger)
+	if err != nil {
+		logger.Fatal("failed to initialize cache", zap.Error(err))
+	}
+	if redisClient != nil {
+		defer redisClient.Close()
+	}
+
+	// Share cache flushes with other instances through Redis
+	var cacheGenerations domain.CacheGenerationStore
+	if redisClient != nil {
+		generationStore := repository.NewRedisGenerationStore(redisClient, cacheKeys.GenerationKey())
+		cacheGenerations = generationStore
+
+		loadCacheGeneration(backgroundCtx, generationStore, cacheKeys, logger)
+		go watchCacheGeneration(backgroundCtx, generationStore, cacheKeys, cfg.Cache.GenerationPollInterval, logger)
 	}
-	logger.Info("connected to Redis")
 
 	// Initialize repositories
 	urlRepo := repository.NewPostgresURLRepository(dbPool)
-	cacheRepo := repository.NewRedisCache(redisClient, cfg.Redis.TTL)
 	analyticsRepo := repository.NewPostgresAnalyticsRepository(dbPool)
 
+	codeGenerator, err := newShortCodeGenerator(cfg.ShortCode, repository.NewPostgresSequence(dbPool, shortCodeSequence))
+	if err != nil {
+		logger.Fatal("failed to initialize short code generator", zap.Error(err))
+	}
+
+	codeValidator := shortcode.NewValidator(shortcode.Rules{
+		MinLength: cfg.ShortCode.MinLength,
+		MaxLength: cfg.ShortCode.MaxLength,
+		Alphabet:  cfg.ShortCode.CustomAlphabet,
+		Reserved:  cfg.ShortCode.Reserved,
+		Denied:    cfg.ShortCode.DenyList,
+	})
+
+	// Load the filter of existing codes and keep it in sync with other
+	// instances, if there is Redis to sync it through
+	var codeFilter domain.CodeFilter
+	if cfg.Filter.ExpectedItems > 0 {
+		filter := bloom.New(cfg.Filter.ExpectedItems, cfg.Filter.FalsePositiveRate)
+		codeFilter = filter
+
+		if redisClient != nil {
+			syncedFilter := repository.NewSyncedCodeFilter(
+				filter,
+				repository.NewRedisBroadcaster(redisClient, repository.CodeFilterAddChannel),
+				repository.NewRedisBroadcaster(redisClient, repository.CodeFilterRemoveChannel),
+				logger,
+			)
+			codeFilter = syncedFilter
+
+			go runUntilDone(backgroundCtx, "code filter listener", logger, syncedFilter.Run)
+		}
+
+		go rebuildCodeFilter(backgroundCtx, filter, urlRepo, cfg.Filter.RebuildInterval, logger)
+	}
+
+	// Count clicks in Redis when we have it, so hot links do not contend on
+	// their row, and flush the counts to PostgreSQL periodically
+	var clickCounter domain.ClickCounter = repository.NewDirectClickCounter(urlRepo)
+	var redisClickCounter *repository.RedisClickCounter
+	if redisClient != nil {
+		redisClickCounter = repository.NewRedisClickCounter(redisClient, cacheKeys, urlRepo, cfg.Analytics.CounterFlushInterval, logger)
+		clickCounter = redisClickCounter
+
+		go runUntilDone(backgroundCtx, "click counter flush", logger, redisClickCounter.Run)
+	}
+
+	// Unique visitors are counted in Redis HyperLogLogs, so they need Redis
+	var visitorCounter domain.VisitorCounter
+	var redisVisitorCounter *repository.RedisVisitorCounter
+	if redisClient != nil {
+		redisVisitorCounter = repository.NewRedisVisitorCounter(redisClient, cacheKeys, analyticsRepo, cfg.Analytics.VisitorFlushInterval, logger)
+		visitorCounter = redisVisitorCounter
+
+		go runUntilDone(backgroundCtx, "unique visitor flush", logger, redisVisitorCounter.Run)
+	}
+
+	// Locate clicks from a local GeoIP database, picking up updates to it
+	var geoLocator domain.GeoLocator
+	if cfg.GeoIP.DatabasePath != "" {
+		resolver := geoip.NewResolver(cfg.GeoIP.DatabasePath, cfg.GeoIP.ReloadInterval, logger)
+		if err := resolver.Load(); err != nil {
+			logger.Error("failed to load GeoIP database, clicks are recorded without location until it loads", zap.Error(err))
+		}
+		geoLocator = resolver
+
+		go runUntilDone(backgroundCtx, "GeoIP reload", logger, resolver.Run)
+	}
+
+	// Recognise bots, which are recorded but not counted as clicks
+	botClassifier, err := clickinfo.NewClassifier(cfg.Analytics.BotPatterns, cfg.Analytics.BotNetworks)
+	if err != nil {
+		logger.Fatal("failed to initialize bot classifier", zap.Error(err))
+	}
+
+	// Decide what of each click may be stored
+	privacyPolicy, err := privacy.NewPolicy(privacy.Options{
+		IPMode:          privacy.IPMode(cfg.Privacy.IPMode),
+		HashKey:         cfg.Privacy.IPHashKey,
+		HonorDoNotTrack: cfg.Privacy.HonorDoNotTrack,
+	})
+	if err != nil {
+		logger.Fatal("failed to initialize privacy policy", zap.Error(err))
+	}
+
+	// Roll clicks up for the statistics endpoints
+	aggregator := analytics.NewAggregator(analyticsRepo, analytics.AggregatorOptions{
+		Interval:   cfg.Analytics.RollupInterval,
+		Classifier: botClassifier,
+	}, logger)
+	go runUntilDone(backgroundCtx, "click rollup", logger, aggregator.Run)
+
+	// Expire clicks past the retention period
+	if cfg.Privacy.RetentionPeriod > 0 {
+		retention, err := analytics.NewRetention(analyticsRepo, analytics.RetentionOptions{
+			MaxAge:   cfg.Privacy.RetentionPeriod,
+			Interval: cfg.Privacy.RetentionInterval,
+		}, logger)
+		if err != nil {
+			logger.Fatal("failed to initialize click retention", zap.Error(err))
+		}
+
+		go runUntilDone(backgroundCtx, "click retention", logger, retention.Run)
+	}
+
+	// Record clicks in batches off the redirect path
+	clickPipeline, err := analytics.NewPipeline(analyticsRepo, clickCounter, analytics.Options{
+		QueueSize:     cfg.Analytics.QueueSize,
+		Workers:       cfg.Analytics.Workers,
+		BatchSize:     cfg.Analytics.BatchSize,
+		FlushInterval: cfg.Analytics.FlushInterval,
+		Overflow:      analytics.OverflowPolicy(cfg.Analytics.OverflowPolicy),
+		BlockTimeout:  cfg.Analytics.BlockTimeout,
+		SpillDir:      cfg.Analytics.SpillDir,
+		Geo:           geoLocator,
+		Visitors:      visitorCounter,
+		Classifier:    botClassifier,
+		Privacy:       privacyPolicy,
+	}, logger)
+	if err != nil {
+		logger.Fatal("failed to initialize analytics pipeline", zap.Error(err))
+	}
+
 	// Initialize services
-	urlService := service.NewURLService(urlRepo, cacheRepo, analyticsRepo, logger, cfg.App.BaseURL)
+	urlService := service.NewURLService(urlRepo, cacheRepo, analyticsRepo, codeGenerator, logger, service.Config{
+		BaseURL:        cfg.App.BaseURL,
+		MaxCodeRetries: cfg.ShortCode.MaxRetries,
+		CodeValidator:  codeValidator,
+
+		DefaultRedirectType: cfg.Redirect.DefaultType,
+		RedirectCacheMaxAge: cfg.Redirect.CacheMaxAge,
+		CacheTTL:            cfg.Redis.TTL,
+		NegativeCacheTTL:    cfg.Cache.NegativeTTL,
+		CodeFilter:          codeFilter,
+		EarlyRefreshBeta:    cfg.Cache.EarlyRefreshBeta,
+		CacheKeys:           cacheKeys,
+		CacheGenerations:    cacheGenerations,
+		WarmupSize:          cfg.Cache.WarmupSize,
+		WarmupWindow:        cfg.Cache.WarmupWindow,
+		ClickRecorder:       clickPipeline,
+		ClickCounter:        clickCounter,
+		BotClassifier:       botClassifier,
+		Privacy:             privacyPolicy,
+	})
+
+	// Warm the cache in the background. WarmCache logs its own failures, and
+	// the instance becomes ready either way as it can serve from PostgreSQL.
+	var warmedUp atomic.Bool
+	if cfg.Cache.WarmupEnabled {
+		go func() {
+			defer warmedUp.Store(true)
+			urlService.WarmCache(backgroundCtx, 0)
+		}()
+	} else {
+		warmedUp.Store(true)
+	}
 
 	// Initialize handlers
 	urlHandler := handler.NewURLHandler(urlService, logger)
-	healthHandler := handler.NewHealthHandler()
+	healthHandler := handler.NewHealthHandler(map[string]handler.HealthCheck{
+		"cache": cacheHealth,
+	}, map[string]handler.HealthCheck{
+		"cache_warmup": func(ctx context.Context) handler.ComponentHealth {
+			if !warmedUp.Load() {
+				return handler.ComponentHealth{Status: handler.HealthNotReady, Detail: "warming up"}
+			}
+
+			return handler.ComponentHealth{Status: handler.HealthOK}
+		},
+	})
 
 	// Initialize rate limiter
 	rateLimiter := custommiddleware.NewRateLimiter(cfg.RateLimit.Requests, cfg.RateLimit.Requests/10)
 
+	realIP, err := custommiddleware.RealIP(cfg.App.TrustedProxies)
+	if err != nil {
+		logger.Fatal("failed to parse trusted proxies", zap.Error(err))
+	}
+
 	// Setup router
 	r := chi.NewRouter()
 
 	// Global middlewares
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
+	r.Use(realIP)
 	r.Use(custommiddleware.LoggingMiddleware(logger))
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.Timeout(60 * time.Second))
@@ -91,7 +293,7 @@ func main() {
 	// CORS configuration
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type"},
 		ExposedHeaders:   []string{"Link"},
 		AllowCredentials: false,
@@ -104,6 +306,7 @@ func main() {
 
 	// Health check endpoint
 	r.Get("/health", healthHandler.Health)
+	r.Get("/ready", healthHandler.Ready)
 
 	// Metrics endpoint
 	if cfg.Metrics.Enabled {
@@ -113,13 +316,26 @@ func main() {
 	// API routes
 	r.Route("/api/v1", func(r chi.Router) {
 		r.Post("/shorten", urlHandler.CreateShortURL)
+		r.Post("/shorten/batch", urlHandler.CreateShortURLBatch)
 		r.Get("/stats/{shortCode}", urlHandler.GetStats)
+		r.Get("/stats/{shortCode}/timeseries", urlHandler.GetTimeSeries)
+		r.Get("/stats/{shortCode}/breakdown/{dimension}", urlHandler.GetBreakdown)
+		r.Get("/urls", urlHandler.ListURLs)
+		r.Get("/urls/export", urlHandler.ExportURLs)
+		r.Post("/urls/import", urlHandler.ImportURLs)
+		r.Patch("/urls/{shortCode}", urlHandler.UpdateURL)
 		r.Delete("/urls/{shortCode}", urlHandler.DeleteURL)
+		r.Post("/admin/cache/flush", urlHandler.FlushCache)
+		r.Post("/admin/cache/warm", urlHandler.WarmCache)
+		r.Post("/admin/analytics/erase", urlHandler.EraseClicks)
 	})
 
 	// Redirect route (should be last)
 	r.Get("/{shortCode}", urlHandler.RedirectToOriginalURL)
 
+	// Keep custom codes from shadowing the routes registered above
+	codeValidator.Reserve(routeSegments(r)...)
+
 	// Start server
 	srv := &http.Server{
 		Addr:         ":" + cfg.App.Port,
@@ -156,6 +372,21 @@ func main() {
 		if err != nil {
 			logger.Fatal("server shutdown failed", zap.Error(err))
 		}
+
+		// No more redirects can arrive, so write the clicks still queued
+		if err := clickPipeline.Close(shutdownCtx); err != nil {
+			logger.Error("failed to flush clicks", zap.Error(err))
+		}
+		if redisClickCounter != nil {
+			if err := redisClickCounter.Flush(shutdownCtx); err != nil {
+				logger.Error("failed to flush click counts", zap.Error(err))
+			}
+		}
+		if redisVisitorCounter != nil {
+			if err := redisVisitorCounter.Flush(shutdownCtx); err != nil {
+				logger.Error("failed to save unique visitors", zap.Error(err))
+			}
+		}
 		serverStopCtx()
 	}()
 
@@ -171,6 +402,232 @@ func main() {
 	logger.Info("server stopped")
 }
 
+// routeSegments returns the first path segment of every static route, e.g.
+// "health" for /health and "api" for /api/v1/shorten.
+func routeSegments(routes chi.Routes) []string {
+	var segments []string
+	seen := make(map[string]bool)
+
+	chi.Walk(routes, func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		segment := strings.SplitN(strings.TrimPrefix(route, "/"), "/", 2)[0]
+		if segment != "" && !strings.HasPrefix(segment, "{") && !seen[segment] {
+			seen[segment] = true
+			segments = append(segments, segment)
+		}
+
+		return nil
+	})
+
+	return segments
+}
+
+// initCache builds the cache for the configured mode. In redis mode the Redis
+// client is returned as well, and Redis sits behind a circuit breaker so an
+// outage only costs cache hits. The breaker starts open when Redis is down at
+// startup, and starts a new cache generation when it missed too many deletes
+// to replay them.
+func initCache(ctx context.Context, cfg *config.Config, keys *cachekey.Builder, logger *zap.Logger) (domain.CacheRepository, redis.UniversalClient, handler.HealthCheck, error) {
+	switch cfg.Cache.Mode {
+	case config.CacheModeNone:
+		logger.Info("caching disabled")
+
+		return repository.NewNoopCache(), nil, staticHealth("disabled"), nil
+	case config.CacheModeMemory:
+		if cfg.Cache.LocalSize <= 0 {
+			return nil, nil, nil, fmt.Errorf("memory cache mode needs a positive CACHE_LOCAL_SIZE")
+		}
+		logger.Info("using in-memory cache")
+
+		return repository.NewMemoryCache(cfg.Cache.LocalSize, cfg.Redis.TTL), nil, staticHealth("memory"), nil
+	case config.CacheModeRedis, "":
+	default:
+		return nil, nil, nil, fmt.Errorf("unknown cache mode %q", cfg.Cache.Mode)
+	}
+
+	redisClient, err := initRedis(cfg.Redis)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	probe := func(ctx context.Context) error {
+		return redisClient.Ping(ctx).Err()
+	}
+	flush := func(ctx context.Context) error {
+		generation, err := repository.NewRedisGenerationStore(redisClient, keys.GenerationKey()).Bump(ctx)
+		if err != nil {
+			return err
+		}
+		keys.SetGeneration(generation)
+
+		return nil
+	}
+
+	breaker := repository.NewCircuitBreakerCache(
+		repository.NewRedisCache(redisClient, cfg.Redis.TTL),
+		probe,
+		flush,
+		cfg.Cache.BreakerThreshold,
+		cfg.Cache.BreakerProbeInterval,
+		logger,
+	)
+
+	pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := probe(pingCtx); err != nil {
+		logger.Error("Redis is unavailable, serving without cache until it recovers", zap.Error(err))
+		breaker.Open(err)
+	} else {
+		logger.Info("connected to Redis")
+	}
+	go breaker.Run(ctx)
+
+	var local *repository.MemoryCache
+	if cfg.Cache.LocalSize > 0 {
+		local = repository.NewMemoryCache(cfg.Cache.LocalSize, cfg.Cache.LocalTTL)
+	}
+
+	// Evict locally cached links when other instances change them
+	tiered := repository.NewTieredCache(local, breaker, repository.NewRedisBroadcaster(redisClient, repository.CacheInvalidationChannel), logger)
+	go runUntilDone(ctx, "cache invalidation listener", logger, tiered.Run)
+
+	health := func(ctx context.Context) handler.ComponentHealth {
+		state, err := breaker.State()
+		if state == repository.BreakerOpen {
+			component := handler.ComponentHealth{Status: handler.HealthDegraded, Detail: "redis circuit breaker open"}
+			if err != nil {
+				component.Detail += ": " + err.Error()
+			}
+
+			return component
+		}
+
+		return handler.ComponentHealth{Status: handler.HealthOK, Detail: "redis"}
+	}
+
+	return tiered, redisClient, health, nil
+}
+
+func staticHealth(detail string) handler.HealthCheck {
+	return func(ctx context.Context) handler.ComponentHealth {
+		return handler.ComponentHealth{Status: handler.HealthOK, Detail: detail}
+	}
+}
+
+// runUntilDone restarts fn after a pause whenever it returns, e.g. because
+// Redis was unreachable, until ctx is done.
+func runUntilDone(ctx context.Context, name string, logger *zap.Logger, fn func(ctx context.Context) error) {
+	for {
+		err := fn(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		logger.Warn("background task stopped, restarting", zap.String("task", name), zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(restartDelay):
+		}
+	}
+}
+
+// loadCacheGeneration adopts the shared cache generation. If Redis cannot be
+// reached the keys stay on the current generation until the next poll.
+func loadCacheGeneration(ctx context.Context, store domain.CacheGenerationStore, keys *cachekey.Builder, logger *zap.Logger) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	generation, err := store.Current(ctx)
+	if err != nil {
+		logger.Warn("failed to load cache generation", zap.Error(err))
+
+		return
+	}
+
+	if generation != keys.Generation() {
+		logger.Info("cache generation changed", zap.Int64("generation", generation))
+		keys.SetGeneration(generation)
+	}
+}
+
+// watchCacheGeneration polls the shared cache generation so flushes made by
+// other instances take effect here within one interval.
+func watchCacheGeneration(ctx context.Context, store domain.CacheGenerationStore, keys *cachekey.Builder, interval time.Duration, logger *zap.Logger) {
+	if interval <= 0 {
+		interval = defaultGenerationPollInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			loadCacheGeneration(ctx, store, keys, logger)
+		}
+	}
+}
+
+// rebuildCodeFilter loads the filter from the database, then reloads it every
+// interval to repair changes other instances failed to broadcast. Codes the
+// filter was missing until then are reported, as they were refused.
+func rebuildCodeFilter(ctx context.Context, filter *bloom.Filter, urlRepo domain.URLRepository, interval time.Duration, logger *zap.Logger) {
+	rebuild := func() {
+		start := time.Now()
+		missed := 0
+		err := filter.Rebuild(ctx, func(ctx context.Context, add func(code string)) error {
+			return urlRepo.ForEachShortCode(ctx, func(code string) error {
+				if !filter.MayContain(code) {
+					missed++
+				}
+				add(code)
+
+				return nil
+			})
+		})
+		if err != nil {
+			logger.Error("failed to rebuild code filter", zap.Error(err))
+
+			return
+		}
+		if missed > 0 {
+			logger.Warn("code filter missed existing codes", zap.Int("codes", missed))
+		}
+
+		logger.Info("code filter rebuilt", zap.Duration("duration", time.Since(start)))
+	}
+
+	rebuild()
+	if interval <= 0 {
+		interval = defaultCodeFilterRebuild
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rebuild()
+		}
+	}
+}
+
+func newShortCodeGenerator(cfg config.ShortCodeConfig, seq domain.SequenceRepository) (domain.ShortCodeGenerator, error) {
+	return shortcode.New(shortcode.Options{
+		Strategy:  cfg.Strategy,
+		Length:    cfg.Length,
+		Alphabet:  cfg.Alphabet,
+		Secret:    cfg.Secret,
+		WordCount: cfg.WordCount,
+		Separator: cfg.WordSeparator,
+	}, seq)
+}
+
 func initLogger(level string) (*zap.Logger, error) {
 	var cfg zap.Config
 	if level == "debug" {
@@ -207,10 +664,17 @@ func initDatabase(cfg config.DatabaseConfig) (*pgxpool.Pool, error) {
 	return pool, nil
 }
 
-func initRedis(cfg config.RedisConfig) *redis.Client {
-	return redis.NewClient(&redis.Options{
-		Addr:     cfg.Address(),
-		Password: cfg.Password,
-		DB:       cfg.DB,
+func initRedis(cfg config.RedisConfig) (redis.UniversalClient, error) {
+	return repository.NewRedisClient(repository.RedisClientOptions{
+		Mode:             cfg.Mode,
+		Addrs:            cfg.Addresses(),
+		MasterName:       cfg.MasterName,
+		Username:         cfg.Username,
+		Password:         cfg.Password,
+		SentinelPassword: cfg.SentinelPassword,
+		DB:               cfg.DB,
+		TLS:              cfg.TLS,
+		TLSCAFile:        cfg.TLSCAFile,
+		ReadFromReplica:  cfg.ReadFromReplica,
 	})
 }
@@ -0,0 +1,39 @@
+package analytics
+
+import (
+	"context"
+
+	"github.com/bajdzun/go-url-shortener/internal/clickinfo"
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+)
+
+// EnrichClicks enriches clicks recorded before browsers, devices and
+// referrers were derived at ingest, batchSize at a time, and returns how many
+// it updated. progress, if set, is called after every batch. It can be
+// stopped and resumed at any point.
+func EnrichClicks(ctx context.Context, clicks domain.AnalyticsRepository, classifier *clickinfo.Classifier, batchSize int, progress func(updated int)) (int, error) {
+	var updated int
+	var afterID int64
+	for {
+		batch, err := clicks.ListUnenrichedClicks(ctx, afterID, batchSize)
+		if err != nil {
+			return updated, err
+		}
+		if len(batch) == 0 {
+			return updated, nil
+		}
+
+		for _, click := range batch {
+			classifier.Enrich(click)
+		}
+		if err := clicks.UpdateClickDetails(ctx, batch); err != nil {
+			return updated, err
+		}
+
+		updated += len(batch)
+		afterID = batch[len(batch)-1].ID
+		if progress != nil {
+			progress(updated)
+		}
+	}
+}
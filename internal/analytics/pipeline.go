@@ -0,0 +1,464 @@
+// Package analytics moves clicks off the redirect path. Clicks are queued in
+// memory and written by a small pool of workers in batches, with one COPY of
+// the raw clicks and one aggregated click count update per batch.
+package analytics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/bajdzun/go-url-shortener/internal/clickinfo"
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"github.com/bajdzun/go-url-shortener/internal/privacy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+// OverflowPolicy decides what happens to a click when its queue is full.
+type OverflowPolicy string
+
+const (
+	// OverflowDrop discards the click.
+	OverflowDrop OverflowPolicy = "drop"
+	// OverflowBlock waits up to BlockTimeout for room, then drops the click.
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowSpill appends the click to a file in SpillDir, which is
+	// written to the database once the queues have room again.
+	OverflowSpill OverflowPolicy = "spill"
+)
+
+const (
+	defaultQueueSize     = 10000
+	defaultWorkers       = 4
+	defaultBatchSize     = 500
+	defaultFlushInterval = time.Second
+	defaultBlockTimeout  = 100 * time.Millisecond
+
+	writeTimeout   = 30 * time.Second
+	replayInterval = 10 * time.Second
+)
+
+var (
+	queueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "analytics_queue_depth",
+		Help: "Clicks waiting to be written",
+	})
+	eventsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analytics_events_dropped_total",
+		Help: "Clicks that were never written, by reason",
+	}, []string{"reason"})
+	eventsSpilled = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "analytics_events_spilled_total",
+		Help: "Clicks written to the spill directory",
+	})
+	eventsWritten = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "analytics_events_written_total",
+		Help: "Clicks written to the database",
+	})
+)
+
+type Options struct {
+	// QueueSize is the total number of clicks held in memory.
+	QueueSize     int
+	Workers       int
+	BatchSize     int
+	FlushInterval time.Duration
+	Overflow      OverflowPolicy
+	BlockTimeout  time.Duration
+	// SpillDir holds overflowing clicks with OverflowSpill, and clicks whose
+	// batch failed to write. It must not be shared between instances.
+	SpillDir string
+	// Geo fills in the location of clicks. Without it they have none.
+	Geo domain.GeoLocator
+	// Visitors counts unique visitors. Without it they are not counted.
+	Visitors domain.VisitorCounter
+	// Classifier derives click details and recognises bots, which are
+	// recorded but neither counted as clicks nor as visitors. It defaults to
+	// the built-in bot patterns.
+	Classifier *clickinfo.Classifier
+	// Privacy decides what of each click is stored or spilled. Clicks are
+	// enriched and their visitors counted before it applies, except that
+	// spilled clicks are counted as spilled. It defaults to storing
+	// everything.
+	Privacy *privacy.Policy
+}
+
+// Pipeline is a domain.ClickRecorder backed by Postgres. Clicks of the same
+// code always go to the same worker, so concurrent batches never update the
+// same click count rows when counts are written to Postgres directly.
+type Pipeline struct {
+	clicks domain.AnalyticsRepository
+	counts domain.ClickCounter
+	opts   Options
+	logger *zap.Logger
+
+	mu     sync.RWMutex
+	closed bool
+	queues []chan *domain.Analytics
+	spill  *spillFile
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewPipeline starts the workers. Close must be called to flush the queues.
+func NewPipeline(clicks domain.AnalyticsRepository, counts domain.ClickCounter, opts Options, logger *zap.Logger) (*Pipeline, error) {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaultQueueSize
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = defaultWorkers
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultFlushInterval
+	}
+	if opts.BlockTimeout <= 0 {
+		opts.BlockTimeout = defaultBlockTimeout
+	}
+	if opts.Classifier == nil {
+		opts.Classifier, _ = clickinfo.NewClassifier(nil, nil)
+	}
+	if opts.Privacy == nil {
+		opts.Privacy, _ = privacy.NewPolicy(privacy.Options{})
+	}
+
+	p := &Pipeline{
+		clicks: clicks,
+		counts: counts,
+		opts:   opts,
+		logger: logger,
+		stop:   make(chan struct{}),
+	}
+
+	switch opts.Overflow {
+	case OverflowDrop, OverflowBlock, "":
+	case OverflowSpill:
+		if opts.SpillDir == "" {
+			return nil, errors.New("spill overflow policy needs a spill directory")
+		}
+	default:
+		return nil, fmt.Errorf("unknown overflow policy %q", opts.Overflow)
+	}
+
+	if opts.SpillDir != "" {
+		spill, err := openSpillFile(opts.SpillDir, p.prepare)
+		if err != nil {
+			return nil, err
+		}
+		p.spill = spill
+	}
+
+	queueSize := opts.QueueSize / opts.Workers
+	if queueSize < 1 {
+		queueSize = 1
+	}
+
+	p.queues = make([]chan *domain.Analytics, opts.Workers)
+	for i := range p.queues {
+		p.queues[i] = make(chan *domain.Analytics, queueSize)
+
+		p.wg.Add(1)
+		go p.work(p.queues[i])
+	}
+
+	if p.spill != nil {
+		p.wg.Add(1)
+		go p.replayLoop()
+	}
+
+	return p, nil
+}
+
+// Record queues the click, applying the overflow policy when the queue is
+// full. It never blocks longer than BlockTimeout.
+func (p *Pipeline) Record(click *domain.Analytics) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		p.overflow("closed", click)
+
+		return
+	}
+
+	queue := p.queues[p.shard(click.ShortCode)]
+	select {
+	case queue <- click:
+		queueDepth.Inc()
+
+		return
+	default:
+	}
+
+	if p.opts.Overflow == OverflowBlock {
+		timer := time.NewTimer(p.opts.BlockTimeout)
+		defer timer.Stop()
+
+		select {
+		case queue <- click:
+			queueDepth.Inc()
+
+			return
+		case <-timer.C:
+		}
+	}
+
+	p.overflow("queue_full", click)
+}
+
+// Close stops accepting clicks and waits until the queued ones are written
+// or ctx is done, in which case the remaining clicks are lost.
+func (p *Pipeline) Close(ctx context.Context) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+
+		return nil
+	}
+	p.closed = true
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	close(p.stop)
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return fmt.Errorf("flush clicks: %w", ctx.Err())
+	}
+
+	if p.spill != nil {
+		return p.spill.Close()
+	}
+
+	return nil
+}
+
+func (p *Pipeline) shard(shortCode string) int {
+	h := fnv.New32a()
+	h.Write([]byte(shortCode))
+
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
+
+func (p *Pipeline) work(queue <-chan *domain.Analytics) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*domain.Analytics, 0, p.opts.BatchSize)
+	for {
+		select {
+		case click, ok := <-queue:
+			if !ok {
+				p.flush(batch)
+
+				return
+			}
+
+			queueDepth.Dec()
+			batch = append(batch, click)
+			if len(batch) >= p.opts.BatchSize {
+				p.flush(batch)
+				batch = make([]*domain.Analytics, 0, p.opts.BatchSize)
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				p.flush(batch)
+				batch = make([]*domain.Analytics, 0, p.opts.BatchSize)
+			}
+		}
+	}
+}
+
+// flush writes a batch, spilling it when the write fails and a spill
+// directory is configured.
+func (p *Pipeline) flush(batch []*domain.Analytics) {
+	if len(batch) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+
+	if err := p.write(ctx, batch); err != nil {
+		p.logger.Error("failed to write clicks", zap.Int("clicks", len(batch)), zap.Error(err))
+		p.overflow("write_error", batch...)
+	}
+}
+
+// prepare enriches the click, unless that was done before, and returns the
+// copy of it the privacy policy allows to store.
+func (p *Pipeline) prepare(click *domain.Analytics) *domain.Analytics {
+	// Enrichment always sets the device.
+	if click.Device == "" {
+		p.opts.Classifier.Enrich(click)
+		if p.opts.Geo != nil && click.Country == "" {
+			location := p.opts.Geo.Locate(click.IPAddress)
+			click.Country, click.Region, click.City = location.Country, location.Region, location.City
+		}
+	}
+
+	stored := *click
+	p.opts.Privacy.Apply(&stored)
+
+	return &stored
+}
+
+// write prepares and stores the clicks, then counts those not made by bots
+// and their unique visitors.
+func (p *Pipeline) write(ctx context.Context, batch []*domain.Analytics) error {
+	stored := make([]*domain.Analytics, len(batch))
+	for i, click := range batch {
+		stored[i] = p.prepare(click)
+	}
+
+	return p.store(ctx, batch, stored)
+}
+
+// store records the stored form of the clicks, then counts the clicks. Only
+// a failure to record them is returned: once they are in, retrying the batch
+// would record them twice, so a failed count update is logged and dropped.
+func (p *Pipeline) store(ctx context.Context, batch, stored []*domain.Analytics) error {
+	if err := p.clicks.RecordClicks(ctx, stored); err != nil {
+		return err
+	}
+	eventsWritten.Add(float64(len(batch)))
+
+	deltas := make(map[string]int64)
+	tracked := make([]*domain.Analytics, 0, len(batch))
+	counted := 0
+	for _, click := range batch {
+		if click.IsBot {
+			continue
+		}
+		deltas[click.ShortCode]++
+		counted++
+		if !p.opts.Privacy.OptedOut(click) {
+			tracked = append(tracked, click)
+		}
+	}
+	if counted == 0 {
+		return nil
+	}
+
+	if err := p.counts.Add(ctx, deltas); err != nil {
+		p.logger.Error("failed to update click counts", zap.Int("codes", len(deltas)), zap.Error(err))
+		eventsDropped.WithLabelValues("count_error").Add(float64(counted))
+	}
+
+	if p.opts.Visitors != nil && len(tracked) > 0 {
+		if err := p.opts.Visitors.Add(ctx, tracked); err != nil {
+			p.logger.Error("failed to count unique visitors", zap.Int("clicks", len(tracked)), zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// overflow spills the clicks when a spill directory is configured and drops
+// them otherwise, except that OverflowDrop and OverflowBlock never spill a
+// full queue. Clicks are spilled as they would be stored, so nothing the
+// privacy policy does not allow to store is ever written to disk.
+func (p *Pipeline) overflow(reason string, clicks ...*domain.Analytics) {
+	canSpill := p.spill != nil && (reason != "queue_full" || p.opts.Overflow == OverflowSpill)
+	if canSpill {
+		stored := make([]*domain.Analytics, len(clicks))
+		for i, click := range clicks {
+			stored[i] = p.prepare(click)
+		}
+
+		err := p.spill.Write(stored)
+		if err == nil {
+			eventsSpilled.Add(float64(len(clicks)))
+
+			return
+		}
+
+		p.logger.Error("failed to spill clicks", zap.Int("clicks", len(clicks)), zap.Error(err))
+		reason = "spill_error"
+	}
+
+	eventsDropped.WithLabelValues(reason).Add(float64(len(clicks)))
+}
+
+func (p *Pipeline) replayLoop() {
+	defer p.wg.Done()
+
+	p.replay()
+
+	ticker := time.NewTicker(replayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.replay()
+		}
+	}
+}
+
+// replay writes spilled clicks while the queues are at most half full, so
+// that catching up never competes with live traffic for long.
+func (p *Pipeline) replay() {
+	if p.busy() {
+		return
+	}
+
+	files, err := p.spill.Rotate()
+	if err != nil {
+		p.logger.Error("failed to rotate spill file", zap.Error(err))
+
+		return
+	}
+
+	for _, file := range files {
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+
+		replayed, err := p.spill.Replay(file, p.opts.BatchSize, func(batch []*domain.Analytics) error {
+			ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+			defer cancel()
+
+			// Spilled clicks are already prepared.
+			return p.store(ctx, batch, batch)
+		})
+		if err != nil {
+			p.logger.Error("failed to replay spilled clicks", zap.String("file", file), zap.Int("replayed", replayed), zap.Error(err))
+
+			return
+		}
+
+		p.logger.Info("replayed spilled clicks", zap.String("file", file), zap.Int("clicks", replayed))
+	}
+}
+
+func (p *Pipeline) busy() bool {
+	var queued, capacity int
+	for _, queue := range p.queues {
+		queued += len(queue)
+		capacity += cap(queue)
+	}
+
+	return queued > capacity/2
+}
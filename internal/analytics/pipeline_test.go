@@ -0,0 +1,310 @@
+package analytics
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"github.com/bajdzun/go-url-shortener/internal/privacy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeStore records what the pipeline writes. Writes wait on gate when it is
+// set and fail while fail is true.
+type fakeStore struct {
+	domain.AnalyticsRepository
+
+	mu     sync.Mutex
+	gate   chan struct{}
+	fail   bool
+	clicks []*domain.Analytics
+	counts map[string]int64
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{counts: make(map[string]int64)}
+}
+
+func (s *fakeStore) RecordClicks(ctx context.Context, clicks []*domain.Analytics) error {
+	if s.gate != nil {
+		<-s.gate
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fail {
+		return errors.New("database unavailable")
+	}
+	s.clicks = append(s.clicks, clicks...)
+
+	return nil
+}
+
+func (s *fakeStore) Add(ctx context.Context, deltas map[string]int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for code, delta := range deltas {
+		s.counts[code] += delta
+	}
+
+	return nil
+}
+
+func (s *fakeStore) Pending(ctx context.Context, shortCode string) (int64, error) {
+	return 0, nil
+}
+
+func (s *fakeStore) written() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.clicks)
+}
+
+func click(code string) *domain.Analytics {
+	return &domain.Analytics{ShortCode: code, ClickedAt: time.Now()}
+}
+
+func TestPipeline_FlushesAggregatedCountsOnClose(t *testing.T) {
+	store := newFakeStore()
+	pipeline, err := NewPipeline(store, store, Options{Workers: 2, BatchSize: 2, FlushInterval: time.Hour}, zap.NewNop())
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		pipeline.Record(click("abc"))
+	}
+	pipeline.Record(click("xyz"))
+	pipeline.Record(click("xyz"))
+
+	require.NoError(t, pipeline.Close(context.Background()))
+
+	assert.Equal(t, 5, store.written())
+	assert.Equal(t, map[string]int64{"abc": 3, "xyz": 2}, store.counts)
+}
+
+type fakeVisitors struct {
+	mu     sync.Mutex
+	clicks int
+}
+
+func (v *fakeVisitors) Add(ctx context.Context, clicks []*domain.Analytics) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.clicks += len(clicks)
+
+	return nil
+}
+
+type fakeLocator map[string]domain.GeoLocation
+
+func (l fakeLocator) Locate(ip string) domain.GeoLocation {
+	return l[ip]
+}
+
+func TestPipeline_EnrichesClicks(t *testing.T) {
+	store := newFakeStore()
+	geo := fakeLocator{"81.2.69.160": {Country: "GB", Region: "England", City: "London"}}
+	visitors := &fakeVisitors{}
+	pipeline, err := NewPipeline(store, store, Options{Workers: 1, Geo: geo, Visitors: visitors}, zap.NewNop())
+	require.NoError(t, err)
+
+	pipeline.Record(&domain.Analytics{
+		ShortCode: "abc",
+		IPAddress: "81.2.69.160",
+		UserAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0",
+		Referer:   "https://www.google.com/",
+	})
+	require.NoError(t, pipeline.Close(context.Background()))
+
+	require.Len(t, store.clicks, 1)
+	click := store.clicks[0]
+	assert.Equal(t, "Firefox", click.Browser)
+	assert.Equal(t, "google.com", click.ReferrerDomain)
+	assert.Equal(t, "GB", click.Country)
+	assert.Equal(t, "London", click.City)
+	assert.Equal(t, 1, visitors.clicks)
+}
+
+func TestPipeline_DoesNotCountBots(t *testing.T) {
+	store := newFakeStore()
+	visitors := &fakeVisitors{}
+	pipeline, err := NewPipeline(store, store, Options{Workers: 1, Visitors: visitors}, zap.NewNop())
+	require.NoError(t, err)
+
+	pipeline.Record(&domain.Analytics{ShortCode: "abc", UserAgent: "facebookexternalhit/1.1"})
+	pipeline.Record(&domain.Analytics{ShortCode: "abc", IsBot: true})
+	pipeline.Record(click("abc"))
+	require.NoError(t, pipeline.Close(context.Background()))
+
+	// Bot clicks are still stored, flagged, but not counted.
+	assert.Equal(t, 3, store.written())
+	assert.Equal(t, map[string]int64{"abc": 1}, store.counts)
+	assert.Equal(t, 1, visitors.clicks)
+}
+
+func TestPipeline_StoresWhatPrivacyAllows(t *testing.T) {
+	store := newFakeStore()
+	geo := fakeLocator{"81.2.69.160": {Country: "GB", Region: "England", City: "London"}}
+	visitors := &fakeVisitors{}
+	policy, err := privacy.NewPolicy(privacy.Options{IPMode: privacy.IPTruncate, HonorDoNotTrack: true})
+	require.NoError(t, err)
+	pipeline, err := NewPipeline(store, store, Options{Workers: 1, Geo: geo, Visitors: visitors, Privacy: policy}, zap.NewNop())
+	require.NoError(t, err)
+
+	pipeline.Record(&domain.Analytics{ShortCode: "abc", IPAddress: "81.2.69.160"})
+	pipeline.Record(&domain.Analytics{ShortCode: "abc", IPAddress: "81.2.69.160", DoNotTrack: true})
+	require.NoError(t, pipeline.Close(context.Background()))
+
+	require.Len(t, store.clicks, 2)
+	// Located before the address was truncated.
+	assert.Equal(t, "81.2.69.0", store.clicks[0].IPAddress)
+	assert.Equal(t, "London", store.clicks[0].City)
+	assert.Equal(t, "", store.clicks[1].IPAddress)
+	assert.Equal(t, "GB", store.clicks[1].Country)
+	assert.Equal(t, "", store.clicks[1].City)
+
+	// Both are counted, but only the first as a visitor.
+	assert.Equal(t, map[string]int64{"abc": 2}, store.counts)
+	assert.Equal(t, 1, visitors.clicks)
+}
+
+func TestPipeline_DropsWhenFull(t *testing.T) {
+	store := newFakeStore()
+	store.gate = make(chan struct{})
+	pipeline, err := NewPipeline(store, store, Options{QueueSize: 1, Workers: 1, BatchSize: 1}, zap.NewNop())
+	require.NoError(t, err)
+
+	// The first click is held by the worker and the second fills the queue.
+	pipeline.Record(click("abc"))
+	require.Eventually(t, func() bool { return len(pipeline.queues[0]) == 0 }, time.Second, time.Millisecond)
+	pipeline.Record(click("abc"))
+	pipeline.Record(click("abc"))
+
+	close(store.gate)
+	require.NoError(t, pipeline.Close(context.Background()))
+
+	assert.Equal(t, 2, store.written())
+}
+
+func TestPipeline_SpillsAndReplays(t *testing.T) {
+	dir := t.TempDir()
+	store := newFakeStore()
+	store.gate = make(chan struct{})
+	opts := Options{QueueSize: 1, Workers: 1, BatchSize: 1, Overflow: OverflowSpill, SpillDir: dir}
+
+	pipeline, err := NewPipeline(store, store, opts, zap.NewNop())
+	require.NoError(t, err)
+
+	pipeline.Record(click("abc"))
+	require.Eventually(t, func() bool { return len(pipeline.queues[0]) == 0 }, time.Second, time.Millisecond)
+	pipeline.Record(click("abc"))
+	for i := 0; i < 3; i++ {
+		pipeline.Record(click("xyz"))
+	}
+
+	close(store.gate)
+	require.NoError(t, pipeline.Close(context.Background()))
+	assert.Equal(t, 2, store.written())
+
+	// The next start replays what was spilled.
+	store.gate = nil
+	pipeline, err = NewPipeline(store, store, opts, zap.NewNop())
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return store.written() == 5 }, time.Second, 10*time.Millisecond)
+	require.NoError(t, pipeline.Close(context.Background()))
+
+	assert.Equal(t, map[string]int64{"abc": 2, "xyz": 3}, store.counts)
+}
+
+func TestPipeline_SpillsFailedWrites(t *testing.T) {
+	dir := t.TempDir()
+	store := newFakeStore()
+	store.fail = true
+	opts := Options{BatchSize: 10, SpillDir: dir}
+
+	pipeline, err := NewPipeline(store, store, opts, zap.NewNop())
+	require.NoError(t, err)
+
+	pipeline.Record(click("abc"))
+	pipeline.Record(click("abc"))
+	require.NoError(t, pipeline.Close(context.Background()))
+	assert.Equal(t, 0, store.written())
+
+	store.fail = false
+	pipeline, err = NewPipeline(store, store, opts, zap.NewNop())
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return store.written() == 2 }, time.Second, 10*time.Millisecond)
+	require.NoError(t, pipeline.Close(context.Background()))
+}
+
+func TestPipeline_SpillsWhatPrivacyAllows(t *testing.T) {
+	dir := t.TempDir()
+	store := newFakeStore()
+	store.fail = true
+	policy, err := privacy.NewPolicy(privacy.Options{IPMode: privacy.IPHash, HashKey: "secret"})
+	require.NoError(t, err)
+	opts := Options{Workers: 1, SpillDir: dir, Privacy: policy}
+
+	pipeline, err := NewPipeline(store, store, opts, zap.NewNop())
+	require.NoError(t, err)
+	pipeline.Record(&domain.Analytics{ShortCode: "abc", ClickedAt: time.Now(), IPAddress: "81.2.69.160"})
+	require.NoError(t, pipeline.Close(context.Background()))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	spilled, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.NotContains(t, string(spilled), "81.2.69.160")
+
+	// Replayed as spilled, without hashing the address again.
+	store.fail = false
+	pipeline, err = NewPipeline(store, store, opts, zap.NewNop())
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return store.written() == 1 }, time.Second, 10*time.Millisecond)
+	require.NoError(t, pipeline.Close(context.Background()))
+
+	assert.Len(t, store.clicks[0].IPAddress, 32)
+	assert.Equal(t, map[string]int64{"abc": 1}, store.counts)
+}
+
+func TestSpillFile_PreparesClicksSpilledRaw(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, spillPrefix+"1"+spillReadySuffix)
+	require.NoError(t, os.WriteFile(path, []byte(`{"short_code":"abc","ip_address":"81.2.69.160"}`+"\n"), 0o644))
+
+	spill, err := openSpillFile(dir, func(click *domain.Analytics) *domain.Analytics {
+		return &domain.Analytics{ShortCode: click.ShortCode, IPAddress: "81.2.69.0"}
+	})
+	require.NoError(t, err)
+
+	var replayed []*domain.Analytics
+	_, err = spill.Replay(path, 10, func(batch []*domain.Analytics) error {
+		replayed = append(replayed, batch...)
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, replayed, 1)
+	assert.Equal(t, "81.2.69.0", replayed[0].IPAddress)
+}
+
+func TestNewPipeline_InvalidOptions(t *testing.T) {
+	store := newFakeStore()
+
+	_, err := NewPipeline(store, store, Options{Overflow: OverflowSpill}, zap.NewNop())
+	assert.Error(t, err)
+
+	_, err = NewPipeline(store, store, Options{Overflow: "discard"}, zap.NewNop())
+	assert.Error(t, err)
+}
@@ -0,0 +1,97 @@
+package analytics
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultRetentionInterval  = time.Hour
+	defaultRetentionBatchSize = 10000
+)
+
+var clicksExpired = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "analytics_clicks_expired_total",
+	Help: "Clicks removed for being older than the retention period",
+})
+
+type RetentionOptions struct {
+	// MaxAge is how long clicks are kept.
+	MaxAge   time.Duration
+	Interval time.Duration
+	// BatchSize bounds the clicks expired per statement, so that no
+	// transaction holds many rows.
+	BatchSize int
+}
+
+// Retention deletes clicks older than the retention period once they are
+// rolled up, so statistics keep counting them without anything identifying
+// their visitors.
+type Retention struct {
+	clicks domain.AnalyticsRepository
+	opts   RetentionOptions
+	logger *zap.Logger
+}
+
+func NewRetention(clicks domain.AnalyticsRepository, opts RetentionOptions, logger *zap.Logger) (*Retention, error) {
+	if opts.MaxAge <= 0 {
+		return nil, fmt.Errorf("invalid retention period %s", opts.MaxAge)
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaultRetentionInterval
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultRetentionBatchSize
+	}
+
+	return &Retention{clicks: clicks, opts: opts, logger: logger}, nil
+}
+
+// Run expires clicks right away and then every interval until ctx is done.
+func (r *Retention) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := r.Expire(ctx); err != nil && ctx.Err() == nil {
+			r.logger.Error("failed to expire clicks", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Expire deletes the clicks older than the retention period, in batches,
+// and returns how many it deleted.
+func (r *Retention) Expire(ctx context.Context) (int64, error) {
+	cutoff := time.Now().Add(-r.opts.MaxAge)
+
+	var total int64
+	for {
+		expired, err := r.clicks.ExpireClicks(ctx, cutoff, r.opts.BatchSize)
+		total += expired
+		clicksExpired.Add(float64(expired))
+		if err != nil {
+			return total, err
+		}
+		if expired < int64(r.opts.BatchSize) {
+			break
+		}
+	}
+
+	if total > 0 {
+		r.logger.Info("expired clicks", zap.Int64("clicks", total), zap.Time("before", cutoff))
+	}
+
+	return total, nil
+}
@@ -0,0 +1,102 @@
+package analytics
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bajdzun/go-url-shortener/internal/clickinfo"
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// batchStore holds clicks that are all past their retention period and not
+// rolled up yet.
+type batchStore struct {
+	domain.AnalyticsRepository
+	remaining int64
+	calls     int
+}
+
+func (s *batchStore) take(limit int) int64 {
+	s.calls++
+
+	taken := s.remaining
+	if taken > int64(limit) {
+		taken = int64(limit)
+	}
+	s.remaining -= taken
+
+	return taken
+}
+
+func (s *batchStore) ExpireClicks(ctx context.Context, cutoff time.Time, limit int) (int64, error) {
+	return s.take(limit), nil
+}
+
+func (s *batchStore) ListUnenrichedClicks(ctx context.Context, afterID int64, limit int) ([]*domain.Analytics, error) {
+	clicks := make([]*domain.Analytics, s.take(limit))
+	for i := range clicks {
+		clicks[i] = &domain.Analytics{ID: afterID + int64(i) + 1, UserAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)"}
+	}
+
+	return clicks, nil
+}
+
+func (s *batchStore) UpdateClickDetails(ctx context.Context, clicks []*domain.Analytics) error {
+	for _, click := range clicks {
+		if click.Device == "" {
+			return errors.New("click not enriched")
+		}
+	}
+
+	return nil
+}
+
+func (s *batchStore) RollUpClicks(ctx context.Context, limit int) (int64, error) {
+	return s.take(limit), nil
+}
+
+func TestRetention_ExpiresInBatches(t *testing.T) {
+	store := &batchStore{remaining: 25}
+	retention, err := NewRetention(store, RetentionOptions{MaxAge: 24 * time.Hour, BatchSize: 10}, zap.NewNop())
+	require.NoError(t, err)
+
+	expired, err := retention.Expire(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(25), expired)
+	assert.Equal(t, 3, store.calls)
+}
+
+func TestEnrichClicks_EnrichesInBatches(t *testing.T) {
+	store := &batchStore{remaining: 15}
+	classifier, err := clickinfo.NewClassifier(nil, nil)
+	require.NoError(t, err)
+
+	var progress []int
+	enriched, err := EnrichClicks(context.Background(), store, classifier, 10, func(updated int) {
+		progress = append(progress, updated)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 15, enriched)
+	assert.Equal(t, []int{10, 15}, progress)
+}
+
+func TestAggregator_RollsUpInBatches(t *testing.T) {
+	store := &batchStore{remaining: 20}
+	aggregator := NewAggregator(store, AggregatorOptions{BatchSize: 10}, zap.NewNop())
+
+	rolledUp, err := aggregator.RollUp(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(20), rolledUp)
+	// The last, empty batch tells it is done.
+	assert.Equal(t, 3, store.calls)
+}
+
+func TestNewRetention_InvalidPeriod(t *testing.T) {
+	_, err := NewRetention(&batchStore{}, RetentionOptions{}, zap.NewNop())
+	assert.Error(t, err)
+}
@@ -0,0 +1,97 @@
+package analytics
+
+import (
+	"context"
+	"time"
+
+	"github.com/bajdzun/go-url-shortener/internal/clickinfo"
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultRollupInterval  = time.Minute
+	defaultRollupBatchSize = 10000
+)
+
+var clicksRolledUp = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "analytics_clicks_rolled_up_total",
+	Help: "Clicks added to the hourly and daily rollups",
+})
+
+type AggregatorOptions struct {
+	Interval time.Duration
+	// BatchSize bounds the clicks rolled up per statement.
+	BatchSize int
+	// Classifier enriches clicks recorded before enrichment existed, which
+	// are only rolled up once enriched. It defaults to the built-in bot
+	// patterns.
+	Classifier *clickinfo.Classifier
+}
+
+// Aggregator keeps the click rollups up to date. Statistics read what it
+// has not rolled up yet from the clicks themselves, so the interval only
+// decides how much of that there is.
+type Aggregator struct {
+	clicks domain.AnalyticsRepository
+	opts   AggregatorOptions
+	logger *zap.Logger
+}
+
+func NewAggregator(clicks domain.AnalyticsRepository, opts AggregatorOptions, logger *zap.Logger) *Aggregator {
+	if opts.Interval <= 0 {
+		opts.Interval = defaultRollupInterval
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultRollupBatchSize
+	}
+	if opts.Classifier == nil {
+		opts.Classifier, _ = clickinfo.NewClassifier(nil, nil)
+	}
+
+	return &Aggregator{clicks: clicks, opts: opts, logger: logger}
+}
+
+// Run rolls clicks up right away and then every interval until ctx is done.
+// Clicks recorded before enrichment existed are enriched first.
+func (a *Aggregator) Run(ctx context.Context) error {
+	ticker := time.NewTicker(a.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		if enriched, err := EnrichClicks(ctx, a.clicks, a.opts.Classifier, a.opts.BatchSize, nil); err != nil && ctx.Err() == nil {
+			a.logger.Error("failed to enrich clicks", zap.Error(err))
+		} else if enriched > 0 {
+			a.logger.Info("enriched clicks to roll them up", zap.Int("clicks", enriched))
+		}
+		if _, err := a.RollUp(ctx); err != nil && ctx.Err() == nil {
+			a.logger.Error("failed to roll up clicks", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// RollUp adds the clicks recorded since the last run to the rollups, in
+// batches, and returns how many it added. Another instance rolling up at
+// the same time makes it stop early.
+func (a *Aggregator) RollUp(ctx context.Context) (int64, error) {
+	var total int64
+	for {
+		rolledUp, err := a.clicks.RollUpClicks(ctx, a.opts.BatchSize)
+		total += rolledUp
+		clicksRolledUp.Add(float64(rolledUp))
+		if err != nil {
+			return total, err
+		}
+		if rolledUp < int64(a.opts.BatchSize) {
+			return total, nil
+		}
+	}
+}
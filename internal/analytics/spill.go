@@ -0,0 +1,189 @@
+package analytics
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+)
+
+const (
+	spillPrefix = "clicks-"
+	// Clicks are appended to a file ending in spillOpenSuffix. Rotating it
+	// renames it to spillReadySuffix, and only those files are replayed.
+	spillOpenSuffix  = ".ndjson.open"
+	spillReadySuffix = ".ndjson"
+)
+
+// spillFile appends clicks as JSON lines to files in a directory.
+type spillFile struct {
+	dir string
+	// prepare turns a click spilled before the privacy policy applied to
+	// spilled clicks into what may be stored.
+	prepare func(click *domain.Analytics) *domain.Analytics
+
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// spilledClick is a line of a spill file. Anonymized is unset in files
+// written before the privacy policy applied to spilled clicks.
+type spilledClick struct {
+	*domain.Analytics
+	Anonymized bool `json:"anonymized,omitempty"`
+}
+
+// openSpillFile prepares dir. Files left open by a crash are marked ready,
+// so their clicks are replayed.
+func openSpillFile(dir string, prepare func(click *domain.Analytics) *domain.Analytics) (*spillFile, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create spill directory: %w", err)
+	}
+
+	leftovers, err := filepath.Glob(filepath.Join(dir, spillPrefix+"*"+spillOpenSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range leftovers {
+		if err := os.Rename(path, readyPath(path)); err != nil {
+			return nil, err
+		}
+	}
+
+	return &spillFile{dir: dir, prepare: prepare}, nil
+}
+
+// Write appends clicks the privacy policy has been applied to.
+func (s *spillFile) Write(clicks []*domain.Analytics) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		name := fmt.Sprintf("%s%d%s", spillPrefix, time.Now().UnixNano(), spillOpenSuffix)
+		file, err := os.OpenFile(filepath.Join(s.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		s.file = file
+		s.encoder = json.NewEncoder(file)
+	}
+
+	for _, click := range clicks {
+		if err := s.encoder.Encode(spilledClick{Analytics: click, Anonymized: true}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Rotate closes the file being written and returns every file ready to be
+// replayed, oldest first.
+func (s *spillFile) Rotate() ([]string, error) {
+	if err := s.Close(); err != nil {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(s.dir, spillPrefix+"*"+spillReadySuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// Replay passes the clicks in path to write in batches, in the form they may
+// be stored, and removes the file. When a batch fails, it and the clicks after it are spilled again, so that
+// nothing is lost or written twice.
+func (s *spillFile) Replay(path string, batchSize int, write func(batch []*domain.Analytics) error) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var replayed int
+	var failure error
+	batch := make([]*domain.Analytics, 0, batchSize)
+
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for decoder.More() {
+		record := spilledClick{Analytics: &domain.Analytics{}}
+		if err := decoder.Decode(&record); err != nil {
+			// The rest of a file cut short by a crash cannot be recovered.
+			break
+		}
+		click := record.Analytics
+		if !record.Anonymized {
+			click = s.prepare(click)
+		}
+		batch = append(batch, click)
+
+		if len(batch) < batchSize {
+			continue
+		}
+		if failure == nil {
+			if failure = write(batch); failure == nil {
+				replayed += len(batch)
+				batch = batch[:0]
+
+				continue
+			}
+		}
+		if err := s.Write(batch); err != nil {
+			return replayed, err
+		}
+		batch = batch[:0]
+	}
+
+	if len(batch) > 0 {
+		if failure == nil {
+			if failure = write(batch); failure == nil {
+				replayed += len(batch)
+			}
+		}
+		if failure != nil {
+			if err := s.Write(batch); err != nil {
+				return replayed, err
+			}
+		}
+	}
+
+	if err := os.Remove(path); err != nil {
+		return replayed, err
+	}
+
+	return replayed, failure
+}
+
+func (s *spillFile) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	path := s.file.Name()
+	err := s.file.Close()
+	s.file = nil
+	s.encoder = nil
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path, readyPath(path))
+}
+
+func readyPath(path string) string {
+	return strings.TrimSuffix(path, spillOpenSuffix) + spillReadySuffix
+}
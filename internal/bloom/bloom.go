@@ -0,0 +1,166 @@
+// Package bloom implements a counting Bloom filter of short codes, used to
+// answer "definitely absent" without touching storage.
+package bloom
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"sync"
+)
+
+const (
+	defaultFalsePositiveRate = 0.01
+	maxCount                 = math.MaxUint8
+)
+
+// Filter is a counting Bloom filter, so codes can be removed as well as
+// added. Until the first Rebuild completes it reports every code as possibly
+// present.
+type Filter struct {
+	mu       sync.RWMutex
+	counts   []uint8
+	building []uint8
+	hashes   int
+	ready    bool
+}
+
+// New sizes a filter for expectedItems codes at the given false positive
+// rate. The rate degrades gracefully when more codes are added.
+func New(expectedItems int, falsePositiveRate float64) *Filter {
+	if expectedItems <= 0 {
+		expectedItems = 1
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		falsePositiveRate = defaultFalsePositiveRate
+	}
+
+	size := math.Ceil(-float64(expectedItems) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashes := int(math.Round(size / float64(expectedItems) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+
+	return &Filter{
+		counts: make([]uint8, int(size)),
+		hashes: hashes,
+	}
+}
+
+func (f *Filter) Add(code string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.add(f.counts, code)
+	if f.building != nil {
+		f.add(f.building, code)
+	}
+}
+
+// Remove ignores codes the filter does not hold, such as codes created
+// after a rebuild started loading, whose counters would otherwise be
+// decremented for other codes.
+func (f *Filter) Remove(code string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.remove(f.counts, code)
+	if f.building != nil {
+		f.remove(f.building, code)
+	}
+}
+
+// MayContain reports false only for codes that were never added or have been
+// removed since.
+func (f *Filter) MayContain(code string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if !f.ready {
+		return true
+	}
+
+	for _, index := range f.indexes(code) {
+		if f.counts[index] == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Ready reports whether the filter has been built at least once.
+func (f *Filter) Ready() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.ready
+}
+
+// Rebuild replaces the filter contents with the codes produced by load. Adds
+// and removes that happen while load runs are applied to the new contents as
+// well, so no code is lost to the swap.
+func (f *Filter) Rebuild(ctx context.Context, load func(ctx context.Context, add func(code string)) error) error {
+	f.mu.Lock()
+	f.building = make([]uint8, len(f.counts))
+	f.mu.Unlock()
+
+	err := load(ctx, func(code string) {
+		f.mu.Lock()
+		f.add(f.building, code)
+		f.mu.Unlock()
+	})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err == nil {
+		f.counts = f.building
+		f.ready = true
+	}
+	f.building = nil
+
+	return err
+}
+
+func (f *Filter) add(counts []uint8, code string) {
+	for _, index := range f.indexes(code) {
+		if counts[index] < maxCount {
+			counts[index]++
+		}
+	}
+}
+
+// remove leaves saturated counters alone; their true count is unknown, so
+// they can only ever cause false positives.
+func (f *Filter) remove(counts []uint8, code string) {
+	indexes := f.indexes(code)
+	for _, index := range indexes {
+		if counts[index] == 0 {
+			return
+		}
+	}
+
+	for _, index := range indexes {
+		if counts[index] < maxCount {
+			counts[index]--
+		}
+	}
+}
+
+// indexes derives the counter positions from two halves of a 64-bit hash.
+func (f *Filter) indexes(code string) []uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(code))
+	sum := hash.Sum64()
+
+	h1, h2 := sum&math.MaxUint32, sum>>32
+	size := uint64(len(f.counts))
+
+	indexes := make([]uint64, f.hashes)
+	for i := range indexes {
+		indexes[i] = (h1 + uint64(i)*h2) % size
+	}
+
+	return indexes
+}
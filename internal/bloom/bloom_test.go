@@ -0,0 +1,122 @@
+package bloom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func loadCodes(codes ...string) func(ctx context.Context, add func(string)) error {
+	return func(ctx context.Context, add func(string)) error {
+		for _, code := range codes {
+			add(code)
+		}
+
+		return nil
+	}
+}
+
+func TestFilter_MayContainEverythingUntilBuilt(t *testing.T) {
+	filter := New(100, 0.01)
+
+	assert.False(t, filter.Ready())
+	assert.True(t, filter.MayContain("anything"))
+
+	require.NoError(t, filter.Rebuild(context.Background(), loadCodes("abc123")))
+
+	assert.True(t, filter.Ready())
+	assert.True(t, filter.MayContain("abc123"))
+	assert.False(t, filter.MayContain("anything"))
+}
+
+func TestFilter_NoFalseNegatives(t *testing.T) {
+	filter := New(1000, 0.01)
+	require.NoError(t, filter.Rebuild(context.Background(), loadCodes()))
+
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		filter.Add(fmt.Sprintf("code%d", i))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.True(t, filter.MayContain(fmt.Sprintf("code%d", i)))
+		if filter.MayContain(fmt.Sprintf("other%d", i)) {
+			falsePositives++
+		}
+	}
+
+	assert.Less(t, falsePositives, 50)
+}
+
+func TestFilter_Remove(t *testing.T) {
+	filter := New(100, 0.01)
+	require.NoError(t, filter.Rebuild(context.Background(), loadCodes("keep", "drop")))
+
+	filter.Remove("drop")
+
+	assert.True(t, filter.MayContain("keep"))
+	assert.False(t, filter.MayContain("drop"))
+}
+
+func TestFilter_RebuildKeepsConcurrentAdds(t *testing.T) {
+	filter := New(100, 0.01)
+
+	err := filter.Rebuild(context.Background(), func(ctx context.Context, add func(string)) error {
+		add("loaded")
+		filter.Add("created")
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	assert.True(t, filter.MayContain("loaded"))
+	assert.True(t, filter.MayContain("created"))
+}
+
+func TestFilter_RemoveDuringRebuildKeepsLoadedCodes(t *testing.T) {
+	filter := New(100, 0.01)
+
+	// A code sharing some, but not all, of its counters with the loaded one.
+	unloaded := ""
+	for i := 0; unloaded == ""; i++ {
+		code := fmt.Sprintf("unloaded%d", i)
+		shared := 0
+		for _, index := range filter.indexes(code) {
+			for _, loaded := range filter.indexes("loaded") {
+				if index == loaded {
+					shared++
+				}
+			}
+		}
+		if shared > 0 && shared < filter.hashes {
+			unloaded = code
+		}
+	}
+
+	err := filter.Rebuild(context.Background(), func(ctx context.Context, add func(string)) error {
+		add("loaded")
+		// Deleted before the rebuild loaded it, or created after.
+		filter.Remove(unloaded)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	assert.True(t, filter.MayContain("loaded"))
+	assert.False(t, filter.MayContain(unloaded))
+}
+
+func TestFilter_FailedRebuildKeepsContents(t *testing.T) {
+	filter := New(100, 0.01)
+	require.NoError(t, filter.Rebuild(context.Background(), loadCodes("abc123")))
+
+	err := filter.Rebuild(context.Background(), func(ctx context.Context, add func(string)) error {
+		return errors.New("connection lost")
+	})
+
+	assert.Error(t, err)
+	assert.True(t, filter.MayContain("abc123"))
+}
@@ -0,0 +1,75 @@
+// Package cachekey builds the keys everything in the shared cache is stored
+// under, so the service can share a Redis database with other data.
+//
+// Link records and negative entries are scoped by FormatVersion and by a
+// generation number. Bumping the generation orphans every cached link at
+// once; the old keys simply age out. Counters are kept outside generations,
+// as flushing must not lose them.
+package cachekey
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// FormatVersion is the version of the cached link record. Bump it whenever
+// the record changes incompatibly, so old and new instances never read each
+// other's values during a rollout.
+const FormatVersion = 1
+
+const DefaultPrefix = "urlshortener"
+
+const (
+	NamespaceLink     = "link"
+	NamespaceNegative = "neg"
+	NamespaceCounter  = "ctr"
+	NamespaceMeta     = "meta"
+)
+
+type Builder struct {
+	prefix     string
+	generation atomic.Int64
+}
+
+func New(prefix string) *Builder {
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+
+	return &Builder{prefix: prefix}
+}
+
+// Link is the key of the cached record of a short code.
+func (b *Builder) Link(shortCode string) string {
+	return b.scoped(NamespaceLink, shortCode)
+}
+
+// Negative is the key remembering that a short code does not exist.
+func (b *Builder) Negative(shortCode string) string {
+	return b.scoped(NamespaceNegative, shortCode)
+}
+
+// Counter is the key of a named counter. Counters survive generation bumps.
+func (b *Builder) Counter(name string) string {
+	return b.prefix + ":" + NamespaceCounter + ":" + name
+}
+
+// GenerationKey is where the shared generation number is stored.
+func (b *Builder) GenerationKey() string {
+	return b.prefix + ":" + NamespaceMeta + ":generation"
+}
+
+func (b *Builder) Generation() int64 {
+	return b.generation.Load()
+}
+
+func (b *Builder) SetGeneration(generation int64) {
+	b.generation.Store(generation)
+}
+
+func (b *Builder) scoped(namespace, id string) string {
+	return b.prefix + ":" + namespace +
+		":v" + strconv.Itoa(FormatVersion) +
+		":g" + strconv.FormatInt(b.generation.Load(), 10) +
+		":" + id
+}
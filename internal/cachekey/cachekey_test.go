@@ -0,0 +1,25 @@
+package cachekey
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuilder_Keys(t *testing.T) {
+	keys := New("app")
+
+	assert.Equal(t, "app:link:v1:g0:abc123", keys.Link("abc123"))
+	assert.Equal(t, "app:neg:v1:g0:abc123", keys.Negative("abc123"))
+	assert.Equal(t, "app:ctr:clicks", keys.Counter("clicks"))
+	assert.Equal(t, "app:meta:generation", keys.GenerationKey())
+}
+
+func TestBuilder_GenerationScopesLinksOnly(t *testing.T) {
+	keys := New("")
+	keys.SetGeneration(7)
+
+	assert.Equal(t, "urlshortener:link:v1:g7:abc123", keys.Link("abc123"))
+	assert.Equal(t, "urlshortener:neg:v1:g7:abc123", keys.Negative("abc123"))
+	assert.Equal(t, "urlshortener:ctr:clicks", keys.Counter("clicks"))
+}
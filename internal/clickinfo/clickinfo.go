@@ -0,0 +1,249 @@
+// Package clickinfo derives the browser, operating system, device class and
+// referring site of a click from its raw headers, and tells bots from people.
+package clickinfo
+
+import (
+	_ "embed"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+)
+
+//go:embed bots.txt
+var botList string
+
+const (
+	Other = "Other"
+
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceBot     = "bot"
+	DeviceOther   = "other"
+)
+
+type UserAgent struct {
+	Browser string
+	OS      string
+	Device  string
+	Bot     bool
+}
+
+type pattern struct {
+	token string
+	name  string
+}
+
+// Order matters: most browsers also claim to be the ones they are built on,
+// so Edge says Chrome and Safari, and Chrome says Safari.
+var browsers = []pattern{
+	{"edg/", "Edge"},
+	{"edga/", "Edge"},
+	{"edgios/", "Edge"},
+	{"opr/", "Opera"},
+	{"opera", "Opera"},
+	{"samsungbrowser/", "Samsung Internet"},
+	{"yabrowser/", "Yandex Browser"},
+	{"ucbrowser/", "UC Browser"},
+	{"firefox/", "Firefox"},
+	{"fxios/", "Firefox"},
+	{"crios/", "Chrome"},
+	{"chromium/", "Chromium"},
+	{"chrome/", "Chrome"},
+	{"msie ", "Internet Explorer"},
+	{"trident/", "Internet Explorer"},
+	{"safari/", "Safari"},
+}
+
+var systems = []pattern{
+	{"windows phone", "Windows Phone"},
+	{"windows", "Windows"},
+	{"iphone", "iOS"},
+	{"ipad", "iOS"},
+	{"ipod", "iOS"},
+	{"android", "Android"},
+	{"cros", "Chrome OS"},
+	{"mac os x", "macOS"},
+	{"macintosh", "macOS"},
+	{"linux", "Linux"},
+}
+
+// referrerAliases maps the redirect hosts that social networks put in front
+// of outbound links to the network itself.
+var referrerAliases = map[string]string{
+	"t.co":                  "twitter.com",
+	"x.com":                 "twitter.com",
+	"l.facebook.com":        "facebook.com",
+	"lm.facebook.com":       "facebook.com",
+	"l.instagram.com":       "instagram.com",
+	"lnkd.in":               "linkedin.com",
+	"out.reddit.com":        "reddit.com",
+	"old.reddit.com":        "reddit.com",
+	"away.vk.com":           "vk.com",
+	"l.messenger.com":       "messenger.com",
+	"com.google.android.gm": "mail.google.com",
+}
+
+// Classifier derives the details of clicks and tells bots from people, by
+// their user agent or by the network they come from.
+type Classifier struct {
+	botPatterns []string
+	botNetworks []*net.IPNet
+}
+
+var defaultClassifier, _ = NewClassifier(nil, nil)
+
+// NewClassifier adds botPatterns, matched case-insensitively anywhere in the
+// user agent, to the built-in list, and treats clicks from botNetworks, in
+// CIDR notation, as bots.
+func NewClassifier(botPatterns, botNetworks []string) (*Classifier, error) {
+	c := &Classifier{}
+	for _, line := range append(strings.Split(botList, "\n"), botPatterns...) {
+		line = strings.ToLower(strings.TrimSpace(line))
+		if line != "" && !strings.HasPrefix(line, "#") {
+			c.botPatterns = append(c.botPatterns, line)
+		}
+	}
+
+	for _, cidr := range botNetworks {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid bot network %q: %w", cidr, err)
+		}
+		c.botNetworks = append(c.botNetworks, network)
+	}
+
+	return c, nil
+}
+
+// ParseUserAgent uses the built-in bot patterns.
+func ParseUserAgent(raw string) UserAgent {
+	return defaultClassifier.ParseUserAgent(raw)
+}
+
+// Enrich uses the built-in bot patterns.
+func Enrich(click *domain.Analytics) {
+	defaultClassifier.Enrich(click)
+}
+
+func (c *Classifier) ParseUserAgent(raw string) UserAgent {
+	ua := strings.ToLower(raw)
+	info := UserAgent{
+		Browser: match(ua, browsers),
+		OS:      match(ua, systems),
+	}
+
+	for _, pattern := range c.botPatterns {
+		if strings.Contains(ua, pattern) {
+			info.Bot = true
+			break
+		}
+	}
+
+	switch {
+	case info.Bot:
+		info.Device = DeviceBot
+	case strings.Contains(ua, "ipad") || strings.Contains(ua, "tablet") ||
+		(strings.Contains(ua, "android") && !strings.Contains(ua, "mobile")):
+		info.Device = DeviceTablet
+	case strings.Contains(ua, "mobi") || strings.Contains(ua, "iphone") || strings.Contains(ua, "ipod"):
+		info.Device = DeviceMobile
+	case info.OS == "Windows" || info.OS == "macOS" || info.OS == "Linux" || info.OS == "Chrome OS":
+		info.Device = DeviceDesktop
+	default:
+		info.Device = DeviceOther
+	}
+
+	return info
+}
+
+// ReferrerDomain reduces a Referer header to the site it came from, without
+// a leading "www." or "m.". It is empty for direct visits and malformed
+// headers.
+func ReferrerDomain(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return ""
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".")
+	// Android apps send android-app://<package>
+	if parsed.Scheme == "android-app" {
+		if alias, ok := referrerAliases[host]; ok {
+			return alias
+		}
+
+		return host
+	}
+	for _, prefix := range []string{"www.", "m.", "mobile."} {
+		host = strings.TrimPrefix(host, prefix)
+	}
+	if alias, ok := referrerAliases[host]; ok {
+		return alias
+	}
+
+	return host
+}
+
+// Enrich fills in the details derived from the click's headers. A click
+// already flagged as a bot stays one.
+func (c *Classifier) Enrich(click *domain.Analytics) {
+	info := c.ParseUserAgent(click.UserAgent)
+	click.Browser = info.Browser
+	click.OS = info.OS
+	click.Device = info.Device
+	click.IsBot = click.IsBot || info.Bot || c.fromBotNetwork(click.IPAddress)
+	if click.IsBot {
+		click.Device = DeviceBot
+	}
+	click.ReferrerDomain = ReferrerDomain(click.Referer)
+}
+
+func (c *Classifier) fromBotNetwork(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range c.botNetworks {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsPrefetch reports whether a request was made ahead of time by a browser
+// or an app rendering a preview, rather than by someone following the link.
+func IsPrefetch(header http.Header) bool {
+	for _, name := range []string{"Purpose", "Sec-Purpose", "X-Purpose", "X-Moz"} {
+		value := strings.ToLower(header.Get(name))
+		if strings.Contains(value, "prefetch") || strings.Contains(value, "preview") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func match(ua string, patterns []pattern) string {
+	for _, p := range patterns {
+		if strings.Contains(ua, p.token) {
+			return p.name
+		}
+	}
+
+	return Other
+}
@@ -0,0 +1,131 @@
+package clickinfo
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUserAgent(t *testing.T) {
+	tests := []struct {
+		name string
+		ua   string
+		want UserAgent
+	}{
+		{
+			name: "chrome on windows",
+			ua:   "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			want: UserAgent{Browser: "Chrome", OS: "Windows", Device: DeviceDesktop},
+		},
+		{
+			name: "edge on windows",
+			ua:   "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.2210.91",
+			want: UserAgent{Browser: "Edge", OS: "Windows", Device: DeviceDesktop},
+		},
+		{
+			name: "safari on iphone",
+			ua:   "Mozilla/5.0 (iPhone; CPU iPhone OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Mobile/15E148 Safari/604.1",
+			want: UserAgent{Browser: "Safari", OS: "iOS", Device: DeviceMobile},
+		},
+		{
+			name: "chrome on android tablet",
+			ua:   "Mozilla/5.0 (Linux; Android 13; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			want: UserAgent{Browser: "Chrome", OS: "Android", Device: DeviceTablet},
+		},
+		{
+			name: "firefox on linux",
+			ua:   "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0",
+			want: UserAgent{Browser: "Firefox", OS: "Linux", Device: DeviceDesktop},
+		},
+		{
+			name: "googlebot",
+			ua:   "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			want: UserAgent{Browser: Other, OS: Other, Device: DeviceBot, Bot: true},
+		},
+		{
+			name: "empty",
+			ua:   "",
+			want: UserAgent{Browser: Other, OS: Other, Device: DeviceOther},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, ParseUserAgent(tt.ua))
+		})
+	}
+}
+
+func TestReferrerDomain(t *testing.T) {
+	tests := map[string]string{
+		"":                                     "",
+		"https://www.google.com/search?q=go":   "google.com",
+		"https://m.facebook.com/story.php":     "facebook.com",
+		"https://l.facebook.com/l.php?u=x":     "facebook.com",
+		"https://t.co/abc":                     "twitter.com",
+		"news.ycombinator.com/item?id=1":       "news.ycombinator.com",
+		"android-app://com.google.android.gm/": "mail.google.com",
+		"HTTPS://WWW.Example.COM./path":        "example.com",
+		"://":                                  "",
+	}
+
+	for referer, want := range tests {
+		assert.Equal(t, want, ReferrerDomain(referer), referer)
+	}
+}
+
+func TestClassifier_Enrich(t *testing.T) {
+	classifier, err := NewClassifier([]string{"InternalMonitor"}, []string{"203.0.113.0/24", "2001:db8::/32"})
+	require.NoError(t, err)
+
+	firefox := "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0"
+	tests := []struct {
+		name  string
+		click domain.Analytics
+		bot   bool
+	}{
+		{name: "person", click: domain.Analytics{UserAgent: firefox, IPAddress: "198.51.100.7"}},
+		{name: "built-in pattern", click: domain.Analytics{UserAgent: "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)"}, bot: true},
+		{name: "extra pattern", click: domain.Analytics{UserAgent: "internalmonitor/2.0"}, bot: true},
+		{name: "bot network", click: domain.Analytics{UserAgent: firefox, IPAddress: "203.0.113.9"}, bot: true},
+		{name: "bot network v6", click: domain.Analytics{UserAgent: firefox, IPAddress: "2001:db8::1"}, bot: true},
+		{name: "flagged prefetch", click: domain.Analytics{UserAgent: firefox, IsBot: true}, bot: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			click := tt.click
+			classifier.Enrich(&click)
+			assert.Equal(t, tt.bot, click.IsBot)
+			if tt.bot {
+				assert.Equal(t, DeviceBot, click.Device)
+			}
+		})
+	}
+}
+
+func TestNewClassifier_InvalidNetwork(t *testing.T) {
+	_, err := NewClassifier(nil, []string{"10.0.0.0/33"})
+	assert.Error(t, err)
+}
+
+func TestIsPrefetch(t *testing.T) {
+	tests := []struct {
+		header http.Header
+		want   bool
+	}{
+		{header: http.Header{}, want: false},
+		{header: http.Header{"Sec-Purpose": {"prefetch;prerender"}}, want: true},
+		{header: http.Header{"Purpose": {"prefetch"}}, want: true},
+		{header: http.Header{"X-Purpose": {"preview"}}, want: true},
+		{header: http.Header{"X-Moz": {"prefetch"}}, want: true},
+		{header: http.Header{"Sec-Fetch-Mode": {"navigate"}}, want: false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, IsPrefetch(tt.header), tt.header)
+	}
+}
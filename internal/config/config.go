@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/bajdzun/go-url-shortener/internal/shortcode"
 	"github.com/joho/godotenv"
 )
 
@@ -13,6 +15,13 @@ type Config struct {
 	App       AppConfig
 	Database  DatabaseConfig
 	Redis     RedisConfig
+	Cache     CacheConfig
+	Filter    CodeFilterConfig
+	ShortCode ShortCodeConfig
+	Redirect  RedirectConfig
+	Analytics AnalyticsConfig
+	GeoIP     GeoIPConfig
+	Privacy   PrivacyConfig
 	RateLimit RateLimitConfig
 	Logging   LoggingConfig
 	Metrics   MetricsConfig
@@ -22,6 +31,9 @@ type AppConfig struct {
 	Env     string
 	Port    string
 	BaseURL string
+	// TrustedProxies are CIDR ranges of proxies whose X-Forwarded-For and
+	// X-Real-IP headers are believed.
+	TrustedProxies []string
 }
 
 type DatabaseConfig struct {
@@ -36,11 +48,85 @@ type DatabaseConfig struct {
 }
 
 type RedisConfig struct {
-	Host     string
-	Port     string
-	Password string
-	DB       int
-	TTL      time.Duration
+	// Mode is standalone, sentinel or cluster; empty means standalone.
+	Mode string
+	Host string
+	Port string
+	// Addrs lists the sentinels or cluster seed nodes and replaces Host and
+	// Port when set.
+	Addrs            []string
+	MasterName       string
+	Username         string
+	Password         string
+	SentinelPassword string
+	DB               int
+	TLS              bool
+	TLSCAFile        string
+	ReadFromReplica  bool
+	TTL              time.Duration
+}
+
+const (
+	CacheModeRedis  = "redis"
+	CacheModeMemory = "memory"
+	CacheModeNone   = "none"
+)
+
+type CacheConfig struct {
+	// Mode is redis, memory or none; empty means redis.
+	Mode string
+	// LocalSize is the number of links kept in process memory; zero disables
+	// the local tier.
+	LocalSize int
+	LocalTTL  time.Duration
+	// NegativeTTL is how long unknown short codes are remembered.
+	NegativeTTL time.Duration
+	// EarlyRefreshBeta enables probabilistic early refresh when positive.
+	EarlyRefreshBeta float64
+	// BreakerThreshold consecutive Redis errors open the circuit breaker,
+	// which probes Redis every BreakerProbeInterval until it answers again.
+	BreakerThreshold     int
+	BreakerProbeInterval time.Duration
+	// KeyPrefix namespaces every cache key; empty means the default prefix.
+	KeyPrefix string
+	// GenerationPollInterval is how often instances pick up cache flushes
+	// made elsewhere.
+	GenerationPollInterval time.Duration
+	// WarmupEnabled loads the WarmupSize most clicked links at startup and
+	// holds readiness until done. A positive WarmupWindow ranks links by
+	// their clicks in that window instead of all time.
+	WarmupEnabled bool
+	WarmupSize    int
+	WarmupWindow  time.Duration
+}
+
+type CodeFilterConfig struct {
+	// ExpectedItems sizes the Bloom filter of existing codes; zero disables it.
+	ExpectedItems     int
+	FalsePositiveRate float64
+	RebuildInterval   time.Duration
+}
+
+type ShortCodeConfig struct {
+	Strategy      string
+	Length        int
+	Alphabet      string
+	Secret        string
+	WordCount     int
+	WordSeparator string
+	MaxRetries    int
+	MinLength     int
+	MaxLength     int
+	// CustomAlphabet lists the characters allowed in user-chosen codes.
+	CustomAlphabet string
+	Reserved       []string
+	DenyList       []string
+}
+
+type RedirectConfig struct {
+	DefaultType int
+	// CacheMaxAge is how long clients may cache a redirect; zero disables it.
+	CacheMaxAge time.Duration
 }
 
 type RateLimitConfig struct {
@@ -48,6 +134,48 @@ type RateLimitConfig struct {
 	Window   time.Duration
 }
 
+type AnalyticsConfig struct {
+	QueueSize     int
+	Workers       int
+	BatchSize     int
+	FlushInterval time.Duration
+	// OverflowPolicy is drop, block or spill; empty means drop.
+	OverflowPolicy string
+	BlockTimeout   time.Duration
+	// SpillDir keeps clicks that could not be queued or written.
+	SpillDir string
+	// CounterFlushInterval is how often click counts buffered in Redis are
+	// written to the database.
+	CounterFlushInterval time.Duration
+	// VisitorFlushInterval is how often unique visitor counts are saved from
+	// Redis to the database.
+	VisitorFlushInterval time.Duration
+	// BotPatterns are user agent substrings recognised as bots on top of
+	// the built-in list, and BotNetworks CIDR ranges whose clicks are bots.
+	BotPatterns []string
+	BotNetworks []string
+	// RollupInterval is how often clicks are added to the rollups that
+	// statistics are read from.
+	RollupInterval time.Duration
+}
+
+type GeoIPConfig struct {
+	// DatabasePath is a MaxMind-format .mmdb file; empty disables GeoIP.
+	DatabasePath   string
+	ReloadInterval time.Duration
+}
+
+type PrivacyConfig struct {
+	// IPMode is full, truncate or hash; empty means full.
+	IPMode          string
+	IPHashKey       string
+	HonorDoNotTrack bool
+	// RetentionPeriod is how long recorded clicks are kept; zero keeps them
+	// forever.
+	RetentionPeriod   time.Duration
+	RetentionInterval time.Duration
+}
+
 type LoggingConfig struct {
 	Level  string
 	Format string
@@ -63,9 +191,10 @@ func Load() (*Config, error) {
 
 	cfg := &Config{
 		App: AppConfig{
-			Env:     os.Getenv("APP_ENV"),
-			Port:    os.Getenv("APP_PORT"),
-			BaseURL: os.Getenv("APP_BASE_URL"),
+			Env:            os.Getenv("APP_ENV"),
+			Port:           os.Getenv("APP_PORT"),
+			BaseURL:        os.Getenv("APP_BASE_URL"),
+			TrustedProxies: getEnvAsList("TRUSTED_PROXIES"),
 		},
 		Database: DatabaseConfig{
 			Host:           os.Getenv("DB_HOST"),
@@ -78,11 +207,85 @@ func Load() (*Config, error) {
 			MaxIdleConns:   getEnvAsInt("DB_MAX_IDLE_CONNECTIONS"),
 		},
 		Redis: RedisConfig{
-			Host:     os.Getenv("REDIS_HOST"),
-			Port:     os.Getenv("REDIS_PORT"),
-			Password: os.Getenv("REDIS_PASSWORD"),
-			DB:       getEnvAsInt("REDIS_DB"),
-			TTL:      time.Duration(getEnvAsInt("REDIS_TTL")) * time.Second,
+			Mode:             os.Getenv("REDIS_MODE"),
+			Host:             os.Getenv("REDIS_HOST"),
+			Port:             os.Getenv("REDIS_PORT"),
+			Addrs:            getEnvAsList("REDIS_ADDRS"),
+			MasterName:       os.Getenv("REDIS_MASTER_NAME"),
+			Username:         os.Getenv("REDIS_USERNAME"),
+			Password:         os.Getenv("REDIS_PASSWORD"),
+			SentinelPassword: os.Getenv("REDIS_SENTINEL_PASSWORD"),
+			DB:               getEnvAsInt("REDIS_DB"),
+			TLS:              getEnvAsBool("REDIS_TLS"),
+			TLSCAFile:        os.Getenv("REDIS_TLS_CA_FILE"),
+			ReadFromReplica:  getEnvAsBool("REDIS_READ_FROM_REPLICA"),
+			TTL:              time.Duration(getEnvAsInt("REDIS_TTL")) * time.Second,
+		},
+		Cache: CacheConfig{
+			Mode:        os.Getenv("CACHE_MODE"),
+			LocalSize:   getEnvAsInt("CACHE_LOCAL_SIZE"),
+			LocalTTL:    time.Duration(getEnvAsInt("CACHE_LOCAL_TTL")) * time.Second,
+			NegativeTTL: time.Duration(getEnvAsInt("CACHE_NEGATIVE_TTL")) * time.Second,
+
+			EarlyRefreshBeta:     getEnvAsFloat("CACHE_EARLY_REFRESH_BETA"),
+			BreakerThreshold:     getEnvAsInt("CACHE_BREAKER_THRESHOLD"),
+			BreakerProbeInterval: time.Duration(getEnvAsInt("CACHE_BREAKER_PROBE_INTERVAL")) * time.Second,
+
+			KeyPrefix:              os.Getenv("CACHE_KEY_PREFIX"),
+			GenerationPollInterval: time.Duration(getEnvAsInt("CACHE_GENERATION_POLL_INTERVAL")) * time.Second,
+
+			WarmupEnabled: getEnvAsBool("CACHE_WARMUP_ENABLED"),
+			WarmupSize:    getEnvAsInt("CACHE_WARMUP_SIZE"),
+			WarmupWindow:  time.Duration(getEnvAsInt("CACHE_WARMUP_WINDOW")) * time.Second,
+		},
+		Filter: CodeFilterConfig{
+			ExpectedItems:     getEnvAsInt("CODE_FILTER_EXPECTED_ITEMS"),
+			FalsePositiveRate: getEnvAsFloat("CODE_FILTER_FALSE_POSITIVE_RATE"),
+			RebuildInterval:   time.Duration(getEnvAsInt("CODE_FILTER_REBUILD_INTERVAL")) * time.Second,
+		},
+		ShortCode: ShortCodeConfig{
+			Strategy:       os.Getenv("SHORTCODE_STRATEGY"),
+			Length:         getEnvAsInt("SHORTCODE_LENGTH"),
+			Alphabet:       os.Getenv("SHORTCODE_ALPHABET"),
+			Secret:         os.Getenv("SHORTCODE_SECRET"),
+			WordCount:      getEnvAsInt("SHORTCODE_WORD_COUNT"),
+			WordSeparator:  os.Getenv("SHORTCODE_WORD_SEPARATOR"),
+			MaxRetries:     getEnvAsInt("SHORTCODE_MAX_RETRIES"),
+			MinLength:      getEnvAsInt("SHORTCODE_MIN_LENGTH"),
+			MaxLength:      getEnvAsInt("SHORTCODE_MAX_LENGTH"),
+			CustomAlphabet: os.Getenv("SHORTCODE_CUSTOM_ALPHABET"),
+			Reserved:       getEnvAsList("SHORTCODE_RESERVED"),
+			DenyList:       getEnvAsList("SHORTCODE_DENY_LIST"),
+		},
+		Redirect: RedirectConfig{
+			DefaultType: getEnvAsInt("REDIRECT_DEFAULT_TYPE"),
+			CacheMaxAge: time.Duration(getEnvAsInt("REDIRECT_CACHE_MAX_AGE")) * time.Second,
+		},
+		Analytics: AnalyticsConfig{
+			QueueSize:      getEnvAsInt("ANALYTICS_QUEUE_SIZE"),
+			Workers:        getEnvAsInt("ANALYTICS_WORKERS"),
+			BatchSize:      getEnvAsInt("ANALYTICS_BATCH_SIZE"),
+			FlushInterval:  time.Duration(getEnvAsInt("ANALYTICS_FLUSH_INTERVAL_MS")) * time.Millisecond,
+			OverflowPolicy: os.Getenv("ANALYTICS_OVERFLOW_POLICY"),
+			BlockTimeout:   time.Duration(getEnvAsInt("ANALYTICS_BLOCK_TIMEOUT_MS")) * time.Millisecond,
+			SpillDir:       os.Getenv("ANALYTICS_SPILL_DIR"),
+
+			CounterFlushInterval: time.Duration(getEnvAsInt("ANALYTICS_COUNTER_FLUSH_INTERVAL")) * time.Second,
+			VisitorFlushInterval: time.Duration(getEnvAsInt("ANALYTICS_VISITOR_FLUSH_INTERVAL")) * time.Second,
+			BotPatterns:          getEnvAsList("BOT_UA_PATTERNS"),
+			BotNetworks:          getEnvAsList("BOT_IP_RANGES"),
+			RollupInterval:       time.Duration(getEnvAsInt("ANALYTICS_ROLLUP_INTERVAL")) * time.Second,
+		},
+		GeoIP: GeoIPConfig{
+			DatabasePath:   os.Getenv("GEOIP_DATABASE_PATH"),
+			ReloadInterval: time.Duration(getEnvAsInt("GEOIP_RELOAD_INTERVAL")) * time.Second,
+		},
+		Privacy: PrivacyConfig{
+			IPMode:            os.Getenv("PRIVACY_IP_MODE"),
+			IPHashKey:         os.Getenv("PRIVACY_IP_HASH_KEY"),
+			HonorDoNotTrack:   getEnvAsBool("PRIVACY_HONOR_DNT"),
+			RetentionPeriod:   time.Duration(getEnvAsInt("ANALYTICS_RETENTION_DAYS")) * 24 * time.Hour,
+			RetentionInterval: time.Duration(getEnvAsInt("ANALYTICS_RETENTION_INTERVAL")) * time.Second,
 		},
 		RateLimit: RateLimitConfig{
 			Requests: getEnvAsInt("RATE_LIMIT_REQUESTS"),
@@ -97,9 +300,33 @@ func Load() (*Config, error) {
 		},
 	}
 
+	if err := cfg.ShortCode.Validate(); err != nil {
+		return nil, err
+	}
+
 	return cfg, nil
 }
 
+// Validate rejects settings under which every generated code would fail
+// validation, which would otherwise only show once links are created.
+func (c *ShortCodeConfig) Validate() error {
+	if c.Strategy != shortcode.StrategyWords {
+		return nil
+	}
+
+	allowed := c.CustomAlphabet
+	if allowed == "" {
+		allowed = shortcode.CustomAlphabet
+	}
+	for _, r := range c.WordSeparator {
+		if !strings.ContainsRune(allowed, r) {
+			return fmt.Errorf("word separator %q is not allowed in short codes, which may only use %q", c.WordSeparator, allowed)
+		}
+	}
+
+	return nil
+}
+
 func (c *DatabaseConfig) DSN() string {
 	return fmt.Sprintf(
 		"host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
@@ -111,6 +338,15 @@ func (c *RedisConfig) Address() string {
 	return fmt.Sprintf("%s:%s", c.Host, c.Port)
 }
 
+// Addresses returns Addrs, or the single address of Host and Port.
+func (c *RedisConfig) Addresses() []string {
+	if len(c.Addrs) > 0 {
+		return c.Addrs
+	}
+
+	return []string{c.Address()}
+}
+
 func getEnvAsInt(key string) int {
 	valueStr := os.Getenv(key)
 	value, _ := strconv.Atoi(valueStr)
@@ -118,9 +354,27 @@ func getEnvAsInt(key string) int {
 	return value
 }
 
+func getEnvAsFloat(key string) float64 {
+	valueStr := os.Getenv(key)
+	value, _ := strconv.ParseFloat(valueStr, 64)
+
+	return value
+}
+
 func getEnvAsBool(key string) bool {
 	valueStr := os.Getenv(key)
 	value, _ := strconv.ParseBool(valueStr)
 
 	return value
 }
+
+func getEnvAsList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
@@ -3,31 +3,192 @@ package domain
 import (
 	"context"
 	"errors"
+	"time"
 )
 
 var (
-	ErrURLNotFound     = errors.New("url not found")
-	ErrInvalidURL      = errors.New("invalid url")
-	ErrShortCodeExists = errors.New("short code already exists")
-	ErrExpiredURL      = errors.New("url has expired")
+	ErrURLNotFound      = errors.New("url not found")
+	ErrInvalidURL       = errors.New("invalid url")
+	ErrShortCodeExists  = errors.New("short code already exists")
+	ErrExpiredURL       = errors.New("url has expired")
+	ErrInvalidCursor    = errors.New("invalid pagination cursor")
+	ErrInvalidFilter    = errors.New("invalid list filter")
+	ErrEmptyBatch       = errors.New("batch contains no items")
+	ErrBatchTooLarge    = errors.New("batch contains too many items")
+	ErrBatchAborted     = errors.New("batch aborted because another item failed")
+	ErrInvalidPolicy    = errors.New("invalid conflict policy")
+	ErrInvalidImport    = errors.New("invalid import data")
+	ErrCodeGeneration   = errors.New("could not generate a unique short code")
+	ErrInvalidShortCode = errors.New("invalid short code")
+	ErrInvalidRedirect  = errors.New("redirect type must be 301, 302, 307 or 308")
+	ErrURLDisabled      = errors.New("url is disabled")
+	ErrInvalidStatus    = errors.New("status must be active or disabled")
+	ErrCacheMiss        = errors.New("cache miss")
+	ErrCacheUnavailable = errors.New("cache unavailable")
+	ErrWarmupInProgress = errors.New("cache warm-up already in progress")
+	ErrInvalidInterval  = errors.New("interval must be minute, hour, day, week or month")
+	ErrInvalidTimezone  = errors.New("unknown time zone")
+	ErrInvalidTimeRange = errors.New("invalid time range")
+	ErrUniqueInterval   = errors.New("unique visitors are counted per day, so they need a day, week or month interval")
+	ErrInvalidDimension = errors.New("dimension must be referrer, browser, os, device or country")
+	ErrInvalidErasure   = errors.New("a valid IP address, visitor hash or network is required")
 )
 
+// ShortCodeError explains why a short code was rejected. It matches
+// ErrInvalidShortCode with errors.Is.
+type ShortCodeError struct {
+	Code   string
+	Reason string
+}
+
+func (e *ShortCodeError) Error() string {
+	return ErrInvalidShortCode.Error() + ": " + e.Reason
+}
+
+func (e *ShortCodeError) Is(target error) bool {
+	return target == ErrInvalidShortCode
+}
+
 type URLRepository interface {
 	Create(ctx context.Context, url *URL) error
+	// CreateBatch inserts the URLs and returns a per-item error slice. With
+	// atomic set, nothing is inserted unless every item succeeds.
+	CreateBatch(ctx context.Context, urls []*URL, atomic bool) ([]error, error)
 	GetByShortCode(ctx context.Context, shortCode string) (*URL, error)
-	Update(ctx context.Context, url *URL) error
+	// Update passes the URL to apply and stores the result, unless apply
+	// fails. No other update of the URL runs in between.
+	Update(ctx context.Context, shortCode string, apply func(url *URL) error) (*URL, error)
 	Delete(ctx context.Context, shortCode string) error
-	IncrementClickCount(ctx context.Context, shortCode string) error
+	// IncrementClickCounts adds each delta to the click count of its code.
+	// Unknown codes are ignored.
+	IncrementClickCounts(ctx context.Context, deltas map[string]int64) error
+	// ApplyClickCounts increments click counts like IncrementClickCounts,
+	// but at most once per flushID. It reports false when flushID was
+	// already applied.
+	ApplyClickCounts(ctx context.Context, flushID string, deltas map[string]int64) (bool, error)
+	List(ctx context.Context, filter URLFilter) (*URLPage, error)
+	// ForEach streams every URL ordered by id until fn returns an error.
+	ForEach(ctx context.Context, fn func(url *URL) error) error
+	// ForEachShortCode streams every short code in no particular order.
+	ForEachShortCode(ctx context.Context, fn func(shortCode string) error) error
+	// TopURLs returns up to limit active, unexpired URLs ranked by click
+	// count, or by clicks recorded since clickedSince when it is set.
+	TopURLs(ctx context.Context, limit int, clickedSince *time.Time) ([]*URL, error)
+	// Import inserts URLs pulled from next, including their click counts, in
+	// a single transaction. next returns io.EOF when there are no more URLs.
+	Import(ctx context.Context, next func() (*URL, error), policy ConflictPolicy) (*ImportResult, error)
+}
+
+// CodeFilter is a probabilistic set of existing short codes. MayContain may
+// report codes that do not exist, but never misses one that does.
+type CodeFilter interface {
+	Add(shortCode string)
+	Remove(shortCode string)
+	MayContain(shortCode string) bool
+	// Ready reports whether the filter has been loaded; before that it
+	// reports every code as possibly present.
+	Ready() bool
+}
+
+type SequenceRepository interface {
+	NextValue(ctx context.Context) (int64, error)
+}
+
+type ShortCodeGenerator interface {
+	Generate(ctx context.Context) (string, error)
+}
+
+type ShortCodeValidator interface {
+	// Validate returns a *ShortCodeError when the code may not be used.
+	Validate(code string) error
 }
 
 type CacheRepository interface {
 	Set(ctx context.Context, key string, value interface{}) error
+	// SetWithTTL stores a value that must not outlive ttl.
+	SetWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration) error
+	SetMany(ctx context.Context, entries []CacheEntry) error
+	// SetNewer stores a JSON object unless the key holds one with a greater
+	// "v" field than version, atomically. A zero ttl is the cache default.
+	SetNewer(ctx context.Context, key, value string, version int64, ttl time.Duration) error
+	// Get returns ErrCacheMiss when the key is not cached.
 	Get(ctx context.Context, key string) (string, error)
 	Delete(ctx context.Context, key string) error
 	Exists(ctx context.Context, key string) (bool, error)
 }
 
+// ClickRecorder takes clicks off the redirect path. Record must not block
+// for long and may drop clicks under overload.
+type ClickRecorder interface {
+	Record(click *Analytics)
+}
+
+// GeoLocator resolves client IPs to where they are. It returns an empty
+// location for IPs it does not know.
+type GeoLocator interface {
+	Locate(ip string) GeoLocation
+}
+
+// VisitorCounter estimates the unique visitors of each link per UTC day.
+// Visitors are recognised within a day only, so a visitor returning on
+// another day counts again.
+type VisitorCounter interface {
+	Add(ctx context.Context, clicks []*Analytics) error
+}
+
+// VisitorSketchStore persists the daily unique visitor sketches of links.
+type VisitorSketchStore interface {
+	// LoadVisitorSketch returns nil when nothing was saved for the day.
+	LoadVisitorSketch(ctx context.Context, shortCode string, day time.Time) ([]byte, error)
+	// SaveVisitorSketch replaces the sketch of the day and its estimate.
+	// Sketches of links deleted in the meantime are dropped.
+	SaveVisitorSketch(ctx context.Context, shortCode string, day time.Time, sketch []byte, visitors int64) error
+}
+
+// ClickCounter keeps the click counts of links.
+type ClickCounter interface {
+	Add(ctx context.Context, deltas map[string]int64) error
+	// Pending returns the clicks counted for shortCode that have not reached
+	// the database yet.
+	Pending(ctx context.Context, shortCode string) (int64, error)
+}
+
+// CacheGenerationStore holds the cache generation shared by all instances.
+// Bumping it orphans every cached link of the previous generation.
+type CacheGenerationStore interface {
+	Current(ctx context.Context) (int64, error)
+	Bump(ctx context.Context) (int64, error)
+}
+
 type AnalyticsRepository interface {
-	RecordClick(ctx context.Context, analytics *Analytics) error
-	GetStats(ctx context.Context, shortCode string) (*URLStats, error)
+	// RecordClicks stores the clicks in one round trip. Clicks on links that
+	// no longer exist are skipped.
+	RecordClicks(ctx context.Context, clicks []*Analytics) error
+	// GetStats counts clicks by bots in ClickCount only with includeBots.
+	GetStats(ctx context.Context, shortCode string, includeBots bool) (*URLStats, error)
+	// GetTimeSeries returns the buckets of query that have clicks, in order.
+	GetTimeSeries(ctx context.Context, query TimeSeriesQuery) ([]TimeSeriesPoint, error)
+	// GetBreakdown returns the top values of query's dimension with their
+	// clicks, and the clicks in the range overall.
+	GetBreakdown(ctx context.Context, query BreakdownQuery) ([]BreakdownItem, int64, error)
+	// ListUnenrichedClicks returns up to limit clicks recorded before
+	// enrichment existed, with IDs above afterID, in ID order.
+	ListUnenrichedClicks(ctx context.Context, afterID int64, limit int) ([]*Analytics, error)
+	UpdateClickDetails(ctx context.Context, clicks []*Analytics) error
+	// RollUpClicks adds up to limit clicks to the rollups the statistics
+	// are read from, and returns how many it added.
+	RollUpClicks(ctx context.Context, limit int) (int64, error)
+	// ExpireClicks deletes up to limit rolled up clicks recorded before
+	// cutoff and returns how many it deleted. The rollups keep counting
+	// them.
+	ExpireClicks(ctx context.Context, cutoff time.Time, limit int) (int64, error)
+	// EraseClicks deletes the clicks stored with any of the IP addresses.
+	EraseClicks(ctx context.Context, ipAddresses []string) (int64, error)
+}
+
+type CacheEntry struct {
+	Key   string
+	Value interface{}
+	// TTL overrides the cache's default expiration when non-zero.
+	TTL time.Duration
 }
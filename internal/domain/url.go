@@ -13,8 +13,21 @@ type URL struct {
 	ExpiresAt   *time.Time             `json:"expires_at,omitempty"`
 	ClickCount  int64                  `json:"click_count"`
 	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	// RedirectType is the HTTP status used for redirects; zero means the
+	// service default.
+	RedirectType int        `json:"redirect_type,omitempty"`
+	Status       LinkStatus `json:"status,omitempty"`
 }
 
+// LinkStatus controls whether a link redirects. Disabled links are kept with
+// their analytics but answer 410 Gone.
+type LinkStatus string
+
+const (
+	LinkStatusActive   LinkStatus = "active"
+	LinkStatusDisabled LinkStatus = "disabled"
+)
+
 type Analytics struct {
 	ID        int64     `json:"id"`
 	ShortCode string    `json:"short_code"`
@@ -23,6 +36,17 @@ type Analytics struct {
 	UserAgent string    `json:"user_agent,omitempty"`
 	Referer   string    `json:"referer,omitempty"`
 	Country   string    `json:"country,omitempty"`
+	Region    string    `json:"region,omitempty"`
+	City      string    `json:"city,omitempty"`
+	// Derived from UserAgent and Referer when the click is recorded.
+	Browser        string `json:"browser,omitempty"`
+	OS             string `json:"os,omitempty"`
+	Device         string `json:"device,omitempty"`
+	IsBot          bool   `json:"is_bot,omitempty"`
+	ReferrerDomain string `json:"referrer_domain,omitempty"`
+	// DoNotTrack is set when the visitor sent DNT or Sec-GPC. It is not
+	// stored.
+	DoNotTrack bool `json:"do_not_track,omitempty"`
 }
 
 type URLStats struct {
@@ -31,4 +55,155 @@ type URLStats struct {
 	ClickCount  int64      `json:"click_count"`
 	CreatedAt   time.Time  `json:"created_at"`
 	LastClicked *time.Time `json:"last_clicked,omitempty"`
+	// UniqueVisitors sums the estimated unique visitors of each day.
+	UniqueVisitors int64 `json:"unique_visitors"`
+	// BotClicks counts the clicks recognised as bots, whether or not they
+	// are included in ClickCount.
+	BotClicks int64 `json:"bot_clicks"`
+}
+
+type TimeInterval string
+
+const (
+	IntervalMinute TimeInterval = "minute"
+	IntervalHour   TimeInterval = "hour"
+	IntervalDay    TimeInterval = "day"
+	IntervalWeek   TimeInterval = "week"
+	IntervalMonth  TimeInterval = "month"
+)
+
+// TimeSeriesQuery selects the clicks of a link in [From, To), bucketed by
+// Interval in Location. Weeks start on Monday.
+type TimeSeriesQuery struct {
+	ShortCode string
+	From      time.Time
+	To        time.Time
+	Interval  TimeInterval
+	Location  *time.Location
+	// Unique also sums the daily unique visitors per bucket. Days are UTC
+	// days and belong to the bucket their start falls in.
+	Unique      bool
+	IncludeBots bool
+}
+
+type TimeSeriesPoint struct {
+	Start          time.Time `json:"start"`
+	Clicks         int64     `json:"clicks"`
+	UniqueVisitors *int64    `json:"unique_visitors,omitempty"`
+}
+
+type TimeSeries struct {
+	ShortCode string            `json:"short_code"`
+	Interval  TimeInterval      `json:"interval"`
+	Timezone  string            `json:"timezone"`
+	From      time.Time         `json:"from"`
+	To        time.Time         `json:"to"`
+	Total     int64             `json:"total"`
+	Points    []TimeSeriesPoint `json:"points"`
+}
+
+// GeoLocation is where an IP address is. Country is an ISO 3166-1 alpha-2
+// code; Region and City are English names.
+type GeoLocation struct {
+	Country string
+	Region  string
+	City    string
+}
+
+type BreakdownDimension string
+
+const (
+	DimensionReferrer BreakdownDimension = "referrer"
+	DimensionBrowser  BreakdownDimension = "browser"
+	DimensionOS       BreakdownDimension = "os"
+	DimensionDevice   BreakdownDimension = "device"
+	DimensionCountry  BreakdownDimension = "country"
+)
+
+// BreakdownQuery selects the Limit most common values of Dimension among
+// the clicks of a link in [From, To).
+type BreakdownQuery struct {
+	ShortCode   string
+	Dimension   BreakdownDimension
+	From        time.Time
+	To          time.Time
+	Limit       int
+	IncludeBots bool
+}
+
+type BreakdownItem struct {
+	Value      string  `json:"value"`
+	Clicks     int64   `json:"clicks"`
+	Percentage float64 `json:"percentage"`
+}
+
+type Breakdown struct {
+	ShortCode string             `json:"short_code"`
+	Dimension BreakdownDimension `json:"dimension"`
+	From      time.Time          `json:"from"`
+	To        time.Time          `json:"to"`
+	// Total counts every click in the range, including those of values
+	// beyond the top ones.
+	Total int64           `json:"total"`
+	Items []BreakdownItem `json:"items"`
+}
+
+type ExpiryState string
+
+const (
+	ExpiryAny     ExpiryState = ""
+	ExpiryActive  ExpiryState = "active"
+	ExpiryExpired ExpiryState = "expired"
+	ExpiryNever   ExpiryState = "never"
+)
+
+type URLSortField string
+
+const (
+	SortByCreatedAt  URLSortField = "created_at"
+	SortByClickCount URLSortField = "click_count"
+)
+
+type URLFilter struct {
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	Expiry        ExpiryState
+	HostContains  string
+	MetadataKey   string
+	// MetadataValue, when set, must equal the value of MetadataKey as text.
+	// Without it, links only need to have the key.
+	MetadataValue *string
+	SortBy        URLSortField
+	Descending    bool
+	Cursor        string
+	Limit         int
+}
+
+type URLPage struct {
+	Items      []*URL `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type ConflictPolicy string
+
+const (
+	ConflictSkip      ConflictPolicy = "skip"
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	ConflictFail      ConflictPolicy = "fail"
+)
+
+type ImportRejection struct {
+	Record int    `json:"record"`
+	Reason string `json:"reason"`
+}
+
+type ImportResult struct {
+	Created  int               `json:"created"`
+	Updated  int               `json:"updated"`
+	Skipped  int               `json:"skipped"`
+	Rejected []ImportRejection `json:"rejected,omitempty"`
+	// UpdatedCodes lists overwritten links so their cache entries can be dropped.
+	UpdatedCodes []string `json:"-"`
+	// CreatedCodes lists new links so codes cached as missing can be forgotten.
+	CreatedCodes []string `json:"-"`
 }
@@ -0,0 +1,135 @@
+// Package geoip resolves client IPs to a location using a local database in
+// MaxMind's format, such as GeoLite2 City or Country.
+package geoip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"github.com/oschwald/maxminddb-golang"
+	"go.uber.org/zap"
+)
+
+const defaultReloadInterval = time.Minute
+
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+type database struct {
+	reader  *maxminddb.Reader
+	modTime time.Time
+	size    int64
+}
+
+// Resolver looks IPs up in the database at path and reloads it when the file
+// changes, so it can be updated in place, e.g. by geoipupdate. Until a
+// database is loaded, lookups find nothing.
+type Resolver struct {
+	path     string
+	interval time.Duration
+	logger   *zap.Logger
+	db       atomic.Pointer[database]
+}
+
+func NewResolver(path string, interval time.Duration, logger *zap.Logger) *Resolver {
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+
+	return &Resolver{path: path, interval: interval, logger: logger}
+}
+
+// Load reads the database if the file changed since it was last loaded.
+func (r *Resolver) Load() error {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return err
+	}
+
+	current := r.db.Load()
+	if current != nil && current.modTime.Equal(info.ModTime()) && current.size == info.Size() {
+		return nil
+	}
+
+	// The file is read into memory rather than mapped, so replacing it never
+	// pulls data from under a lookup in progress.
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return fmt.Errorf("open GeoIP database %s: %w", r.path, err)
+	}
+
+	r.db.Store(&database{reader: reader, modTime: info.ModTime(), size: info.Size()})
+	r.logger.Info("loaded GeoIP database",
+		zap.String("path", r.path),
+		zap.String("type", reader.Metadata.DatabaseType),
+		zap.Time("built_at", time.Unix(int64(reader.Metadata.BuildEpoch), 0)),
+	)
+
+	return nil
+}
+
+// Run checks the file for changes every interval until ctx is done.
+func (r *Resolver) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := r.Load(); err != nil {
+				r.logger.Warn("failed to reload GeoIP database", zap.String("path", r.path), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Locate returns the location of ip, with empty fields for what the
+// database does not know.
+func (r *Resolver) Locate(ip string) domain.GeoLocation {
+	db := r.db.Load()
+	parsed := net.ParseIP(ip)
+	if db == nil || parsed == nil {
+		return domain.GeoLocation{}
+	}
+
+	var rec record
+	if err := db.reader.Lookup(parsed, &rec); err != nil {
+		return domain.GeoLocation{}
+	}
+
+	location := domain.GeoLocation{
+		Country: rec.Country.ISOCode,
+		City:    rec.City.Names["en"],
+	}
+	if location.Country == "" {
+		location.Country = rec.RegisteredCountry.ISOCode
+	}
+	if len(rec.Subdivisions) > 0 {
+		location.Region = rec.Subdivisions[0].Names["en"]
+	}
+
+	return location
+}
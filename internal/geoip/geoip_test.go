@@ -0,0 +1,73 @@
+package geoip
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func writeDatabase(t *testing.T, path string, country, region, city string, modTime time.Time) {
+	t.Helper()
+
+	writer, err := mmdbwriter.New(mmdbwriter.Options{DatabaseType: "GeoIP2-City", RecordSize: 24})
+	require.NoError(t, err)
+
+	_, network, err := net.ParseCIDR("81.2.69.0/24")
+	require.NoError(t, err)
+	require.NoError(t, writer.Insert(network, mmdbtype.Map{
+		"country":      mmdbtype.Map{"iso_code": mmdbtype.String(country)},
+		"subdivisions": mmdbtype.Slice{mmdbtype.Map{"names": mmdbtype.Map{"en": mmdbtype.String(region)}}},
+		"city":         mmdbtype.Map{"names": mmdbtype.Map{"en": mmdbtype.String(city)}},
+	}))
+
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	_, err = writer.WriteTo(file)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestResolver_LocatesAndReloads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "city.mmdb")
+	resolver := NewResolver(path, time.Minute, zap.NewNop())
+
+	// Nothing is known until a database loads.
+	assert.Error(t, resolver.Load())
+	assert.Equal(t, domain.GeoLocation{}, resolver.Locate("81.2.69.160"))
+
+	built := time.Now().Add(-time.Hour)
+	writeDatabase(t, path, "GB", "England", "London", built)
+	require.NoError(t, resolver.Load())
+
+	assert.Equal(t, domain.GeoLocation{Country: "GB", Region: "England", City: "London"}, resolver.Locate("81.2.69.160"))
+	assert.Equal(t, domain.GeoLocation{}, resolver.Locate("10.0.0.1"))
+	assert.Equal(t, domain.GeoLocation{}, resolver.Locate("not an ip"))
+
+	writeDatabase(t, path, "IE", "Leinster", "Dublin", built.Add(time.Minute))
+	require.NoError(t, resolver.Load())
+
+	assert.Equal(t, "Dublin", resolver.Locate("81.2.69.160").City)
+}
+
+func TestResolver_KeepsDatabaseWhenReloadFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "city.mmdb")
+	resolver := NewResolver(path, time.Minute, zap.NewNop())
+
+	writeDatabase(t, path, "GB", "England", "London", time.Now().Add(-time.Hour))
+	require.NoError(t, resolver.Load())
+
+	require.NoError(t, os.WriteFile(path, []byte("truncated"), 0o644))
+	assert.Error(t, resolver.Load())
+
+	assert.Equal(t, "GB", resolver.Locate("81.2.69.160").Country)
+}
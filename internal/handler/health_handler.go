@@ -1,28 +1,86 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 )
 
-type HealthHandler struct{}
+const (
+	HealthOK       = "ok"
+	HealthDegraded = "degraded"
+	HealthNotReady = "not_ready"
+)
+
+// HealthCheck reports the state of one dependency.
+type HealthCheck func(ctx context.Context) ComponentHealth
 
-func NewHealthHandler() *HealthHandler {
-	return &HealthHandler{}
+type ComponentHealth struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type HealthHandler struct {
+	checks    map[string]HealthCheck
+	readiness map[string]HealthCheck
+}
+
+// NewHealthHandler reports checks on /health. readiness lists the startup
+// tasks that must report ok before /ready lets traffic in.
+func NewHealthHandler(checks, readiness map[string]HealthCheck) *HealthHandler {
+	return &HealthHandler{
+		checks:    checks,
+		readiness: readiness,
+	}
 }
 
 type HealthResponse struct {
-	Status  string `json:"status"`
-	Version string `json:"version"`
+	Status     string                     `json:"status"`
+	Version    string                     `json:"version"`
+	Components map[string]ComponentHealth `json:"components,omitempty"`
 }
 
+// Health reports "degraded" when any component is unhealthy. It still
+// answers 200, as the service keeps serving without its optional parts.
 func (h *HealthHandler) Health(w http.ResponseWriter, r *http.Request) {
 	response := HealthResponse{
-		Status:  "ok",
-		Version: "1.0.0",
+		Status:     HealthOK,
+		Version:    "1.0.0",
+		Components: make(map[string]ComponentHealth, len(h.checks)),
+	}
+
+	for name, check := range h.checks {
+		component := check(r.Context())
+		if component.Status != HealthOK {
+			response.Status = HealthDegraded
+		}
+		response.Components[name] = component
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
 }
+
+// Ready answers 503 until every readiness check reports ok.
+func (h *HealthHandler) Ready(w http.ResponseWriter, r *http.Request) {
+	response := HealthResponse{
+		Status:     HealthOK,
+		Version:    "1.0.0",
+		Components: make(map[string]ComponentHealth, len(h.readiness)),
+	}
+
+	status := http.StatusOK
+	for name, check := range h.readiness {
+		component := check(r.Context())
+		if component.Status != HealthOK {
+			response.Status = HealthNotReady
+			status = http.StatusServiceUnavailable
+		}
+		response.Components[name] = component
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
@@ -2,11 +2,18 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
-	"strings"
+	"strconv"
+	"time"
 
+	"github.com/bajdzun/go-url-shortener/internal/clickinfo"
 	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"github.com/bajdzun/go-url-shortener/internal/privacy"
 	"github.com/bajdzun/go-url-shortener/internal/service"
+	"github.com/bajdzun/go-url-shortener/internal/transfer"
 	"github.com/go-chi/chi/v5"
 	"go.uber.org/zap"
 )
@@ -28,6 +35,14 @@ type ErrorResponse struct {
 	Message string `json:"message,omitempty"`
 }
 
+type FlushCacheResponse struct {
+	Generation int64 `json:"generation"`
+}
+
+type EraseClicksResponse struct {
+	Erased int64 `json:"erased"`
+}
+
 func (h *URLHandler) CreateShortURL(w http.ResponseWriter, r *http.Request) {
 	var req service.CreateURLRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -37,11 +52,21 @@ func (h *URLHandler) CreateShortURL(w http.ResponseWriter, r *http.Request) {
 
 	resp, err := h.service.CreateShortURL(r.Context(), &req)
 	if err != nil {
+		var codeErr *domain.ShortCodeError
+		if errors.As(err, &codeErr) {
+			h.respondError(w, http.StatusBadRequest, "invalid short code", codeErr.Reason)
+			return
+		}
+
 		switch err {
 		case domain.ErrInvalidURL:
 			h.respondError(w, http.StatusBadRequest, "invalid URL", err.Error())
+		case domain.ErrInvalidRedirect:
+			h.respondError(w, http.StatusBadRequest, "invalid redirect type", err.Error())
 		case domain.ErrShortCodeExists:
 			h.respondError(w, http.StatusConflict, "short code already exists", err.Error())
+		case domain.ErrCodeGeneration:
+			h.respondError(w, http.StatusServiceUnavailable, "could not generate a short code", err.Error())
 		default:
 			h.logger.Error("failed to create short URL", zap.Error(err))
 			h.respondError(w, http.StatusInternalServerError, "internal server error", "")
@@ -53,6 +78,34 @@ func (h *URLHandler) CreateShortURL(w http.ResponseWriter, r *http.Request) {
 	h.respondJSON(w, http.StatusCreated, resp)
 }
 
+func (h *URLHandler) CreateShortURLBatch(w http.ResponseWriter, r *http.Request) {
+	var req service.BatchCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid request body", err.Error())
+		return
+	}
+
+	resp, err := h.service.CreateShortURLBatch(r.Context(), &req)
+	if err != nil {
+		switch err {
+		case domain.ErrEmptyBatch, domain.ErrBatchTooLarge:
+			h.respondError(w, http.StatusBadRequest, "invalid batch", err.Error())
+		default:
+			h.logger.Error("failed to create short URL batch", zap.Error(err))
+			h.respondError(w, http.StatusInternalServerError, "internal server error", "")
+		}
+
+		return
+	}
+
+	status := http.StatusCreated
+	if resp.Failed > 0 {
+		status = http.StatusMultiStatus
+	}
+
+	h.respondJSON(w, status, resp)
+}
+
 func (h *URLHandler) RedirectToOriginalURL(w http.ResponseWriter, r *http.Request) {
 	shortCode := chi.URLParam(r, "shortCode")
 	if shortCode == "" {
@@ -61,19 +114,24 @@ func (h *URLHandler) RedirectToOriginalURL(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// Prefetches still get redirected, but are recorded as bots.
 	analytics := &domain.Analytics{
-		IPAddress: h.getClientIP(r),
-		UserAgent: r.UserAgent(),
-		Referer:   r.Referer(),
+		IPAddress:  h.getClientIP(r),
+		UserAgent:  r.UserAgent(),
+		Referer:    r.Referer(),
+		IsBot:      clickinfo.IsPrefetch(r.Header),
+		DoNotTrack: privacy.DoNotTrack(r.Header),
 	}
 
-	originalURL, err := h.service.GetOriginalURL(r.Context(), shortCode, analytics)
+	target, err := h.service.GetOriginalURL(r.Context(), shortCode, analytics)
 	if err != nil {
 		switch err {
 		case domain.ErrURLNotFound:
 			h.respondError(w, http.StatusNotFound, "URL not found", err.Error())
 		case domain.ErrExpiredURL:
 			h.respondError(w, http.StatusGone, "URL has expired", err.Error())
+		case domain.ErrURLDisabled:
+			h.respondError(w, http.StatusGone, "URL is disabled", err.Error())
 		default:
 			h.logger.Error("failed to get original URL", zap.Error(err))
 			h.respondError(w, http.StatusInternalServerError, "internal server error", "")
@@ -82,7 +140,15 @@ func (h *URLHandler) RedirectToOriginalURL(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	http.Redirect(w, r, originalURL, http.StatusMovedPermanently)
+	if target.MaxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(target.MaxAge.Seconds())))
+		w.Header().Set("Expires", time.Now().Add(target.MaxAge).UTC().Format(http.TimeFormat))
+	} else {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Expires", time.Unix(0, 0).UTC().Format(http.TimeFormat))
+	}
+
+	http.Redirect(w, r, target.URL, target.StatusCode)
 }
 
 func (h *URLHandler) GetStats(w http.ResponseWriter, r *http.Request) {
@@ -93,7 +159,13 @@ func (h *URLHandler) GetStats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stats, err := h.service.GetStats(r.Context(), shortCode)
+	includeBots, err := parseBoolParam(r.URL.Query().Get("include_bots"))
+	if err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid include_bots", err.Error())
+		return
+	}
+
+	stats, err := h.service.GetStats(r.Context(), shortCode, includeBots)
 	if err != nil {
 		switch err {
 		case domain.ErrURLNotFound:
@@ -109,6 +181,250 @@ func (h *URLHandler) GetStats(w http.ResponseWriter, r *http.Request) {
 	h.respondJSON(w, http.StatusOK, stats)
 }
 
+func (h *URLHandler) GetTimeSeries(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	req := service.TimeSeriesRequest{
+		ShortCode: chi.URLParam(r, "shortCode"),
+		Interval:  domain.TimeInterval(query.Get("interval")),
+		Timezone:  query.Get("tz"),
+	}
+
+	var err error
+	if req.From, err = parseTimeParam(query.Get("from")); err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid from", err.Error())
+		return
+	}
+	if req.To, err = parseTimeParam(query.Get("to")); err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid to", err.Error())
+		return
+	}
+	if req.Unique, err = parseBoolParam(query.Get("unique")); err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid unique", err.Error())
+		return
+	}
+	if req.IncludeBots, err = parseBoolParam(query.Get("include_bots")); err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid include_bots", err.Error())
+		return
+	}
+
+	series, err := h.service.GetTimeSeries(r.Context(), req)
+	if err != nil {
+		switch err {
+		case domain.ErrURLNotFound:
+			h.respondError(w, http.StatusNotFound, "URL not found", err.Error())
+		case domain.ErrInvalidInterval, domain.ErrInvalidTimezone, domain.ErrUniqueInterval:
+			h.respondError(w, http.StatusBadRequest, "invalid time series query", err.Error())
+		case domain.ErrInvalidTimeRange:
+			h.respondError(w, http.StatusBadRequest, "invalid time series query", "from must be before to and the range must not span more than 5000 intervals")
+		default:
+			h.logger.Error("failed to get time series", zap.Error(err))
+			h.respondError(w, http.StatusInternalServerError, "internal server error", "")
+		}
+
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, series)
+}
+
+func (h *URLHandler) GetBreakdown(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	req := service.BreakdownRequest{
+		ShortCode: chi.URLParam(r, "shortCode"),
+		Dimension: domain.BreakdownDimension(chi.URLParam(r, "dimension")),
+	}
+
+	var err error
+	if req.From, err = parseTimeParam(query.Get("from")); err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid from", err.Error())
+		return
+	}
+	if req.To, err = parseTimeParam(query.Get("to")); err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid to", err.Error())
+		return
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if req.Limit, err = strconv.Atoi(limit); err != nil {
+			h.respondError(w, http.StatusBadRequest, "invalid limit", err.Error())
+			return
+		}
+	}
+	if req.IncludeBots, err = parseBoolParam(query.Get("include_bots")); err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid include_bots", err.Error())
+		return
+	}
+
+	breakdown, err := h.service.GetBreakdown(r.Context(), req)
+	if err != nil {
+		switch err {
+		case domain.ErrURLNotFound:
+			h.respondError(w, http.StatusNotFound, "URL not found", err.Error())
+		case domain.ErrInvalidDimension:
+			h.respondError(w, http.StatusBadRequest, "invalid dimension", err.Error())
+		case domain.ErrInvalidTimeRange:
+			h.respondError(w, http.StatusBadRequest, "invalid time range", "from must be before to")
+		default:
+			h.logger.Error("failed to get breakdown", zap.Error(err))
+			h.respondError(w, http.StatusInternalServerError, "internal server error", "")
+		}
+
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, breakdown)
+}
+
+func (h *URLHandler) UpdateURL(w http.ResponseWriter, r *http.Request) {
+	shortCode := chi.URLParam(r, "shortCode")
+	if shortCode == "" {
+		h.respondError(w, http.StatusBadRequest, "short code is required", "")
+
+		return
+	}
+
+	var req service.UpdateURLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid request body", err.Error())
+		return
+	}
+
+	resp, err := h.service.UpdateURL(r.Context(), shortCode, &req)
+	if err != nil {
+		switch err {
+		case domain.ErrInvalidURL:
+			h.respondError(w, http.StatusBadRequest, "invalid URL", err.Error())
+		case domain.ErrInvalidRedirect:
+			h.respondError(w, http.StatusBadRequest, "invalid redirect type", err.Error())
+		case domain.ErrInvalidStatus:
+			h.respondError(w, http.StatusBadRequest, "invalid status", err.Error())
+		case domain.ErrURLNotFound:
+			h.respondError(w, http.StatusNotFound, "URL not found", err.Error())
+		default:
+			h.logger.Error("failed to update URL", zap.Error(err))
+			h.respondError(w, http.StatusInternalServerError, "internal server error", "")
+		}
+
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, resp)
+}
+
+func (h *URLHandler) ListURLs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filter := domain.URLFilter{
+		Expiry:       domain.ExpiryState(query.Get("expiry")),
+		HostContains: query.Get("host"),
+		MetadataKey:  query.Get("meta_key"),
+		SortBy:       domain.URLSortField(query.Get("sort")),
+		Descending:   query.Get("order") != "asc",
+		Cursor:       query.Get("cursor"),
+	}
+	if query.Has("meta_value") {
+		value := query.Get("meta_value")
+		filter.MetadataValue = &value
+	}
+
+	if order := query.Get("order"); order != "" && order != "asc" && order != "desc" {
+		h.respondError(w, http.StatusBadRequest, "invalid order", "order must be asc or desc")
+		return
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil {
+			h.respondError(w, http.StatusBadRequest, "invalid limit", err.Error())
+			return
+		}
+		filter.Limit = value
+	}
+
+	var err error
+	if filter.CreatedAfter, err = parseTimeParam(query.Get("created_after")); err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid created_after", err.Error())
+		return
+	}
+	if filter.CreatedBefore, err = parseTimeParam(query.Get("created_before")); err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid created_before", err.Error())
+		return
+	}
+
+	page, err := h.service.ListURLs(r.Context(), filter)
+	if err != nil {
+		switch err {
+		case domain.ErrInvalidFilter:
+			h.respondError(w, http.StatusBadRequest, "invalid filter", err.Error())
+		case domain.ErrInvalidCursor:
+			h.respondError(w, http.StatusBadRequest, "invalid cursor", err.Error())
+		default:
+			h.logger.Error("failed to list URLs", zap.Error(err))
+			h.respondError(w, http.StatusInternalServerError, "internal server error", "")
+		}
+
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, page)
+}
+
+func (h *URLHandler) ExportURLs(w http.ResponseWriter, r *http.Request) {
+	format := transfer.Format(r.URL.Query().Get("format"))
+	if format == "" {
+		format = transfer.FormatNDJSON
+	}
+	if format != transfer.FormatCSV && format != transfer.FormatNDJSON {
+		h.respondError(w, http.StatusBadRequest, "invalid format", "format must be csv or ndjson")
+		return
+	}
+
+	w.Header().Set("Content-Type", transfer.ContentType(format))
+	w.Header().Set("Content-Disposition", "attachment; filename=urls."+string(format))
+	w.WriteHeader(http.StatusOK)
+
+	// The status line is already sent, so a failure can only be logged.
+	if err := h.service.ExportURLs(r.Context(), w, format); err != nil {
+		h.logger.Error("failed to export URLs", zap.Error(err))
+	}
+}
+
+func (h *URLHandler) ImportURLs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	format := transfer.Format(query.Get("format"))
+	if format == "" {
+		format = transfer.FormatNDJSON
+	}
+
+	policy := domain.ConflictPolicy(query.Get("conflict"))
+	if policy == "" {
+		policy = domain.ConflictSkip
+	}
+
+	result, err := h.service.ImportURLs(r.Context(), r.Body, format, policy)
+	if err != nil {
+		switch {
+		case errors.Is(err, transfer.ErrUnsupportedFormat):
+			h.respondError(w, http.StatusBadRequest, "invalid format", "format must be csv, ndjson or bitly")
+		case errors.Is(err, domain.ErrInvalidPolicy):
+			h.respondError(w, http.StatusBadRequest, "invalid conflict policy", "conflict must be skip, overwrite or fail")
+		case errors.Is(err, domain.ErrInvalidImport):
+			h.respondError(w, http.StatusBadRequest, "invalid import data", err.Error())
+		case errors.Is(err, domain.ErrShortCodeExists):
+			h.respondError(w, http.StatusConflict, "short code already exists", err.Error())
+		default:
+			h.logger.Error("failed to import URLs", zap.Error(err))
+			h.respondError(w, http.StatusInternalServerError, "internal server error", "")
+		}
+
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, result)
+}
+
 func (h *URLHandler) DeleteURL(w http.ResponseWriter, r *http.Request) {
 	shortCode := chi.URLParam(r, "shortCode")
 	if shortCode == "" {
@@ -132,6 +448,70 @@ func (h *URLHandler) DeleteURL(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (h *URLHandler) FlushCache(w http.ResponseWriter, r *http.Request) {
+	generation, err := h.service.FlushCache(r.Context())
+	if err != nil {
+		h.logger.Error("failed to flush cache", zap.Error(err))
+		h.respondError(w, http.StatusInternalServerError, "internal server error", "")
+
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, FlushCacheResponse{Generation: generation})
+}
+
+func (h *URLHandler) WarmCache(w http.ResponseWriter, r *http.Request) {
+	var limit int
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			h.respondError(w, http.StatusBadRequest, "invalid limit", "")
+
+			return
+		}
+		limit = parsed
+	}
+
+	result, err := h.service.WarmCache(r.Context(), limit)
+	if err != nil {
+		switch err {
+		case domain.ErrWarmupInProgress:
+			h.respondError(w, http.StatusConflict, "warm-up in progress", err.Error())
+		default:
+			h.logger.Error("failed to warm cache", zap.Error(err))
+			h.respondError(w, http.StatusInternalServerError, "internal server error", "")
+		}
+
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, result)
+}
+
+func (h *URLHandler) EraseClicks(w http.ResponseWriter, r *http.Request) {
+	var req service.EraseClicksRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid request body", err.Error())
+
+		return
+	}
+
+	erased, err := h.service.EraseClicks(r.Context(), req)
+	if err != nil {
+		switch err {
+		case domain.ErrInvalidErasure:
+			h.respondError(w, http.StatusBadRequest, "invalid erasure request", err.Error())
+		default:
+			h.logger.Error("failed to erase clicks", zap.Error(err))
+			h.respondError(w, http.StatusInternalServerError, "internal server error", "")
+		}
+
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, EraseClicksResponse{Erased: erased})
+}
+
 func (h *URLHandler) respondJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -147,27 +527,33 @@ func (h *URLHandler) respondError(w http.ResponseWriter, status int, error strin
 	})
 }
 
-func (h *URLHandler) getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header first
-	xff := r.Header.Get("X-Forwarded-For")
-	if xff != "" {
-		ips := strings.Split(xff, ",")
-		if len(ips) > 0 {
-			return strings.TrimSpace(ips[0])
-		}
+func parseTimeParam(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
 	}
 
-	// Check X-Real-IP header
-	xri := r.Header.Get("X-Real-IP")
-	if xri != "" {
-		return xri
+	return &t, nil
+}
+
+func parseBoolParam(value string) (bool, error) {
+	if value == "" {
+		return false, nil
 	}
 
-	// Fallback to RemoteAddr
-	ip := r.RemoteAddr
-	if strings.Contains(ip, ":") {
-		ip = strings.Split(ip, ":")[0]
+	return strconv.ParseBool(value)
+}
+
+// getClientIP returns the address of the client, which the RealIP middleware
+// only takes from forwarding headers when a trusted proxy sent them.
+func (h *URLHandler) getClientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
 	}
 
-	return ip
+	return r.RemoteAddr
 }
@@ -80,11 +80,8 @@ func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
 	})
 }
 
+// getIP keys visitors by the address RealIP settled on, without the port of
+// the connection.
 func getIP(r *http.Request) string {
-	xff := r.Header.Get("X-Forwarded-For")
-	if xff != "" {
-		return xff
-	}
-
-	return r.RemoteAddr
+	return hostOnly(r.RemoteAddr)
 }
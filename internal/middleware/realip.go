@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RealIP sets RemoteAddr to the client address forwarded in X-Forwarded-For
+// or X-Real-IP, but only for requests that come from one of trustedProxies,
+// in CIDR notation. Anyone else could send those headers to pose as another
+// client, so their requests keep the address they connected from.
+func RealIP(trustedProxies []string) (func(next http.Handler) http.Handler, error) {
+	var trusted []*net.IPNet
+	for _, cidr := range trustedProxies {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", cidr, err)
+		}
+		trusted = append(trusted, network)
+	}
+
+	isTrusted := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return false
+		}
+		for _, network := range trusted {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isTrusted(hostOnly(r.RemoteAddr)) {
+				if ip := forwardedIP(r, isTrusted); ip != "" {
+					r.RemoteAddr = ip
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// forwardedIP returns the last X-Forwarded-For address not added by a trusted
+// proxy, as earlier ones were sent by the client, or else X-Real-IP.
+func forwardedIP(r *http.Request, isTrusted func(string) bool) string {
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		if !isTrusted(hop) {
+			return hop
+		}
+	}
+
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+		return ip
+	}
+
+	return ""
+}
+
+// hostOnly strips the port from addr, which has none once RealIP set it.
+func hostOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return addr
+}
@@ -0,0 +1,151 @@
+// Package privacy decides how much of a click may be stored: client IPs can
+// be truncated or replaced with a keyed hash, and visitors who ask not to be
+// tracked can be recorded without anything that identifies them.
+package privacy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+)
+
+type IPMode string
+
+const (
+	IPFull     IPMode = "full"
+	IPTruncate IPMode = "truncate"
+	IPHash     IPMode = "hash"
+)
+
+var (
+	ipv4Mask = net.CIDRMask(24, 32)
+	ipv6Mask = net.CIDRMask(48, 128)
+)
+
+type Options struct {
+	// IPMode is full, truncate or hash; empty means full.
+	IPMode IPMode
+	// HashKey keys the IP hashes. It must stay the same for hashes to be
+	// comparable, and secret for them not to be reversed by trying every
+	// address.
+	HashKey string
+	// HonorDoNotTrack records clicks of visitors sending DNT or Sec-GPC
+	// without their IP, user agent, referrer or location below the country.
+	HonorDoNotTrack bool
+}
+
+type Policy struct {
+	opts Options
+}
+
+func NewPolicy(opts Options) (*Policy, error) {
+	if opts.IPMode == "" {
+		opts.IPMode = IPFull
+	}
+
+	switch opts.IPMode {
+	case IPFull, IPTruncate:
+	case IPHash:
+		if opts.HashKey == "" {
+			return nil, errors.New("hashing IP addresses needs a key")
+		}
+	default:
+		return nil, fmt.Errorf("unknown IP mode %q", opts.IPMode)
+	}
+
+	return &Policy{opts: opts}, nil
+}
+
+// DoNotTrack reports whether a request asks not to be tracked.
+func DoNotTrack(header http.Header) bool {
+	return header.Get("DNT") == "1" || header.Get("Sec-GPC") == "1"
+}
+
+// OptedOut reports whether the click must be stored without what
+// identifies the visitor.
+func (p *Policy) OptedOut(click *domain.Analytics) bool {
+	return p.opts.HonorDoNotTrack && click.DoNotTrack
+}
+
+// Apply removes from the click what the policy does not allow to store.
+func (p *Policy) Apply(click *domain.Analytics) {
+	if p.OptedOut(click) {
+		click.IPAddress = ""
+		click.UserAgent = ""
+		click.Referer = ""
+		click.Region = ""
+		click.City = ""
+
+		return
+	}
+
+	if click.IPAddress == "" {
+		return
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(click.IPAddress))
+	switch {
+	case ip == nil:
+		// Whatever it is, it is no address worth storing, nor one that can be
+		// anonymized.
+		click.IPAddress = ""
+	case p.opts.IPMode == IPFull:
+		click.IPAddress = ip.String()
+	case p.opts.IPMode == IPHash:
+		click.IPAddress = p.hash(ip)
+	default:
+		click.IPAddress = truncate(ip)
+	}
+}
+
+// StoredIPs returns every form in which ip may have been stored on its own,
+// in full or hashed, so that all its clicks can be found. The truncated form
+// is left out, as it stands for other addresses of the same network as well.
+// It is false if ip is not an IP address.
+func (p *Policy) StoredIPs(ip string) ([]string, bool) {
+	parsed := net.ParseIP(strings.TrimSpace(ip))
+	if parsed == nil {
+		return nil, false
+	}
+
+	forms := []string{parsed.String()}
+	if p.opts.HashKey != "" {
+		forms = append(forms, p.hash(parsed))
+	}
+
+	return forms, true
+}
+
+// StoredNetwork returns the truncated form in which the network of ip is
+// stored in truncate mode. It is false if ip is not an IP address.
+func StoredNetwork(ip string) (string, bool) {
+	parsed := net.ParseIP(strings.TrimSpace(ip))
+	if parsed == nil {
+		return "", false
+	}
+
+	return truncate(parsed), true
+}
+
+func (p *Policy) hash(ip net.IP) string {
+	mac := hmac.New(sha256.New, []byte(p.opts.HashKey))
+	mac.Write([]byte(ip.String()))
+
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// truncate keeps the /24 of an IPv4 address and the /48 of an IPv6 one.
+func truncate(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(ipv4Mask).String()
+	}
+
+	return ip.Mask(ipv6Mask).String()
+}
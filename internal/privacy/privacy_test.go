@@ -0,0 +1,107 @@
+package privacy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy_Apply(t *testing.T) {
+	tests := []struct {
+		mode IPMode
+		ip   string
+		want string
+	}{
+		{mode: IPFull, ip: "81.2.69.160", want: "81.2.69.160"},
+		{mode: IPFull, ip: "2001:DB8::0001", want: "2001:db8::1"},
+		{mode: IPFull, ip: "' OR 1=1 --", want: ""},
+		{mode: IPTruncate, ip: "81.2.69.160", want: "81.2.69.0"},
+		{mode: IPTruncate, ip: "::ffff:81.2.69.160", want: "81.2.69.0"},
+		{mode: IPTruncate, ip: "2001:db8:85a3:8d3:1319:8a2e:370:7348", want: "2001:db8:85a3::"},
+		{mode: IPTruncate, ip: "unknown", want: ""},
+		{mode: IPHash, ip: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.mode)+" "+tt.ip, func(t *testing.T) {
+			policy, err := NewPolicy(Options{IPMode: tt.mode, HashKey: "secret"})
+			require.NoError(t, err)
+
+			click := &domain.Analytics{IPAddress: tt.ip}
+			policy.Apply(click)
+			assert.Equal(t, tt.want, click.IPAddress)
+		})
+	}
+}
+
+func TestPolicy_HashesWithKey(t *testing.T) {
+	policy, err := NewPolicy(Options{IPMode: IPHash, HashKey: "secret"})
+	require.NoError(t, err)
+	other, err := NewPolicy(Options{IPMode: IPHash, HashKey: "other"})
+	require.NoError(t, err)
+
+	first := &domain.Analytics{IPAddress: "81.2.69.160"}
+	second := &domain.Analytics{IPAddress: "::ffff:81.2.69.160"}
+	third := &domain.Analytics{IPAddress: "81.2.69.160"}
+	policy.Apply(first)
+	policy.Apply(second)
+	other.Apply(third)
+
+	assert.Len(t, first.IPAddress, 32)
+	assert.Equal(t, first.IPAddress, second.IPAddress)
+	assert.NotEqual(t, first.IPAddress, third.IPAddress)
+
+	forms, ok := policy.StoredIPs("81.2.69.160")
+	require.True(t, ok)
+	assert.Equal(t, []string{"81.2.69.160", first.IPAddress}, forms)
+
+	_, ok = policy.StoredIPs("not an ip")
+	assert.False(t, ok)
+
+	network, ok := StoredNetwork("81.2.69.160")
+	require.True(t, ok)
+	assert.Equal(t, "81.2.69.0", network)
+}
+
+func TestPolicy_HonorsDoNotTrack(t *testing.T) {
+	click := func() *domain.Analytics {
+		return &domain.Analytics{
+			IPAddress:  "81.2.69.160",
+			UserAgent:  "Mozilla/5.0",
+			Referer:    "https://example.com/?user=42",
+			Country:    "GB",
+			City:       "London",
+			DoNotTrack: true,
+		}
+	}
+
+	ignoring, err := NewPolicy(Options{})
+	require.NoError(t, err)
+	kept := click()
+	ignoring.Apply(kept)
+	assert.Equal(t, click(), kept)
+
+	honoring, err := NewPolicy(Options{HonorDoNotTrack: true})
+	require.NoError(t, err)
+	stripped := click()
+	honoring.Apply(stripped)
+	assert.Equal(t, &domain.Analytics{Country: "GB", DoNotTrack: true}, stripped)
+}
+
+func TestNewPolicy_InvalidOptions(t *testing.T) {
+	_, err := NewPolicy(Options{IPMode: IPHash})
+	assert.Error(t, err)
+
+	_, err = NewPolicy(Options{IPMode: "mask"})
+	assert.Error(t, err)
+}
+
+func TestDoNotTrack(t *testing.T) {
+	assert.True(t, DoNotTrack(http.Header{"Dnt": {"1"}}))
+	assert.True(t, DoNotTrack(http.Header{"Sec-Gpc": {"1"}}))
+	assert.False(t, DoNotTrack(http.Header{"Dnt": {"0"}}))
+	assert.False(t, DoNotTrack(http.Header{}))
+}
@@ -0,0 +1,298 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultBreakerThreshold     = 5
+	defaultBreakerProbeInterval = 5 * time.Second
+
+	// maxMissedDeletes bounds the deletes remembered for replay; past it the
+	// whole cache is flushed instead.
+	maxMissedDeletes = 10000
+)
+
+type BreakerState string
+
+const (
+	BreakerClosed BreakerState = "closed"
+	BreakerOpen   BreakerState = "open"
+)
+
+var cacheBreakerOpen = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "cache_circuit_breaker_open",
+		Help: "Whether the cache circuit breaker is open (1) or closed (0)",
+	},
+)
+
+// CircuitBreakerCache stops calling a failing cache after threshold
+// consecutive errors and fails fast with ErrCacheUnavailable until a probe
+// succeeds, so requests fall through to the database instead of waiting on
+// timeouts.
+//
+// Deletes that fail are remembered and replayed before the breaker closes
+// again, so the cache does not come back with links that changed in the
+// meantime. When too many are missed, flush empties the cache instead.
+type CircuitBreakerCache struct {
+	cache     domain.CacheRepository
+	probe     func(ctx context.Context) error
+	flush     func(ctx context.Context) error
+	threshold int
+	interval  time.Duration
+	logger    *zap.Logger
+
+	mu        sync.RWMutex
+	state     BreakerState
+	failures  int
+	lastError error
+	missed    map[string]struct{}
+	overflow  bool
+}
+
+func NewCircuitBreakerCache(cache domain.CacheRepository, probe, flush func(ctx context.Context) error, threshold int, interval time.Duration, logger *zap.Logger) *CircuitBreakerCache {
+	if threshold <= 0 {
+		threshold = defaultBreakerThreshold
+	}
+	if interval <= 0 {
+		interval = defaultBreakerProbeInterval
+	}
+
+	return &CircuitBreakerCache{
+		cache:     cache,
+		probe:     probe,
+		flush:     flush,
+		threshold: threshold,
+		interval:  interval,
+		logger:    logger,
+		state:     BreakerClosed,
+	}
+}
+
+// Run probes the cache while the breaker is open and closes it again once
+// the cache answers and the missed deletes are replayed, until ctx is done.
+func (c *CircuitBreakerCache) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if state, _ := c.State(); state != BreakerOpen {
+				// Deletes can also fail without opening the breaker.
+				c.replay(ctx)
+
+				continue
+			}
+
+			probeCtx, cancel := context.WithTimeout(ctx, c.interval)
+			err := c.probe(probeCtx)
+			cancel()
+
+			if err == nil && c.replay(ctx) == nil {
+				c.close()
+			}
+		}
+	}
+}
+
+// State returns the breaker state and the error that last opened it.
+func (c *CircuitBreakerCache) State() (BreakerState, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.state, c.lastError
+}
+
+// Open trips the breaker right away, e.g. when the cache is unreachable at
+// startup.
+func (c *CircuitBreakerCache) Open(reason error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.open(reason)
+}
+
+func (c *CircuitBreakerCache) Set(ctx context.Context, key string, value interface{}) error {
+	return c.call(ctx, func() error {
+		return c.cache.Set(ctx, key, value)
+	})
+}
+
+func (c *CircuitBreakerCache) SetWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	return c.call(ctx, func() error {
+		return c.cache.SetWithTTL(ctx, key, value, ttl)
+	})
+}
+
+func (c *CircuitBreakerCache) SetMany(ctx context.Context, entries []domain.CacheEntry) error {
+	return c.call(ctx, func() error {
+		return c.cache.SetMany(ctx, entries)
+	})
+}
+
+func (c *CircuitBreakerCache) SetNewer(ctx context.Context, key, value string, version int64, ttl time.Duration) error {
+	return c.call(ctx, func() error {
+		return c.cache.SetNewer(ctx, key, value, version, ttl)
+	})
+}
+
+func (c *CircuitBreakerCache) Get(ctx context.Context, key string) (string, error) {
+	var value string
+	err := c.call(ctx, func() error {
+		var err error
+		value, err = c.cache.Get(ctx, key)
+
+		return err
+	})
+
+	return value, err
+}
+
+func (c *CircuitBreakerCache) Delete(ctx context.Context, key string) error {
+	err := c.call(ctx, func() error {
+		return c.cache.Delete(ctx, key)
+	})
+	if err != nil {
+		c.miss(key)
+	}
+
+	return err
+}
+
+func (c *CircuitBreakerCache) Exists(ctx context.Context, key string) (bool, error) {
+	var exists bool
+	err := c.call(ctx, func() error {
+		var err error
+		exists, err = c.cache.Exists(ctx, key)
+
+		return err
+	})
+
+	return exists, err
+}
+
+func (c *CircuitBreakerCache) call(ctx context.Context, fn func() error) error {
+	if state, _ := c.State(); state == BreakerOpen {
+		return domain.ErrCacheUnavailable
+	}
+
+	err := fn()
+
+	// Misses and callers giving up say nothing about the cache's health.
+	if errors.Is(err, domain.ErrCacheMiss) || ctx.Err() != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil {
+		c.failures = 0
+
+		return nil
+	}
+
+	c.failures++
+	if c.failures >= c.threshold && c.state != BreakerOpen {
+		c.open(err)
+	}
+
+	return err
+}
+
+// miss remembers a delete that did not reach the cache.
+func (c *CircuitBreakerCache) miss(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.overflow {
+		return
+	}
+	if len(c.missed) >= maxMissedDeletes {
+		c.missed = nil
+		c.overflow = true
+
+		return
+	}
+	if c.missed == nil {
+		c.missed = make(map[string]struct{})
+	}
+	c.missed[key] = struct{}{}
+}
+
+// replay applies the missed deletes, or flushes the cache if there were too
+// many. What fails is kept for the next attempt.
+func (c *CircuitBreakerCache) replay(ctx context.Context) error {
+	c.mu.Lock()
+	missed, overflow := c.missed, c.overflow
+	c.missed, c.overflow = nil, false
+	c.mu.Unlock()
+
+	if overflow {
+		if c.flush == nil {
+			c.logger.Warn("too many cache deletes missed to replay, stale entries are served until they expire")
+
+			return nil
+		}
+		if err := c.flush(ctx); err != nil {
+			c.logger.Warn("failed to flush cache after missed deletes", zap.Error(err))
+			c.mu.Lock()
+			c.overflow = true
+			c.mu.Unlock()
+
+			return err
+		}
+		c.logger.Info("cache flushed after missed deletes")
+
+		return nil
+	}
+	if len(missed) == 0 {
+		return nil
+	}
+
+	replayed := len(missed)
+	for key := range missed {
+		if err := c.cache.Delete(ctx, key); err != nil {
+			c.logger.Warn("failed to replay cache deletes", zap.Int("deletes", len(missed)), zap.Error(err))
+			for key := range missed {
+				c.miss(key)
+			}
+
+			return err
+		}
+		delete(missed, key)
+	}
+	c.logger.Info("replayed missed cache deletes", zap.Int("deletes", replayed))
+
+	return nil
+}
+
+func (c *CircuitBreakerCache) open(reason error) {
+	c.state = BreakerOpen
+	c.lastError = reason
+	cacheBreakerOpen.Set(1)
+	c.logger.Warn("cache circuit breaker opened", zap.Error(reason))
+}
+
+func (c *CircuitBreakerCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.state = BreakerClosed
+	c.failures = 0
+	c.lastError = nil
+	cacheBreakerOpen.Set(0)
+	c.logger.Info("cache circuit breaker closed")
+}
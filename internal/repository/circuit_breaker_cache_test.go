@@ -0,0 +1,157 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// failingCache answers every call with err.
+type failingCache struct {
+	NoopCache
+	err   error
+	calls int
+}
+
+func (c *failingCache) Get(ctx context.Context, key string) (string, error) {
+	c.calls++
+
+	return "", c.err
+}
+
+func TestCircuitBreakerCache_OpensAfterThreshold(t *testing.T) {
+	ctx := context.Background()
+	cache := &failingCache{err: errors.New("connection refused")}
+	breaker := NewCircuitBreakerCache(cache, nil, nil, 3, time.Second, zap.NewNop())
+
+	for i := 0; i < 3; i++ {
+		_, err := breaker.Get(ctx, "abc123")
+		assert.EqualError(t, err, "connection refused")
+	}
+
+	state, reason := breaker.State()
+	assert.Equal(t, BreakerOpen, state)
+	assert.EqualError(t, reason, "connection refused")
+
+	_, err := breaker.Get(ctx, "abc123")
+	assert.ErrorIs(t, err, domain.ErrCacheUnavailable)
+	assert.Equal(t, 3, cache.calls)
+}
+
+func TestCircuitBreakerCache_MissesAreNotFailures(t *testing.T) {
+	ctx := context.Background()
+	cache := &failingCache{err: domain.ErrCacheMiss}
+	breaker := NewCircuitBreakerCache(cache, nil, nil, 2, time.Second, zap.NewNop())
+
+	for i := 0; i < 5; i++ {
+		_, err := breaker.Get(ctx, "abc123")
+		assert.ErrorIs(t, err, domain.ErrCacheMiss)
+	}
+
+	state, _ := breaker.State()
+	assert.Equal(t, BreakerClosed, state)
+}
+
+func TestCircuitBreakerCache_ProbeClosesBreaker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	probes := make(chan struct{}, 10)
+	breaker := NewCircuitBreakerCache(NoopCache{}, func(ctx context.Context) error {
+		probes <- struct{}{}
+
+		return nil
+	}, nil, 1, 10*time.Millisecond, zap.NewNop())
+	breaker.Open(errors.New("unreachable at startup"))
+
+	go breaker.Run(ctx)
+	<-probes
+
+	assert.Eventually(t, func() bool {
+		state, _ := breaker.State()
+
+		return state == BreakerClosed
+	}, time.Second, 5*time.Millisecond)
+}
+
+// flakyCache fails every call while down and records the keys it deletes.
+type flakyCache struct {
+	NoopCache
+	mu      sync.Mutex
+	down    bool
+	deleted []string
+}
+
+func (c *flakyCache) Delete(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.down {
+		return errors.New("connection refused")
+	}
+	c.deleted = append(c.deleted, key)
+
+	return nil
+}
+
+func (c *flakyCache) setDown(down bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.down = down
+}
+
+func (c *flakyCache) deletedKeys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]string(nil), c.deleted...)
+}
+
+func TestCircuitBreakerCache_ReplaysMissedDeletesBeforeClosing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache := &flakyCache{down: true}
+	breaker := NewCircuitBreakerCache(cache, func(ctx context.Context) error {
+		return nil
+	}, nil, 1, 10*time.Millisecond, zap.NewNop())
+
+	assert.Error(t, breaker.Delete(ctx, "updated"))
+	assert.ErrorIs(t, breaker.Delete(ctx, "deleted"), domain.ErrCacheUnavailable)
+
+	cache.setDown(false)
+	go breaker.Run(ctx)
+
+	assert.Eventually(t, func() bool {
+		state, _ := breaker.State()
+
+		return state == BreakerClosed
+	}, time.Second, 5*time.Millisecond)
+	assert.ElementsMatch(t, []string{"updated", "deleted"}, cache.deletedKeys())
+}
+
+func TestCircuitBreakerCache_FlushesWhenTooManyDeletesMissed(t *testing.T) {
+	ctx := context.Background()
+	flushed := 0
+	breaker := NewCircuitBreakerCache(&flakyCache{down: true}, nil, func(ctx context.Context) error {
+		flushed++
+
+		return nil
+	}, 1, time.Second, zap.NewNop())
+
+	for i := 0; i <= maxMissedDeletes; i++ {
+		breaker.Delete(ctx, fmt.Sprintf("link%d", i))
+	}
+
+	require.NoError(t, breaker.replay(ctx))
+	assert.Equal(t, 1, flushed)
+}
@@ -0,0 +1,201 @@
+package repository
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+)
+
+const defaultMemoryCacheTTL = 5 * time.Second
+
+// MemoryCache is a size-bounded LRU cache kept in process memory. Entries
+// live for at most ttl, which bounds how stale a missed invalidation can get.
+type MemoryCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	items      map[string]*list.Element
+	order      *list.List
+}
+
+type memoryEntry struct {
+	key       string
+	value     string
+	expiresAt time.Time
+}
+
+func NewMemoryCache(maxEntries int, ttl time.Duration) *MemoryCache {
+	if ttl <= 0 {
+		ttl = defaultMemoryCacheTTL
+	}
+
+	return &MemoryCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		items:      make(map[string]*list.Element, maxEntries),
+		order:      list.New(),
+	}
+}
+
+func (c *MemoryCache) Set(ctx context.Context, key string, value interface{}) error {
+	c.store(key, value, c.ttl)
+
+	return nil
+}
+
+// SetWithTTL stores the value for ttl or the cache's own TTL, whichever is
+// shorter.
+func (c *MemoryCache) SetWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	if ttl <= 0 || ttl > c.ttl {
+		ttl = c.ttl
+	}
+	c.store(key, value, ttl)
+
+	return nil
+}
+
+func (c *MemoryCache) SetMany(ctx context.Context, entries []domain.CacheEntry) error {
+	for _, entry := range entries {
+		c.SetWithTTL(ctx, entry.Key, entry.Value, entry.TTL)
+	}
+
+	return nil
+}
+
+func (c *MemoryCache) SetNewer(ctx context.Context, key, value string, version int64, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.items[key]; ok {
+		entry := element.Value.(*memoryEntry)
+		if time.Now().Before(entry.expiresAt) && valueVersion(entry.value) > version {
+			return nil
+		}
+	}
+	if ttl <= 0 || ttl > c.ttl {
+		ttl = c.ttl
+	}
+	c.storeLocked(key, value, ttl)
+
+	return nil
+}
+
+func (c *MemoryCache) Get(ctx context.Context, key string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.items[key]
+	if !ok {
+		cacheRequestsTotal.WithLabelValues("local", "miss").Inc()
+
+		return "", domain.ErrCacheMiss
+	}
+
+	entry := element.Value.(*memoryEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.remove(element)
+		cacheRequestsTotal.WithLabelValues("local", "miss").Inc()
+
+		return "", domain.ErrCacheMiss
+	}
+
+	c.order.MoveToFront(element)
+	cacheRequestsTotal.WithLabelValues("local", "hit").Inc()
+
+	return entry.value, nil
+}
+
+func (c *MemoryCache) Delete(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.items[key]; ok {
+		c.remove(element)
+	}
+
+	return nil
+}
+
+func (c *MemoryCache) Exists(ctx context.Context, key string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.items[key]
+	if !ok {
+		return false, nil
+	}
+
+	return time.Now().Before(element.Value.(*memoryEntry).expiresAt), nil
+}
+
+// Len returns the number of entries, including expired ones not yet evicted.
+func (c *MemoryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+func (c *MemoryCache) store(key string, value interface{}, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.storeLocked(key, value, ttl)
+}
+
+func (c *MemoryCache) storeLocked(key string, value interface{}, ttl time.Duration) {
+	if c.maxEntries <= 0 {
+		return
+	}
+
+	entry := &memoryEntry{
+		key:       key,
+		value:     toCacheString(value),
+		expiresAt: time.Now().Add(ttl),
+	}
+
+	if element, ok := c.items[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+
+		return
+	}
+
+	c.items[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.maxEntries {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *MemoryCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.items, element.Value.(*memoryEntry).key)
+}
+
+// valueVersion returns the "v" field of a JSON object, or zero.
+func valueVersion(value string) int64 {
+	var versioned struct {
+		V int64 `json:"v"`
+	}
+	json.Unmarshal([]byte(value), &versioned)
+
+	return versioned.V
+}
+
+// toCacheString mirrors how Redis stores values, so both tiers return the
+// same string for the same value.
+func toCacheString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
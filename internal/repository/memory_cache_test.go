@@ -0,0 +1,87 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	cache := NewMemoryCache(2, time.Minute)
+
+	cache.Set(ctx, "a", "1")
+	cache.Set(ctx, "b", "2")
+
+	_, err := cache.Get(ctx, "a")
+	require.NoError(t, err)
+
+	cache.Set(ctx, "c", "3")
+
+	_, err = cache.Get(ctx, "b")
+	assert.ErrorIs(t, err, domain.ErrCacheMiss)
+
+	value, err := cache.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, "1", value)
+	assert.Equal(t, 2, cache.Len())
+}
+
+func TestMemoryCache_ExpiresEntries(t *testing.T) {
+	ctx := context.Background()
+	cache := NewMemoryCache(10, time.Minute)
+
+	cache.SetWithTTL(ctx, "short", "1", 10*time.Millisecond)
+	cache.SetWithTTL(ctx, "capped", "2", time.Hour)
+
+	time.Sleep(20 * time.Millisecond)
+
+	_, err := cache.Get(ctx, "short")
+	assert.ErrorIs(t, err, domain.ErrCacheMiss)
+
+	exists, err := cache.Exists(ctx, "capped")
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestMemoryCache_DeleteAndDisabled(t *testing.T) {
+	ctx := context.Background()
+
+	cache := NewMemoryCache(10, time.Minute)
+	cache.SetMany(ctx, []domain.CacheEntry{{Key: "a", Value: "1"}, {Key: "b", Value: []byte("2")}})
+	cache.Delete(ctx, "a")
+
+	_, err := cache.Get(ctx, "a")
+	assert.ErrorIs(t, err, domain.ErrCacheMiss)
+
+	value, err := cache.Get(ctx, "b")
+	require.NoError(t, err)
+	assert.Equal(t, "2", value)
+
+	disabled := NewMemoryCache(0, time.Minute)
+	disabled.Set(ctx, "a", "1")
+
+	_, err = disabled.Get(ctx, "a")
+	assert.ErrorIs(t, err, domain.ErrCacheMiss)
+}
+
+func TestMemoryCache_SetNewerKeepsNewerValues(t *testing.T) {
+	ctx := context.Background()
+	cache := NewMemoryCache(10, time.Minute)
+
+	require.NoError(t, cache.SetNewer(ctx, "link", `{"u":"new","v":2}`, 2, 0))
+	require.NoError(t, cache.SetNewer(ctx, "link", `{"u":"old","v":1}`, 1, 0))
+
+	value, err := cache.Get(ctx, "link")
+	require.NoError(t, err)
+	assert.Equal(t, `{"u":"new","v":2}`, value)
+
+	require.NoError(t, cache.SetNewer(ctx, "link", `{"u":"newer","v":3}`, 3, 0))
+	value, err = cache.Get(ctx, "link")
+	require.NoError(t, err)
+	assert.Equal(t, `{"u":"newer","v":3}`, value)
+}
@@ -0,0 +1,43 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+)
+
+// NoopCache caches nothing, so every lookup goes to the database.
+type NoopCache struct{}
+
+func NewNoopCache() *NoopCache {
+	return &NoopCache{}
+}
+
+func (NoopCache) Set(ctx context.Context, key string, value interface{}) error {
+	return nil
+}
+
+func (NoopCache) SetWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	return nil
+}
+
+func (NoopCache) SetMany(ctx context.Context, entries []domain.CacheEntry) error {
+	return nil
+}
+
+func (NoopCache) SetNewer(ctx context.Context, key, value string, version int64, ttl time.Duration) error {
+	return nil
+}
+
+func (NoopCache) Get(ctx context.Context, key string) (string, error) {
+	return "", domain.ErrCacheMiss
+}
+
+func (NoopCache) Delete(ctx context.Context, key string) error {
+	return nil
+}
+
+func (NoopCache) Exists(ctx context.Context, key string) (bool, error) {
+	return false, nil
+}
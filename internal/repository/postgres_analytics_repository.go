@@ -3,13 +3,30 @@ package repository
 import (
 	"context"
 	"errors"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/bajdzun/go-url-shortener/internal/domain"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+var clicksRejected = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "analytics_clicks_rejected_total",
+	Help: "Clicks the database refused to store, left out of their batch",
+})
+
+var clickColumns = []string{"short_code", "clicked_at", "ip_address", "user_agent", "referer", "country", "region", "city", "browser", "os", "device", "is_bot", "referrer_domain"}
+
+// copier is a pool or a transaction.
+type copier interface {
+	CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, error)
+}
+
 type PostgresAnalyticsRepository struct {
 	pool *pgxpool.Pool
 }
@@ -18,49 +35,234 @@ func NewPostgresAnalyticsRepository(pool *pgxpool.Pool) *PostgresAnalyticsReposi
 	return &PostgresAnalyticsRepository{pool: pool}
 }
 
-func (r *PostgresAnalyticsRepository) RecordClick(ctx context.Context, analytics *domain.Analytics) error {
-	query := `
-		INSERT INTO url_analytics (short_code, clicked_at, ip_address, user_agent, referer, country)
-		VALUES ($1, $2, $3, $4, $5, $6)
-	`
+// RecordClicks stores what it can of the clicks. Clicks the database refuses
+// are left out and counted in analytics_clicks_rejected_total; any other
+// failure stores none of them.
+func (r *PostgresAnalyticsRepository) RecordClicks(ctx context.Context, clicks []*domain.Analytics) error {
+	err := copyClicks(ctx, r.pool, clicks)
+
+	// A single click on a link deleted in the meantime fails the whole COPY,
+	// so retry with the clicks whose links still exist.
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == foreignKeyViolationCode {
+		if clicks, err = r.withExistingLinks(ctx, clicks); err != nil {
+			return err
+		}
+
+		err = copyClicks(ctx, r.pool, clicks)
+	}
+
+	// So does any other click the database refuses, which is found by
+	// splitting the batch.
+	if isDataError(err) {
+		return r.copyAccepted(ctx, clicks)
+	}
+
+	return err
+}
+
+// copyAccepted stores the clicks in one transaction, splitting every part
+// that fails until the refused clicks are isolated and left out.
+func (r *PostgresAnalyticsRepository) copyAccepted(ctx context.Context, clicks []*domain.Analytics) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	rejected, err := copySplit(ctx, tx, clicks)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	clicksRejected.Add(float64(rejected))
+
+	return nil
+}
+
+// copySplit copies both halves of clicks under savepoints, splitting further
+// the halves the database refuses, and returns how many clicks it left out.
+func copySplit(ctx context.Context, tx pgx.Tx, clicks []*domain.Analytics) (int, error) {
+	rejected := 0
+	half := len(clicks) / 2
+	for _, part := range [][]*domain.Analytics{clicks[:half], clicks[half:]} {
+		if len(part) == 0 {
+			continue
+		}
+
+		savepoint, err := tx.Begin(ctx)
+		if err != nil {
+			return 0, err
+		}
+		err = copyClicks(ctx, savepoint, part)
+		if err == nil {
+			if err := savepoint.Commit(ctx); err != nil {
+				return 0, err
+			}
+
+			continue
+		}
+		if rollbackErr := savepoint.Rollback(ctx); rollbackErr != nil {
+			return 0, rollbackErr
+		}
+		if !isDataError(err) {
+			return 0, err
+		}
+
+		if len(part) == 1 {
+			rejected++
+
+			continue
+		}
+		partRejected, err := copySplit(ctx, tx, part)
+		if err != nil {
+			return 0, err
+		}
+		rejected += partRejected
+	}
+
+	return rejected, nil
+}
 
-	_, err := r.pool.Exec(
+func copyClicks(ctx context.Context, db copier, clicks []*domain.Analytics) error {
+	if len(clicks) == 0 {
+		return nil
+	}
+
+	_, err := db.CopyFrom(
 		ctx,
-		query,
-		analytics.ShortCode,
-		time.Now(),
-		analytics.IPAddress,
-		analytics.UserAgent,
-		analytics.Referer,
-		analytics.Country,
+		pgx.Identifier{"url_analytics"},
+		clickColumns,
+		pgx.CopyFromSlice(len(clicks), func(i int) ([]interface{}, error) {
+			return clickRow(clicks[i]), nil
+		}),
 	)
 
 	return err
 }
 
-func (r *PostgresAnalyticsRepository) GetStats(ctx context.Context, shortCode string) (*domain.URLStats, error) {
+// clickRow fits the click to its columns, cutting values to their width, so
+// that an oversized header does not cost the click.
+func clickRow(click *domain.Analytics) []interface{} {
+	clickedAt := click.ClickedAt
+	if clickedAt.IsZero() {
+		clickedAt = time.Now()
+	}
+
+	return []interface{}{
+		click.ShortCode,
+		clickedAt,
+		columnText(click.IPAddress, 45),
+		columnText(click.UserAgent, 0),
+		columnText(click.Referer, 0),
+		columnText(click.Country, 2),
+		columnText(click.Region, 128),
+		columnText(click.City, 128),
+		nullIfEmpty(columnText(click.Browser, 32)),
+		nullIfEmpty(columnText(click.OS, 32)),
+		nullIfEmpty(columnText(click.Device, 16)),
+		click.IsBot,
+		columnText(click.ReferrerDomain, 255),
+	}
+}
+
+// columnText makes value valid text for Postgres, which rejects NUL bytes
+// and invalid UTF-8, and cuts it to width characters unless width is zero.
+func columnText(value string, width int) string {
+	value = strings.ToValidUTF8(strings.ReplaceAll(value, "\x00", ""), "")
+	if width <= 0 || utf8.RuneCountInString(value) <= width {
+		return value
+	}
+
+	return string([]rune(value)[:width])
+}
+
+// isDataError reports whether the database refused the data itself, rather
+// than failing to store it.
+func isDataError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+
+	// Class 22 is data exceptions, class 23 integrity constraint violations.
+	return strings.HasPrefix(pgErr.Code, "22") || strings.HasPrefix(pgErr.Code, "23")
+}
+
+func (r *PostgresAnalyticsRepository) withExistingLinks(ctx context.Context, clicks []*domain.Analytics) ([]*domain.Analytics, error) {
+	seen := make(map[string]bool)
+	var codes []string
+	for _, click := range clicks {
+		if !seen[click.ShortCode] {
+			seen[click.ShortCode] = true
+			codes = append(codes, click.ShortCode)
+		}
+	}
+
+	rows, err := r.pool.Query(ctx, `SELECT short_code FROM urls WHERE short_code = ANY($1)`, codes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	existing := make(map[string]bool, len(codes))
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			return nil, err
+		}
+		existing[code] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	kept := make([]*domain.Analytics, 0, len(clicks))
+	for _, click := range clicks {
+		if existing[click.ShortCode] {
+			kept = append(kept, click)
+		}
+	}
+
+	return kept, nil
+}
+
+func (r *PostgresAnalyticsRepository) GetStats(ctx context.Context, shortCode string, includeBots bool) (*domain.URLStats, error) {
+	// urls.click_count never includes bots, so they are counted from the
+	// rollups and the clicks not rolled up yet.
 	query := `
 		SELECT
 			u.short_code,
 			u.original_url,
 			u.click_count,
 			u.created_at,
-			MAX(a.clicked_at) as last_clicked
+			GREATEST(
+				(SELECT MAX(last_clicked_at) FROM click_rollups_daily d
+					WHERE d.short_code = u.short_code AND d.dimension = 'total' AND ($2 OR NOT d.is_bot)),
+				(SELECT MAX(clicked_at) FROM url_analytics a
+					WHERE a.short_code = u.short_code AND NOT a.rolled_up AND ($2 OR NOT a.is_bot))
+			),
+			(SELECT COALESCE(SUM(visitors), 0) FROM daily_unique_visitors v WHERE v.short_code = u.short_code),
+			(SELECT COALESCE(SUM(clicks), 0)::bigint FROM click_rollups_daily d
+				WHERE d.short_code = u.short_code AND d.dimension = 'total' AND d.is_bot)
+			+ (SELECT COUNT(*) FROM url_analytics a WHERE a.short_code = u.short_code AND NOT a.rolled_up AND a.is_bot)
 		FROM urls u
-		LEFT JOIN url_analytics a ON u.short_code = a.short_code
 		WHERE u.short_code = $1
-		GROUP BY u.short_code, u.original_url, u.click_count, u.created_at
 	`
 
 	stats := &domain.URLStats{}
 	var lastClicked *time.Time
 
-	err := r.pool.QueryRow(ctx, query, shortCode).Scan(
+	err := r.pool.QueryRow(ctx, query, shortCode, includeBots).Scan(
 		&stats.ShortCode,
 		&stats.OriginalURL,
 		&stats.ClickCount,
 		&stats.CreatedAt,
 		&lastClicked,
+		&stats.UniqueVisitors,
+		&stats.BotClicks,
 	)
 
 	if err != nil {
@@ -72,6 +274,257 @@ func (r *PostgresAnalyticsRepository) GetStats(ctx context.Context, shortCode st
 	}
 
 	stats.LastClicked = lastClicked
+	if includeBots {
+		stats.ClickCount += stats.BotClicks
+	}
 
 	return stats, nil
 }
+
+func (r *PostgresAnalyticsRepository) GetTimeSeries(ctx context.Context, query domain.TimeSeriesQuery) ([]domain.TimeSeriesPoint, error) {
+	if err := r.checkLinkExists(ctx, query.ShortCode); err != nil {
+		return nil, err
+	}
+
+	sql := `
+		SELECT date_trunc($9, clicked_at, $10) AS bucket, SUM(clicks)::bigint, NULL::bigint
+		FROM ` + rolledUpClicks(rollupTotal, "''") + `
+		GROUP BY bucket
+		ORDER BY bucket
+	`
+	if query.Unique {
+		sql = timeSeriesWithVisitorsQuery
+	}
+
+	// Hourly rollups fit the buckets of time zones a whole number of hours
+	// off UTC, and daily rollups only those of UTC.
+	_, fromOffset := query.From.In(query.Location).Zone()
+	_, toOffset := query.To.In(query.Location).Zone()
+	hours := query.Interval != domain.IntervalMinute && fromOffset%3600 == 0 && toOffset%3600 == 0
+	days := query.Interval != domain.IntervalHour && query.Location == time.UTC
+
+	args := append(rollupRange(query.ShortCode, query.From, query.To, query.IncludeBots, hours, days),
+		string(query.Interval), query.Location.String())
+	rows, err := r.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []domain.TimeSeriesPoint
+	for rows.Next() {
+		var point domain.TimeSeriesPoint
+		if err := rows.Scan(&point.Start, &point.Clicks, &point.UniqueVisitors); err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+
+	return points, rows.Err()
+}
+
+// timeSeriesWithVisitorsQuery adds the daily unique visitors of the days
+// starting in each bucket to the clicks.
+var timeSeriesWithVisitorsQuery = `
+	WITH clicks AS (
+		SELECT date_trunc($9, clicked_at, $10) AS bucket, SUM(clicks)::bigint AS clicks
+		FROM ` + rolledUpClicks(rollupTotal, "''") + `
+		GROUP BY bucket
+	), visitors AS (
+		SELECT date_trunc($9, day::timestamp AT TIME ZONE 'UTC', $10) AS bucket, SUM(visitors)::bigint AS visitors
+		FROM daily_unique_visitors
+		WHERE short_code = $1
+			AND day::timestamp AT TIME ZONE 'UTC' >= $2
+			AND day::timestamp AT TIME ZONE 'UTC' < $3
+		GROUP BY bucket
+	)
+	SELECT bucket, COALESCE(clicks.clicks, 0), COALESCE(visitors.visitors, 0)
+	FROM clicks FULL JOIN visitors USING (bucket)
+	ORDER BY bucket
+`
+
+// breakdownColumns maps each dimension to its column and the label of clicks
+// without a value.
+var breakdownColumns = map[domain.BreakdownDimension]struct{ column, missing string }{
+	domain.DimensionReferrer: {"referrer_domain", "(direct)"},
+	domain.DimensionBrowser:  {"browser", "(unknown)"},
+	domain.DimensionOS:       {"os", "(unknown)"},
+	domain.DimensionDevice:   {"device", "(unknown)"},
+	domain.DimensionCountry:  {"country", "(unknown)"},
+}
+
+func (r *PostgresAnalyticsRepository) GetBreakdown(ctx context.Context, query domain.BreakdownQuery) ([]domain.BreakdownItem, int64, error) {
+	dimension, ok := breakdownColumns[query.Dimension]
+	if !ok {
+		return nil, 0, domain.ErrInvalidDimension
+	}
+	if err := r.checkLinkExists(ctx, query.ShortCode); err != nil {
+		return nil, 0, err
+	}
+
+	args := rollupRange(query.ShortCode, query.From, query.To, query.IncludeBots, true, true)
+
+	var total int64
+	err := r.pool.QueryRow(ctx, `
+		SELECT COALESCE(SUM(clicks), 0)::bigint FROM `+rolledUpClicks(rollupTotal, "''"),
+		args...,
+	).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+	if total == 0 {
+		return []domain.BreakdownItem{}, 0, nil
+	}
+
+	sql := `
+		SELECT COALESCE(NULLIF(value, ''), $9) AS value, SUM(clicks)::bigint AS clicks
+		FROM ` + rolledUpClicks(string(query.Dimension), dimension.column) + `
+		GROUP BY 1
+		ORDER BY clicks DESC, value
+		LIMIT $10
+	`
+
+	rows, err := r.pool.Query(ctx, sql, append(args, dimension.missing, query.Limit)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	items := []domain.BreakdownItem{}
+	for rows.Next() {
+		var item domain.BreakdownItem
+		if err := rows.Scan(&item.Value, &item.Clicks); err != nil {
+			return nil, 0, err
+		}
+		items = append(items, item)
+	}
+
+	return items, total, rows.Err()
+}
+
+func (r *PostgresAnalyticsRepository) ListUnenrichedClicks(ctx context.Context, afterID int64, limit int) ([]*domain.Analytics, error) {
+	rows, err := r.pool.Query(ctx, `
+		SELECT id, COALESCE(user_agent, ''), COALESCE(referer, '')
+		FROM url_analytics
+		WHERE device IS NULL AND id > $1
+		ORDER BY id
+		LIMIT $2
+	`, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var clicks []*domain.Analytics
+	for rows.Next() {
+		click := &domain.Analytics{}
+		if err := rows.Scan(&click.ID, &click.UserAgent, &click.Referer); err != nil {
+			return nil, err
+		}
+		clicks = append(clicks, click)
+	}
+
+	return clicks, rows.Err()
+}
+
+func (r *PostgresAnalyticsRepository) UpdateClickDetails(ctx context.Context, clicks []*domain.Analytics) error {
+	if len(clicks) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(clicks))
+	browsers := make([]string, len(clicks))
+	systems := make([]string, len(clicks))
+	devices := make([]string, len(clicks))
+	bots := make([]bool, len(clicks))
+	referrers := make([]string, len(clicks))
+	for i, click := range clicks {
+		ids[i] = click.ID
+		browsers[i] = click.Browser
+		systems[i] = click.OS
+		devices[i] = click.Device
+		bots[i] = click.IsBot
+		referrers[i] = click.ReferrerDomain
+	}
+
+	_, err := r.pool.Exec(ctx, `
+		UPDATE url_analytics AS a SET
+			browser = d.browser,
+			os = d.os,
+			device = d.device,
+			is_bot = d.is_bot,
+			referrer_domain = d.referrer_domain
+		FROM unnest($1::bigint[], $2::text[], $3::text[], $4::text[], $5::boolean[], $6::text[])
+			AS d(id, browser, os, device, is_bot, referrer_domain)
+		WHERE a.id = d.id
+	`, ids, browsers, systems, devices, bots, referrers)
+
+	return err
+}
+
+func (r *PostgresAnalyticsRepository) LoadVisitorSketch(ctx context.Context, shortCode string, day time.Time) ([]byte, error) {
+	var sketch []byte
+	err := r.pool.QueryRow(ctx, `SELECT sketch FROM daily_unique_visitors WHERE short_code = $1 AND day = $2`, shortCode, day).Scan(&sketch)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+
+	return sketch, err
+}
+
+func (r *PostgresAnalyticsRepository) SaveVisitorSketch(ctx context.Context, shortCode string, day time.Time, sketch []byte, visitors int64) error {
+	_, err := r.pool.Exec(ctx, `
+		INSERT INTO daily_unique_visitors (short_code, day, visitors, sketch)
+		SELECT $1, $2, $3, $4
+		WHERE EXISTS (SELECT 1 FROM urls WHERE short_code = $1)
+		ON CONFLICT (short_code, day) DO UPDATE SET
+			visitors = EXCLUDED.visitors,
+			sketch = EXCLUDED.sketch,
+			updated_at = CURRENT_TIMESTAMP
+	`, shortCode, day, visitors, sketch)
+
+	return err
+}
+
+func (r *PostgresAnalyticsRepository) checkLinkExists(ctx context.Context, shortCode string) error {
+	var exists bool
+	if err := r.pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM urls WHERE short_code = $1)`, shortCode).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return domain.ErrURLNotFound
+	}
+
+	return nil
+}
+
+func nullIfEmpty(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+
+	return value
+}
+
+// ExpireClicks leaves clicks that are not rolled up yet alone, so that they
+// are still counted.
+func (r *PostgresAnalyticsRepository) ExpireClicks(ctx context.Context, cutoff time.Time, limit int) (int64, error) {
+	tag, err := r.pool.Exec(ctx, `
+		DELETE FROM url_analytics
+		WHERE id IN (SELECT id FROM url_analytics WHERE clicked_at < $1 AND rolled_up LIMIT $2)
+	`, cutoff, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+func (r *PostgresAnalyticsRepository) EraseClicks(ctx context.Context, ipAddresses []string) (int64, error) {
+	tag, err := r.pool.Exec(ctx, `DELETE FROM url_analytics WHERE ip_address = ANY($1)`, ipAddresses)
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
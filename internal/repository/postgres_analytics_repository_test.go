@@ -0,0 +1,46 @@
+package repository
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClickRow_FitsValuesToColumns(t *testing.T) {
+	clickedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	row := clickRow(&domain.Analytics{
+		ShortCode:      "abc123",
+		ClickedAt:      clickedAt,
+		IPAddress:      strings.Repeat("1", 60),
+		UserAgent:      "Mozilla\x00/5.0 \xff",
+		Referer:        "https://example.com/" + strings.Repeat("a", 5000),
+		Country:        "DEU",
+		City:           strings.Repeat("ü", 200),
+		Browser:        strings.Repeat("b", 40),
+		Device:         "desktop",
+		ReferrerDomain: "example.com",
+	})
+
+	require.Len(t, row, len(clickColumns))
+	assert.Equal(t, clickedAt, row[1])
+	assert.Equal(t, strings.Repeat("1", 45), row[2])
+	assert.Equal(t, "Mozilla/5.0 ", row[3])
+	assert.Len(t, row[4], 5020)
+	assert.Equal(t, "DE", row[5])
+	assert.Equal(t, strings.Repeat("ü", 128), row[7])
+	assert.Equal(t, strings.Repeat("b", 32), row[8])
+	assert.Nil(t, row[9])
+	assert.Equal(t, "desktop", row[10])
+}
+
+func TestIsDataError(t *testing.T) {
+	assert.True(t, isDataError(&pgconn.PgError{Code: "22001"}))
+	assert.True(t, isDataError(&pgconn.PgError{Code: foreignKeyViolationCode}))
+	assert.False(t, isDataError(&pgconn.PgError{Code: "57014"}))
+	assert.False(t, isDataError(nil))
+}
@@ -0,0 +1,136 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+)
+
+// rollupTotal is the dimension of the rollups counting all clicks, with an
+// empty value.
+const rollupTotal = "total"
+
+// rollupLockID keeps instances from rolling up at the same time, which
+// could deadlock on the rows they both add to.
+const rollupLockID = 7_360_112_025
+
+// RollUpClicks adds up to limit clicks to the hourly and daily rollups of
+// each dimension and marks them as rolled up, in a single statement, so a
+// click is never counted twice. Clicks that were not enriched yet wait for
+// the backfill, as their details would change after being counted.
+func (r *PostgresAnalyticsRepository) RollUpClicks(ctx context.Context, limit int) (int64, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var locked bool
+	if err := tx.QueryRow(ctx, `SELECT pg_try_advisory_xact_lock($1)`, rollupLockID).Scan(&locked); err != nil {
+		return 0, err
+	}
+	if !locked {
+		return 0, nil
+	}
+
+	var rolledUp int64
+	err = tx.QueryRow(ctx, `
+		WITH claimed AS (
+			UPDATE url_analytics SET rolled_up = TRUE
+			WHERE id IN (
+				SELECT id FROM url_analytics
+				WHERE NOT rolled_up AND device IS NOT NULL AND clicked_at IS NOT NULL
+				LIMIT $1
+			)
+			RETURNING short_code, clicked_at, is_bot, browser, os, device, country, referrer_domain
+		), facts AS (
+			SELECT c.short_code, c.clicked_at, c.is_bot, d.dimension, d.value
+			FROM claimed c
+			CROSS JOIN LATERAL (VALUES
+				('`+rollupTotal+`', ''),
+				('`+string(domain.DimensionReferrer)+`', COALESCE(c.referrer_domain, '')),
+				('`+string(domain.DimensionBrowser)+`', COALESCE(c.browser, '')),
+				('`+string(domain.DimensionOS)+`', COALESCE(c.os, '')),
+				('`+string(domain.DimensionDevice)+`', COALESCE(c.device, '')),
+				('`+string(domain.DimensionCountry)+`', COALESCE(c.country, ''))
+			) AS d(dimension, value)
+		), hourly AS (
+			INSERT INTO click_rollups_hourly AS h (short_code, bucket, dimension, value, is_bot, clicks, last_clicked_at)
+			SELECT short_code, date_trunc('hour', clicked_at, 'UTC'), dimension, value, is_bot, COUNT(*), MAX(clicked_at)
+			FROM facts
+			GROUP BY 1, 2, 3, 4, 5
+			ON CONFLICT (short_code, dimension, bucket, value, is_bot) DO UPDATE SET
+				clicks = h.clicks + EXCLUDED.clicks,
+				last_clicked_at = GREATEST(h.last_clicked_at, EXCLUDED.last_clicked_at)
+		), daily AS (
+			INSERT INTO click_rollups_daily AS d (short_code, bucket, dimension, value, is_bot, clicks, last_clicked_at)
+			SELECT short_code, date_trunc('day', clicked_at, 'UTC'), dimension, value, is_bot, COUNT(*), MAX(clicked_at)
+			FROM facts
+			GROUP BY 1, 2, 3, 4, 5
+			ON CONFLICT (short_code, dimension, bucket, value, is_bot) DO UPDATE SET
+				clicks = d.clicks + EXCLUDED.clicks,
+				last_clicked_at = GREATEST(d.last_clicked_at, EXCLUDED.last_clicked_at)
+		)
+		SELECT COUNT(*) FROM claimed
+	`, limit).Scan(&rolledUp)
+	if err != nil {
+		return 0, err
+	}
+
+	return rolledUp, tx.Commit(ctx)
+}
+
+// rolledUpClicks lists the clicks of link $1 in [$2, $3), leaving out bots
+// unless $8, as rows of clicked_at, the value of dimension and the number of
+// clicks they stand for. Whole UTC days in [$6, $7) come from the daily
+// rollups, the other whole hours in [$4, $5) from the hourly ones, and the
+// rest, as well as clicks not rolled up yet, from the clicks themselves,
+// where the dimension is column. Rollup rows are dated at their start.
+func rolledUpClicks(dimension, column string) string {
+	return `(
+		SELECT bucket AS clicked_at, value, clicks
+		FROM click_rollups_daily
+		WHERE short_code = $1 AND dimension = '` + dimension + `' AND ($8 OR NOT is_bot)
+			AND bucket >= $6 AND bucket < $7
+		UNION ALL
+		SELECT bucket, value, clicks
+		FROM click_rollups_hourly
+		WHERE short_code = $1 AND dimension = '` + dimension + `' AND ($8 OR NOT is_bot)
+			AND bucket >= $4 AND bucket < $5 AND NOT (bucket >= $6 AND bucket < $7)
+		UNION ALL
+		SELECT clicked_at, COALESCE(` + column + `, ''), 1
+		FROM url_analytics
+		WHERE short_code = $1 AND ($8 OR NOT is_bot)
+			AND clicked_at >= $2 AND clicked_at < $3
+			AND (NOT rolled_up OR NOT (clicked_at >= $4 AND clicked_at < $5))
+	) c`
+}
+
+// rollupRange returns the arguments of rolledUpClicks. Without hours or days,
+// the matching rollups are not used, e.g. because their buckets would
+// straddle those of a time series.
+func rollupRange(shortCode string, from, to time.Time, includeBots, hours, days bool) []interface{} {
+	hourFrom, hourTo := ceilTime(from, time.Hour), to.Truncate(time.Hour)
+	if !hours || !hourFrom.Before(hourTo) {
+		hourFrom, hourTo = from, from
+	}
+
+	// Truncating to 24 hours gives UTC midnight, as Go times have no leap
+	// seconds.
+	dayFrom, dayTo := ceilTime(hourFrom, 24*time.Hour), hourTo.Truncate(24*time.Hour)
+	if !days || !dayFrom.Before(dayTo) {
+		dayFrom, dayTo = hourFrom, hourFrom
+	}
+
+	return []interface{}{shortCode, from, to, hourFrom, hourTo, dayFrom, dayTo, includeBots}
+}
+
+func ceilTime(t time.Time, d time.Duration) time.Time {
+	truncated := t.Truncate(d)
+	if truncated.Before(t) {
+		return truncated.Add(d)
+	}
+
+	return truncated
+}
@@ -0,0 +1,75 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRollupRange(t *testing.T) {
+	at := func(value string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return parsed
+	}
+
+	tests := []struct {
+		name             string
+		from, to         string
+		hours, days      bool
+		hourFrom, hourTo string
+		dayFrom, dayTo   string
+	}{
+		{
+			name: "days with hours and minutes around them",
+			from: "2024-02-20T10:30:00Z", to: "2024-02-23T05:15:00Z", hours: true, days: true,
+			hourFrom: "2024-02-20T11:00:00Z", hourTo: "2024-02-23T05:00:00Z",
+			dayFrom: "2024-02-21T00:00:00Z", dayTo: "2024-02-23T00:00:00Z",
+		},
+		{
+			name: "whole days",
+			from: "2024-02-20T00:00:00Z", to: "2024-02-22T00:00:00Z", hours: true, days: true,
+			hourFrom: "2024-02-20T00:00:00Z", hourTo: "2024-02-22T00:00:00Z",
+			dayFrom: "2024-02-20T00:00:00Z", dayTo: "2024-02-22T00:00:00Z",
+		},
+		{
+			name: "no whole day",
+			from: "2024-02-20T10:30:00Z", to: "2024-02-21T05:15:00Z", hours: true, days: true,
+			hourFrom: "2024-02-20T11:00:00Z", hourTo: "2024-02-21T05:00:00Z",
+			dayFrom: "2024-02-20T11:00:00Z", dayTo: "2024-02-20T11:00:00Z",
+		},
+		{
+			name: "no whole hour",
+			from: "2024-02-20T10:10:00Z", to: "2024-02-20T10:50:00Z", hours: true, days: true,
+			hourFrom: "2024-02-20T10:10:00Z", hourTo: "2024-02-20T10:10:00Z",
+			dayFrom: "2024-02-20T10:10:00Z", dayTo: "2024-02-20T10:10:00Z",
+		},
+		{
+			name: "hours only",
+			from: "2024-02-20T10:30:00Z", to: "2024-02-23T05:15:00Z", hours: true,
+			hourFrom: "2024-02-20T11:00:00Z", hourTo: "2024-02-23T05:00:00Z",
+			dayFrom: "2024-02-20T11:00:00Z", dayTo: "2024-02-20T11:00:00Z",
+		},
+		{
+			name: "clicks only",
+			from: "2024-02-20T10:30:00Z", to: "2024-02-23T05:15:00Z", days: true,
+			hourFrom: "2024-02-20T10:30:00Z", hourTo: "2024-02-20T10:30:00Z",
+			dayFrom: "2024-02-20T10:30:00Z", dayTo: "2024-02-20T10:30:00Z",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to := at(tt.from), at(tt.to)
+			args := rollupRange("abc", from, to, false, tt.hours, tt.days)
+
+			assert.Equal(t, []interface{}{
+				"abc", from, to, at(tt.hourFrom), at(tt.hourTo), at(tt.dayFrom), at(tt.dayTo), false,
+			}, args)
+		})
+	}
+}
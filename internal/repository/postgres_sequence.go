@@ -0,0 +1,28 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type PostgresSequence struct {
+	pool *pgxpool.Pool
+	name string
+}
+
+func NewPostgresSequence(pool *pgxpool.Pool, name string) *PostgresSequence {
+	return &PostgresSequence{
+		pool: pool,
+		name: name,
+	}
+}
+
+func (s *PostgresSequence) NextValue(ctx context.Context) (int64, error) {
+	query := `SELECT nextval($1::regclass)`
+
+	var value int64
+	err := s.pool.QueryRow(ctx, query, s.name).Scan(&value)
+
+	return value, err
+}
@@ -2,15 +2,36 @@ package repository
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"strings"
 	"time"
 
 	"github.com/bajdzun/go-url-shortener/internal/domain"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+const (
+	importBatchSize = 500
+
+	uniqueViolationCode     = "23505"
+	foreignKeyViolationCode = "23503"
+)
+
+const incrementClickCountsQuery = `
+	UPDATE urls
+	SET click_count = urls.click_count + deltas.delta
+	FROM unnest($1::text[], $2::bigint[]) AS deltas(short_code, delta)
+	WHERE urls.short_code = deltas.short_code
+`
+
+const urlColumns = `id, short_code, original_url, created_at, updated_at, expires_at, click_count, metadata, redirect_type, status`
+
 type PostgresURLRepository struct {
 	pool *pgxpool.Pool
 }
@@ -21,8 +42,8 @@ func NewPostgresURLRepository(pool *pgxpool.Pool) *PostgresURLRepository {
 
 func (r *PostgresURLRepository) Create(ctx context.Context, url *domain.URL) error {
 	query := `
-		INSERT INTO urls (short_code, original_url, created_at, updated_at, expires_at, metadata)
-		VALUES ($1, $2, $3, $4, $5, $6)
+		INSERT INTO urls (short_code, original_url, created_at, updated_at, expires_at, metadata, redirect_type, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, COALESCE(NULLIF($8, ''), 'active'))
 		RETURNING id
 	`
 
@@ -44,79 +65,181 @@ func (r *PostgresURLRepository) Create(ctx context.Context, url *domain.URL) err
 		url.UpdatedAt,
 		url.ExpiresAt,
 		metadataJSON,
+		url.RedirectType,
+		string(url.Status),
 	).Scan(&url.ID)
 
 	if err != nil {
+		if isUniqueViolation(err) {
+			return domain.ErrShortCodeExists
+		}
+
 		return err
 	}
 
 	return nil
 }
 
-func (r *PostgresURLRepository) GetByShortCode(ctx context.Context, shortCode string) (*domain.URL, error) {
+func (r *PostgresURLRepository) CreateBatch(ctx context.Context, urls []*domain.URL, atomic bool) ([]error, error) {
+	// Conflicts are reported per item instead of failing the whole statement
+	// batch, so callers can tell which codes were already taken.
 	query := `
-		SELECT id, short_code, original_url, created_at, updated_at, expires_at, click_count, metadata
-		FROM urls
-		WHERE short_code = $1
+		INSERT INTO urls (short_code, original_url, created_at, updated_at, expires_at, metadata, redirect_type, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, COALESCE(NULLIF($8, ''), 'active'))
+		ON CONFLICT (short_code) DO NOTHING
+		RETURNING id
 	`
 
-	url := &domain.URL{}
-	var metadataJSON []byte
+	itemErrs := make([]error, len(urls))
+	queued := make([]int, 0, len(urls))
+	batch := &pgx.Batch{}
 
-	err := r.pool.QueryRow(ctx, query, shortCode).Scan(
-		&url.ID,
-		&url.ShortCode,
-		&url.OriginalURL,
-		&url.CreatedAt,
-		&url.UpdatedAt,
-		&url.ExpiresAt,
-		&url.ClickCount,
-		&metadataJSON,
-	)
+	for i, url := range urls {
+		var metadataJSON []byte
+		if url.Metadata != nil {
+			data, err := json.Marshal(url.Metadata)
+			if err != nil {
+				itemErrs[i] = err
+				continue
+			}
+			metadataJSON = data
+		}
 
-	if err != nil {
+		batch.Queue(query, url.ShortCode, url.OriginalURL, url.CreatedAt, url.UpdatedAt, url.ExpiresAt, metadataJSON, url.RedirectType, string(url.Status))
+		queued = append(queued, i)
+	}
+
+	if atomic && hasError(itemErrs) {
+		return abortBatch(itemErrs), nil
+	}
+
+	if len(queued) == 0 {
+		return itemErrs, nil
+	}
+
+	var tx pgx.Tx
+	var results pgx.BatchResults
+	if atomic {
+		var err error
+		tx, err = r.pool.Begin(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback(ctx)
+
+		results = tx.SendBatch(ctx, batch)
+	} else {
+		results = r.pool.SendBatch(ctx, batch)
+	}
+
+	for _, i := range queued {
+		err := results.QueryRow().Scan(&urls[i].ID)
 		if errors.Is(err, pgx.ErrNoRows) {
-			return nil, domain.ErrURLNotFound
+			itemErrs[i] = domain.ErrShortCodeExists
+			continue
 		}
+		if err != nil {
+			results.Close()
 
+			return nil, err
+		}
+	}
+
+	if err := results.Close(); err != nil {
 		return nil, err
 	}
 
-	if metadataJSON != nil {
-		if err := json.Unmarshal(metadataJSON, &url.Metadata); err != nil {
+	if atomic {
+		if hasError(itemErrs) {
+			for _, url := range urls {
+				url.ID = 0
+			}
+
+			return abortBatch(itemErrs), nil
+		}
+
+		if err := tx.Commit(ctx); err != nil {
 			return nil, err
 		}
 	}
 
-	return url, nil
+	return itemErrs, nil
 }
 
-func (r *PostgresURLRepository) Update(ctx context.Context, url *domain.URL) error {
+func (r *PostgresURLRepository) GetByShortCode(ctx context.Context, shortCode string) (*domain.URL, error) {
 	query := `
-		UPDATE urls
-		SET original_url = $1, updated_at = $2, expires_at = $3, metadata = $4
-		WHERE short_code = $5
+		SELECT ` + urlColumns + `
+		FROM urls
+		WHERE short_code = $1
 	`
 
+	url, err := scanURL(r.pool.QueryRow(ctx, query, shortCode))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, domain.ErrURLNotFound
+		}
+
+		return nil, err
+	}
+
+	return url, nil
+}
+
+// Update locks the row while apply changes the URL, so concurrent updates
+// are applied one after the other rather than overwriting each other.
+func (r *PostgresURLRepository) Update(ctx context.Context, shortCode string, apply func(url *domain.URL) error) (*domain.URL, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	url, err := scanURL(tx.QueryRow(ctx, `SELECT `+urlColumns+` FROM urls WHERE short_code = $1 FOR UPDATE`, shortCode))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, domain.ErrURLNotFound
+		}
+
+		return nil, err
+	}
+	if err := apply(url); err != nil {
+		return nil, err
+	}
+
 	var metadataJSON []byte
-	var err error
 	if url.Metadata != nil {
 		metadataJSON, err = json.Marshal(url.Metadata)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	cmdTag, err := r.pool.Exec(
+	_, err = tx.Exec(
 		ctx,
-		query,
+		`
+		UPDATE urls
+		SET original_url = $1, updated_at = $2, expires_at = $3, metadata = $4, redirect_type = $5, status = $6
+		WHERE short_code = $7
+		`,
 		url.OriginalURL,
-		time.Now(),
+		url.UpdatedAt,
 		url.ExpiresAt,
 		metadataJSON,
+		url.RedirectType,
+		string(url.Status),
 		url.ShortCode,
 	)
+	if err != nil {
+		return nil, err
+	}
+
+	return url, tx.Commit(ctx)
+}
 
+func (r *PostgresURLRepository) Delete(ctx context.Context, shortCode string) error {
+	query := `DELETE FROM urls WHERE short_code = $1`
+
+	cmdTag, err := r.pool.Exec(ctx, query, shortCode)
 	if err != nil {
 		return err
 	}
@@ -128,28 +251,437 @@ func (r *PostgresURLRepository) Update(ctx context.Context, url *domain.URL) err
 	return nil
 }
 
-func (r *PostgresURLRepository) Delete(ctx context.Context, shortCode string) error {
-	query := `DELETE FROM urls WHERE short_code = $1`
+func (r *PostgresURLRepository) IncrementClickCounts(ctx context.Context, deltas map[string]int64) error {
+	if len(deltas) == 0 {
+		return nil
+	}
 
-	cmdTag, err := r.pool.Exec(ctx, query, shortCode)
+	codes, counts := splitDeltas(deltas)
+	_, err := r.pool.Exec(ctx, incrementClickCountsQuery, codes, counts)
+	return err
+}
+
+// ApplyClickCounts records flushID and applies the deltas in one
+// transaction. Flush records older than a day are pruned along the way; a
+// flush is only ever retried shortly after it first ran.
+func (r *PostgresURLRepository) ApplyClickCounts(ctx context.Context, flushID string, deltas map[string]int64) (bool, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `INSERT INTO click_count_flushes (flush_id) VALUES ($1) ON CONFLICT (flush_id) DO NOTHING`, flushID)
+	if err != nil {
+		return false, err
+	}
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
+
+	codes, counts := splitDeltas(deltas)
+	if _, err := tx.Exec(ctx, incrementClickCountsQuery, codes, counts); err != nil {
+		return false, err
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM click_count_flushes WHERE flushed_at < NOW() - INTERVAL '1 day'`); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit(ctx)
+}
+
+func splitDeltas(deltas map[string]int64) ([]string, []int64) {
+	codes := make([]string, 0, len(deltas))
+	counts := make([]int64, 0, len(deltas))
+	for code, delta := range deltas {
+		codes = append(codes, code)
+		counts = append(counts, delta)
+	}
+
+	return codes, counts
+}
+
+func (r *PostgresURLRepository) List(ctx context.Context, filter domain.URLFilter) (*domain.URLPage, error) {
+	sortColumn := "created_at"
+	if filter.SortBy == domain.SortByClickCount {
+		sortColumn = "click_count"
+	}
+
+	direction, comparator := "ASC", ">"
+	if filter.Descending {
+		direction, comparator = "DESC", "<"
+	}
+
+	var conditions []string
+	var args []interface{}
+	addArg := func(value interface{}) string {
+		args = append(args, value)
+
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if filter.CreatedAfter != nil {
+		conditions = append(conditions, "created_at >= "+addArg(*filter.CreatedAfter))
+	}
+	if filter.CreatedBefore != nil {
+		conditions = append(conditions, "created_at < "+addArg(*filter.CreatedBefore))
+	}
+
+	switch filter.Expiry {
+	case domain.ExpiryActive:
+		conditions = append(conditions, "(expires_at IS NULL OR expires_at > NOW())")
+	case domain.ExpiryExpired:
+		conditions = append(conditions, "expires_at <= NOW()")
+	case domain.ExpiryNever:
+		conditions = append(conditions, "expires_at IS NULL")
+	}
+
+	if filter.HostContains != "" {
+		conditions = append(conditions, fmt.Sprintf(
+			`substring(original_url from '^[^:]+://(?:[^@/]*@)?([^:/?#]+)') ILIKE '%%' || %s || '%%'`,
+			addArg(escapeLike(filter.HostContains)),
+		))
+	}
+
+	if filter.MetadataKey != "" {
+		conditions = append(conditions, metadataCondition(filter.MetadataKey, filter.MetadataValue, addArg))
+	}
+
+	if filter.Cursor != "" {
+		cursor, err := decodeListCursor(filter.Cursor)
+		if err != nil || cursor.Sort != sortColumn || cursor.Descending != filter.Descending {
+			return nil, domain.ErrInvalidCursor
+		}
+
+		var sortValue interface{} = cursor.ClickCount
+		if sortColumn == "created_at" {
+			sortValue = cursor.CreatedAt
+		}
+		conditions = append(conditions, fmt.Sprintf("(%s, id) %s (%s, %s)", sortColumn, comparator, addArg(sortValue), addArg(cursor.ID)))
+	}
+
+	query := `SELECT ` + urlColumns + ` FROM urls`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	// Fetch one extra row to find out whether there is a next page.
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT %s", sortColumn, direction, direction, addArg(filter.Limit+1))
+
+	rows, err := r.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &domain.URLPage{Items: make([]*domain.URL, 0, filter.Limit)}
+	for rows.Next() {
+		url, err := scanURL(rows)
+		if err != nil {
+			return nil, err
+		}
+		page.Items = append(page.Items, url)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Items) > filter.Limit {
+		page.Items = page.Items[:filter.Limit]
+		last := page.Items[len(page.Items)-1]
+		page.NextCursor = encodeListCursor(listCursor{
+			Sort:       sortColumn,
+			Descending: filter.Descending,
+			CreatedAt:  last.CreatedAt,
+			ClickCount: last.ClickCount,
+			ID:         last.ID,
+		})
+	}
+
+	return page, nil
+}
+
+// metadataCondition matches links having key, with value when it is set.
+func metadataCondition(key string, value *string, addArg func(value interface{}) string) string {
+	if value == nil {
+		return "metadata ? " + addArg(key)
+	}
+
+	return fmt.Sprintf("metadata ->> %s = %s", addArg(key), addArg(*value))
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolationCode
+}
+
+func hasError(errs []error) bool {
+	for _, err := range errs {
+		if err != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+func abortBatch(errs []error) []error {
+	for i, err := range errs {
+		if err == nil {
+			errs[i] = domain.ErrBatchAborted
+		}
+	}
+
+	return errs
+}
+
+func (r *PostgresURLRepository) ForEach(ctx context.Context, fn func(url *domain.URL) error) error {
+	query := `SELECT ` + urlColumns + ` FROM urls ORDER BY id`
+
+	rows, err := r.pool.Query(ctx, query)
 	if err != nil {
 		return err
 	}
+	defer rows.Close()
 
-	if cmdTag.RowsAffected() == 0 {
-		return domain.ErrURLNotFound
+	for rows.Next() {
+		url, err := scanURL(rows)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(url); err != nil {
+			return err
+		}
 	}
 
-	return nil
+	return rows.Err()
 }
 
-func (r *PostgresURLRepository) IncrementClickCount(ctx context.Context, shortCode string) error {
+func (r *PostgresURLRepository) ForEachShortCode(ctx context.Context, fn func(shortCode string) error) error {
+	rows, err := r.pool.Query(ctx, `SELECT short_code FROM urls`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var shortCode string
+		if err := rows.Scan(&shortCode); err != nil {
+			return err
+		}
+
+		if err := fn(shortCode); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (r *PostgresURLRepository) TopURLs(ctx context.Context, limit int, clickedSince *time.Time) ([]*domain.URL, error) {
+	const servable = `status = 'active' AND (expires_at IS NULL OR expires_at > NOW())`
+
+	query := `SELECT ` + urlColumns + ` FROM urls WHERE ` + servable + ` ORDER BY click_count DESC LIMIT $1`
+	args := []interface{}{limit}
+	if clickedSince != nil {
+		query = `
+			SELECT ` + urlColumns + `
+			FROM urls
+			JOIN (
+				SELECT short_code, COUNT(*) AS recent_clicks
+				FROM url_analytics
+				WHERE clicked_at >= $2
+				GROUP BY short_code
+			) AS recent USING (short_code)
+			WHERE ` + servable + `
+			ORDER BY recent.recent_clicks DESC
+			LIMIT $1
+		`
+		args = append(args, *clickedSince)
+	}
+
+	rows, err := r.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var urls []*domain.URL
+	for rows.Next() {
+		url, err := scanURL(rows)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+
+	return urls, rows.Err()
+}
+
+func (r *PostgresURLRepository) Import(ctx context.Context, next func() (*domain.URL, error), policy domain.ConflictPolicy) (*domain.ImportResult, error) {
+	var conflictClause string
+	switch policy {
+	case domain.ConflictSkip, domain.ConflictFail:
+		conflictClause = `ON CONFLICT (short_code) DO NOTHING`
+	case domain.ConflictOverwrite:
+		conflictClause = `
+			ON CONFLICT (short_code) DO UPDATE SET
+				original_url = EXCLUDED.original_url,
+				created_at = EXCLUDED.created_at,
+				updated_at = EXCLUDED.updated_at,
+				expires_at = EXCLUDED.expires_at,
+				click_count = EXCLUDED.click_count,
+				metadata = EXCLUDED.metadata,
+				redirect_type = EXCLUDED.redirect_type,
+				status = EXCLUDED.status`
+	default:
+		return nil, domain.ErrInvalidPolicy
+	}
+
+	// xmax is zero for freshly inserted rows and non-zero for updated ones.
 	query := `
-		UPDATE urls
-		SET click_count = click_count + 1
-		WHERE short_code = $1
+		INSERT INTO urls (short_code, original_url, created_at, updated_at, expires_at, click_count, metadata, redirect_type, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, COALESCE(NULLIF($9, ''), 'active'))
+		` + conflictClause + `
+		RETURNING (xmax = 0)
 	`
 
-	_, err := r.pool.Exec(ctx, query, shortCode)
-	return err
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	result := &domain.ImportResult{}
+	done := false
+
+	for !done {
+		batch := &pgx.Batch{}
+		var urls []*domain.URL
+
+		for len(urls) < importBatchSize {
+			url, err := next()
+			if errors.Is(err, io.EOF) {
+				done = true
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			var metadataJSON []byte
+			if url.Metadata != nil {
+				if metadataJSON, err = json.Marshal(url.Metadata); err != nil {
+					return nil, err
+				}
+			}
+
+			batch.Queue(query, url.ShortCode, url.OriginalURL, url.CreatedAt, url.UpdatedAt, url.ExpiresAt, url.ClickCount, metadataJSON, url.RedirectType, string(url.Status))
+			urls = append(urls, url)
+		}
+
+		if len(urls) == 0 {
+			break
+		}
+
+		results := tx.SendBatch(ctx, batch)
+		for _, url := range urls {
+			var inserted bool
+			err := results.QueryRow().Scan(&inserted)
+
+			switch {
+			case errors.Is(err, pgx.ErrNoRows) && policy == domain.ConflictFail:
+				results.Close()
+
+				return nil, fmt.Errorf("%w: %s", domain.ErrShortCodeExists, url.ShortCode)
+			case errors.Is(err, pgx.ErrNoRows):
+				result.Skipped++
+			case err != nil:
+				results.Close()
+
+				return nil, err
+			case inserted:
+				result.Created++
+				result.CreatedCodes = append(result.CreatedCodes, url.ShortCode)
+			default:
+				result.Updated++
+				result.UpdatedCodes = append(result.UpdatedCodes, url.ShortCode)
+			}
+		}
+
+		if err := results.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+type listCursor struct {
+	Sort       string    `json:"s"`
+	Descending bool      `json:"d,omitempty"`
+	CreatedAt  time.Time `json:"c,omitempty"`
+	ClickCount int64     `json:"n,omitempty"`
+	ID         int64     `json:"i"`
+}
+
+func encodeListCursor(cursor listCursor) string {
+	data, _ := json.Marshal(cursor)
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeListCursor(value string) (listCursor, error) {
+	var cursor listCursor
+
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, err
+	}
+
+	err = json.Unmarshal(data, &cursor)
+
+	return cursor, err
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
+
+func scanURL(row pgx.Row) (*domain.URL, error) {
+	url := &domain.URL{}
+	var metadataJSON []byte
+	var status string
+
+	err := row.Scan(
+		&url.ID,
+		&url.ShortCode,
+		&url.OriginalURL,
+		&url.CreatedAt,
+		&url.UpdatedAt,
+		&url.ExpiresAt,
+		&url.ClickCount,
+		&metadataJSON,
+		&url.RedirectType,
+		&status,
+	)
+	if err != nil {
+		return nil, err
+	}
+	url.Status = domain.LinkStatus(status)
+
+	if metadataJSON != nil {
+		if err := json.Unmarshal(metadataJSON, &url.Metadata); err != nil {
+			return nil, err
+		}
+	}
+
+	return url, nil
 }
@@ -0,0 +1,50 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadataCondition(t *testing.T) {
+	empty, campaign := "", "summer"
+
+	tests := []struct {
+		name      string
+		value     *string
+		condition string
+		args      []interface{}
+	}{
+		{name: "key only", value: nil, condition: "metadata ? $1", args: []interface{}{"campaign"}},
+		{name: "key and value", value: &campaign, condition: "metadata ->> $1 = $2", args: []interface{}{"campaign", "summer"}},
+		{name: "empty value", value: &empty, condition: "metadata ->> $1 = $2", args: []interface{}{"campaign", ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var args []interface{}
+			addArg := func(value interface{}) string {
+				args = append(args, value)
+
+				return fmt.Sprintf("$%d", len(args))
+			}
+
+			assert.Equal(t, tt.condition, metadataCondition("campaign", tt.value, addArg))
+			assert.Equal(t, tt.args, args)
+		})
+	}
+}
+
+func TestList_RejectsCursorOfAnotherOrder(t *testing.T) {
+	repo := &PostgresURLRepository{}
+	cursor := encodeListCursor(listCursor{Sort: "created_at", Descending: true, ID: 42})
+
+	_, err := repo.List(context.Background(), domain.URLFilter{Limit: 10, Cursor: cursor})
+	assert.ErrorIs(t, err, domain.ErrInvalidCursor)
+
+	_, err = repo.List(context.Background(), domain.URLFilter{Limit: 10, SortBy: domain.SortByClickCount, Descending: true, Cursor: cursor})
+	assert.ErrorIs(t, err, domain.ErrInvalidCursor)
+}
@@ -0,0 +1,92 @@
+package repository
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Pub/sub channels API instances use to keep their in-process state in sync.
+const (
+	CacheInvalidationChannel = "url-shortener:cache-invalidation"
+	CodeFilterAddChannel     = "url-shortener:code-filter:add"
+	CodeFilterRemoveChannel  = "url-shortener:code-filter:remove"
+)
+
+// RedisBroadcaster fans keys out to every instance subscribed to the same
+// channel. Messages are fire-and-forget, so receivers must tolerate missing
+// one now and then.
+type RedisBroadcaster struct {
+	client     redis.UniversalClient
+	channel    string
+	instanceID string
+}
+
+type broadcastMessage struct {
+	Origin string   `json:"origin"`
+	Keys   []string `json:"keys"`
+}
+
+func NewRedisBroadcaster(client redis.UniversalClient, channel string) *RedisBroadcaster {
+	return &RedisBroadcaster{
+		client:     client,
+		channel:    channel,
+		instanceID: newRandomID(),
+	}
+}
+
+func (b *RedisBroadcaster) Publish(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(broadcastMessage{Origin: b.instanceID, Keys: keys})
+	if err != nil {
+		return err
+	}
+
+	return b.client.Publish(ctx, b.channel, payload).Err()
+}
+
+// Listen calls fn with the keys published by other instances until ctx is
+// done. It returns once the subscription fails or ctx is cancelled.
+func (b *RedisBroadcaster) Listen(ctx context.Context, fn func(keys []string)) error {
+	pubsub := b.client.Subscribe(ctx, b.channel)
+	defer pubsub.Close()
+
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return err
+	}
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-messages:
+			if !ok {
+				return nil
+			}
+
+			var message broadcastMessage
+			if err := json.Unmarshal([]byte(msg.Payload), &message); err != nil {
+				continue
+			}
+			if message.Origin == b.instanceID {
+				continue
+			}
+
+			fn(message.Keys)
+		}
+	}
+}
+
+func newRandomID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
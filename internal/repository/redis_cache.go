@@ -4,15 +4,34 @@ import (
 	"context"
 	"time"
 
+	"github.com/bajdzun/go-url-shortener/internal/domain"
 	"github.com/go-redis/redis/v8"
 )
 
+// setNewer stores ARGV[1] unless the key holds a JSON object with a greater
+// "v" field than ARGV[2]. ARGV[3] is the TTL in milliseconds, 0 for none.
+var setNewer = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current then
+	local ok, decoded = pcall(cjson.decode, current)
+	if ok and type(decoded) == 'table' and tonumber(decoded.v) and tonumber(decoded.v) > tonumber(ARGV[2]) then
+		return 0
+	end
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[3])
+else
+	redis.call('SET', KEYS[1], ARGV[1])
+end
+return 1
+`)
+
 type RedisCache struct {
-	client *redis.Client
+	client redis.UniversalClient
 	ttl    time.Duration
 }
 
-func NewRedisCache(client *redis.Client, ttl time.Duration) *RedisCache {
+func NewRedisCache(client redis.UniversalClient, ttl time.Duration) *RedisCache {
 	return &RedisCache{
 		client: client,
 		ttl:    ttl,
@@ -23,8 +42,53 @@ func (r *RedisCache) Set(ctx context.Context, key string, value interface{}) err
 	return r.client.Set(ctx, key, value, r.ttl).Err()
 }
 
+func (r *RedisCache) SetWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	return r.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (r *RedisCache) SetMany(ctx context.Context, entries []domain.CacheEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	pipe := r.client.Pipeline()
+	for _, entry := range entries {
+		ttl := entry.TTL
+		if ttl == 0 {
+			ttl = r.ttl
+		}
+		pipe.Set(ctx, entry.Key, entry.Value, ttl)
+	}
+
+	_, err := pipe.Exec(ctx)
+
+	return err
+}
+
+func (r *RedisCache) SetNewer(ctx context.Context, key, value string, version int64, ttl time.Duration) error {
+	if ttl == 0 {
+		ttl = r.ttl
+	}
+
+	return setNewer.Run(ctx, r.client, []string{key}, value, version, ttl.Milliseconds()).Err()
+}
+
 func (r *RedisCache) Get(ctx context.Context, key string) (string, error) {
-	return r.client.Get(ctx, key).Result()
+	value, err := r.client.Get(ctx, key).Result()
+	switch {
+	case err == redis.Nil:
+		cacheRequestsTotal.WithLabelValues("redis", "miss").Inc()
+
+		return "", domain.ErrCacheMiss
+	case err != nil:
+		cacheRequestsTotal.WithLabelValues("redis", "error").Inc()
+
+		return "", err
+	}
+
+	cacheRequestsTotal.WithLabelValues("redis", "hit").Inc()
+
+	return value, nil
 }
 
 func (r *RedisCache) Delete(ctx context.Context, key string) error {
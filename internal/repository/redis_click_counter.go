@@ -0,0 +1,208 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/bajdzun/go-url-shortener/internal/cachekey"
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+const defaultClickFlushInterval = 10 * time.Second
+
+// The counter keys share the {clicks} hash tag, so the scripts touching
+// several of them also run on Redis Cluster.
+const (
+	clicksPendingKey  = "{clicks}:pending"
+	clicksInflightKey = "{clicks}:inflight"
+	clicksFlushIDKey  = "{clicks}:flush-id"
+)
+
+// claimFlush moves the pending counts aside under a new flush ID, unless an
+// earlier flush never finished, in which case that one is returned to be
+// retried with its original ID.
+var claimFlush = redis.NewScript(`
+local id = redis.call('GET', KEYS[3])
+if id then
+	return id
+end
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return false
+end
+redis.call('RENAME', KEYS[1], KEYS[2])
+redis.call('SET', KEYS[3], ARGV[1])
+return ARGV[1]
+`)
+
+// finishFlush drops the flushed counts, unless another instance already did
+// and a new flush has been claimed since.
+var finishFlush = redis.NewScript(`
+if redis.call('GET', KEYS[2]) == ARGV[1] then
+	redis.call('DEL', KEYS[1], KEYS[2])
+end
+return 1
+`)
+
+// RedisClickCounter counts clicks in a Redis hash and periodically moves the
+// counts to Postgres, so busy links do not turn their row into a hotspot.
+//
+// A flush renames the pending hash and tags it with a flush ID before
+// applying it, and Postgres remembers applied IDs. A flush interrupted at any
+// point is retried with the same ID by the next one, on any instance, so
+// clicks are neither lost nor counted twice.
+type RedisClickCounter struct {
+	client   redis.UniversalClient
+	urls     domain.URLRepository
+	interval time.Duration
+	logger   *zap.Logger
+
+	pendingKey  string
+	inflightKey string
+	flushIDKey  string
+}
+
+func NewRedisClickCounter(client redis.UniversalClient, keys *cachekey.Builder, urls domain.URLRepository, interval time.Duration, logger *zap.Logger) *RedisClickCounter {
+	if interval <= 0 {
+		interval = defaultClickFlushInterval
+	}
+
+	return &RedisClickCounter{
+		client:      client,
+		urls:        urls,
+		interval:    interval,
+		logger:      logger,
+		pendingKey:  keys.Counter(clicksPendingKey),
+		inflightKey: keys.Counter(clicksInflightKey),
+		flushIDKey:  keys.Counter(clicksFlushIDKey),
+	}
+}
+
+// Add counts the clicks in Redis. When Redis cannot be reached they are
+// written to Postgres directly instead. Any other failure is returned, as the
+// counts may have reached Redis before it, and writing them to Postgres too
+// would count them twice.
+func (c *RedisClickCounter) Add(ctx context.Context, deltas map[string]int64) error {
+	if len(deltas) == 0 {
+		return nil
+	}
+
+	pipe := c.client.Pipeline()
+	for code, delta := range deltas {
+		pipe.HIncrBy(ctx, c.pendingKey, code, delta)
+	}
+
+	_, err := pipe.Exec(ctx)
+	if err != nil && notSent(err) {
+		c.logger.Warn("failed to reach Redis to count clicks, writing them to the database", zap.Error(err))
+
+		return c.urls.IncrementClickCounts(ctx, deltas)
+	}
+
+	return err
+}
+
+// notSent reports whether err shows that the commands never left for Redis.
+func notSent(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	return errors.Is(err, redis.ErrClosed)
+}
+
+func (c *RedisClickCounter) Pending(ctx context.Context, shortCode string) (int64, error) {
+	pipe := c.client.Pipeline()
+	pending := pipe.HGet(ctx, c.pendingKey, shortCode)
+	inflight := pipe.HGet(ctx, c.inflightKey, shortCode)
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return 0, err
+	}
+
+	var total int64
+	for _, cmd := range []*redis.StringCmd{pending, inflight} {
+		if count, err := cmd.Int64(); err == nil {
+			total += count
+		}
+	}
+
+	return total, nil
+}
+
+// Run flushes the counts every interval until ctx is done.
+func (c *RedisClickCounter) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := c.Flush(ctx); err != nil && ctx.Err() == nil {
+				c.logger.Error("failed to flush click counts", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Flush moves the pending counts to Postgres.
+func (c *RedisClickCounter) Flush(ctx context.Context) error {
+	keys := []string{c.pendingKey, c.inflightKey, c.flushIDKey}
+
+	flushID, err := claimFlush.Run(ctx, c.client, keys, newRandomID()).Text()
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	counts, err := c.client.HGetAll(ctx, c.inflightKey).Result()
+	if err != nil {
+		return err
+	}
+
+	deltas := make(map[string]int64, len(counts))
+	for code, value := range counts {
+		delta, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.logger.Warn("skipping malformed click count", zap.String("short_code", code), zap.String("value", value))
+			continue
+		}
+		deltas[code] = delta
+	}
+
+	applied, err := c.urls.ApplyClickCounts(ctx, flushID, deltas)
+	if err != nil {
+		return err
+	}
+	if !applied {
+		c.logger.Info("click count flush was already applied", zap.String("flush_id", flushID))
+	}
+
+	return finishFlush.Run(ctx, c.client, []string{c.inflightKey, c.flushIDKey}, flushID).Err()
+}
+
+// DirectClickCounter writes click counts straight to Postgres. It is used
+// when there is no Redis to buffer them in.
+type DirectClickCounter struct {
+	urls domain.URLRepository
+}
+
+func NewDirectClickCounter(urls domain.URLRepository) *DirectClickCounter {
+	return &DirectClickCounter{urls: urls}
+}
+
+func (c *DirectClickCounter) Add(ctx context.Context, deltas map[string]int64) error {
+	return c.urls.IncrementClickCounts(ctx, deltas)
+}
+
+func (c *DirectClickCounter) Pending(ctx context.Context, shortCode string) (int64, error) {
+	return 0, nil
+}
@@ -0,0 +1,70 @@
+package repository
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/bajdzun/go-url-shortener/internal/cachekey"
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// countingURLs records the click counts written to it.
+type countingURLs struct {
+	domain.URLRepository
+	increments []map[string]int64
+}
+
+func (r *countingURLs) IncrementClickCounts(ctx context.Context, deltas map[string]int64) error {
+	r.increments = append(r.increments, deltas)
+
+	return nil
+}
+
+func newTestClickCounter(t *testing.T, addr string, urls domain.URLRepository) *RedisClickCounter {
+	client := redis.NewClient(&redis.Options{Addr: addr, MaxRetries: -1})
+	t.Cleanup(func() { client.Close() })
+
+	return NewRedisClickCounter(client, cachekey.New(""), urls, 0, zap.NewNop())
+}
+
+func TestRedisClickCounter_AddFallsBackWhenRedisUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+
+	urls := &countingURLs{}
+	counter := newTestClickCounter(t, addr, urls)
+
+	require.NoError(t, counter.Add(context.Background(), map[string]int64{"abc123": 2}))
+	assert.Equal(t, []map[string]int64{{"abc123": 2}}, urls.increments)
+}
+
+func TestRedisClickCounter_AddDoesNotFallBackOnceSent(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// Read the commands, then drop the connection without answering.
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Read(make([]byte, 1024))
+			conn.Close()
+		}
+	}()
+
+	urls := &countingURLs{}
+	counter := newTestClickCounter(t, listener.Addr().String(), urls)
+
+	assert.Error(t, counter.Add(context.Background(), map[string]int64{"abc123": 2}))
+	assert.Empty(t, urls.increments)
+}
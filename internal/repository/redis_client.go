@@ -0,0 +1,130 @@
+package repository
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	RedisModeStandalone = "standalone"
+	RedisModeSentinel   = "sentinel"
+	RedisModeCluster    = "cluster"
+)
+
+type RedisClientOptions struct {
+	// Mode is standalone, sentinel or cluster; empty means standalone.
+	Mode string
+	// Addrs are the server address in standalone mode, the sentinels in
+	// sentinel mode and the seed nodes in cluster mode.
+	Addrs      []string
+	MasterName string
+	// Username and Password authenticate against Redis; with an empty
+	// Username the password is sent without ACLs.
+	Username         string
+	Password         string
+	SentinelPassword string
+	DB               int
+	TLS              bool
+	// TLSCAFile verifies servers against a private CA instead of the system
+	// roots.
+	TLSCAFile string
+	// ReadFromReplica sends reads to replicas as well. Reads may then return
+	// values a moment older than the latest write.
+	ReadFromReplica bool
+}
+
+// NewRedisClient builds a client for the configured topology. Everything
+// built on top of it only uses commands that work the same on all of them.
+func NewRedisClient(opts RedisClientOptions) (redis.UniversalClient, error) {
+	if len(opts.Addrs) == 0 {
+		return nil, errors.New("no Redis address configured")
+	}
+
+	var tlsConfig *tls.Config
+	if opts.TLS {
+		var err error
+		if tlsConfig, err = newRedisTLSConfig(opts.TLSCAFile); err != nil {
+			return nil, err
+		}
+	}
+
+	switch opts.Mode {
+	case RedisModeStandalone, "":
+		if len(opts.Addrs) > 1 {
+			return nil, errors.New("standalone Redis takes a single address")
+		}
+		if opts.ReadFromReplica {
+			return nil, errors.New("reading from replicas needs sentinel or cluster mode")
+		}
+
+		return redis.NewClient(&redis.Options{
+			Addr:      opts.Addrs[0],
+			Username:  opts.Username,
+			Password:  opts.Password,
+			DB:        opts.DB,
+			TLSConfig: tlsConfig,
+		}), nil
+	case RedisModeSentinel:
+		if opts.MasterName == "" {
+			return nil, errors.New("sentinel mode needs a master name")
+		}
+
+		failoverOpts := &redis.FailoverOptions{
+			MasterName:       opts.MasterName,
+			SentinelAddrs:    opts.Addrs,
+			SentinelPassword: opts.SentinelPassword,
+			Username:         opts.Username,
+			Password:         opts.Password,
+			DB:               opts.DB,
+			TLSConfig:        tlsConfig,
+		}
+		if opts.ReadFromReplica {
+			// Only the cluster flavour of the failover client spreads reads
+			// over the master and its replicas.
+			failoverOpts.RouteRandomly = true
+
+			return redis.NewFailoverClusterClient(failoverOpts), nil
+		}
+
+		return redis.NewFailoverClient(failoverOpts), nil
+	case RedisModeCluster:
+		if opts.DB != 0 {
+			return nil, errors.New("cluster mode only supports database 0")
+		}
+
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     opts.Addrs,
+			Username:  opts.Username,
+			Password:  opts.Password,
+			ReadOnly:  opts.ReadFromReplica,
+			TLSConfig: tlsConfig,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown Redis mode %q", opts.Mode)
+	}
+}
+
+func newRedisTLSConfig(caFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read Redis CA file: %w", err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	tlsConfig.RootCAs = roots
+
+	return tlsConfig, nil
+}
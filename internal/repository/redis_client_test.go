@@ -0,0 +1,54 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRedisClient_Topologies(t *testing.T) {
+	tests := []struct {
+		name string
+		opts RedisClientOptions
+		want redis.UniversalClient
+	}{
+		{"standalone", RedisClientOptions{Addrs: []string{"localhost:6379"}}, &redis.Client{}},
+		{"sentinel", RedisClientOptions{Mode: RedisModeSentinel, Addrs: []string{"a:26379", "b:26379"}, MasterName: "mymaster"}, &redis.Client{}},
+		{"sentinel replicas", RedisClientOptions{Mode: RedisModeSentinel, Addrs: []string{"a:26379"}, MasterName: "mymaster", ReadFromReplica: true}, &redis.ClusterClient{}},
+		{"cluster", RedisClientOptions{Mode: RedisModeCluster, Addrs: []string{"a:6379"}, ReadFromReplica: true}, &redis.ClusterClient{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := NewRedisClient(tt.opts)
+			require.NoError(t, err)
+			defer client.Close()
+
+			assert.IsType(t, tt.want, client)
+		})
+	}
+}
+
+func TestNewRedisClient_InvalidOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts RedisClientOptions
+	}{
+		{"no address", RedisClientOptions{}},
+		{"standalone with several addresses", RedisClientOptions{Addrs: []string{"a:6379", "b:6379"}}},
+		{"standalone from replica", RedisClientOptions{Addrs: []string{"a:6379"}, ReadFromReplica: true}},
+		{"sentinel without master", RedisClientOptions{Mode: RedisModeSentinel, Addrs: []string{"a:26379"}}},
+		{"cluster with database", RedisClientOptions{Mode: RedisModeCluster, Addrs: []string{"a:6379"}, DB: 1}},
+		{"unknown mode", RedisClientOptions{Mode: "ring", Addrs: []string{"a:6379"}}},
+		{"missing CA file", RedisClientOptions{Addrs: []string{"a:6379"}, TLS: true, TLSCAFile: "/nonexistent/ca.pem"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRedisClient(tt.opts)
+			assert.Error(t, err)
+		})
+	}
+}
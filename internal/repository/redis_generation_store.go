@@ -0,0 +1,35 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisGenerationStore keeps the cache generation in a Redis counter, so a
+// flush on one instance reaches the others the next time they poll it.
+type RedisGenerationStore struct {
+	client redis.UniversalClient
+	key    string
+}
+
+func NewRedisGenerationStore(client redis.UniversalClient, key string) *RedisGenerationStore {
+	return &RedisGenerationStore{
+		client: client,
+		key:    key,
+	}
+}
+
+func (s *RedisGenerationStore) Current(ctx context.Context) (int64, error) {
+	generation, err := s.client.Get(ctx, s.key).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+
+	return generation, err
+}
+
+func (s *RedisGenerationStore) Bump(ctx context.Context) (int64, error) {
+	return s.client.Incr(ctx, s.key).Result()
+}
@@ -0,0 +1,235 @@
+package repository
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/bajdzun/go-url-shortener/internal/cachekey"
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultVisitorFlushInterval = time.Minute
+	visitorDayLayout            = "2006-01-02"
+
+	// Sketches stay in Redis for a while after their day, so that late
+	// clicks still land in them.
+	visitorSketchTTL = 8 * 24 * time.Hour
+	// A salt outlives its day only long enough for clicks still queued at
+	// midnight, after which the fingerprints made with it cannot be
+	// reproduced.
+	visitorSaltTTL   = 48 * time.Hour
+	visitorSaltBytes = 32
+	// Salts are remembered for today and yesterday, the days clicks around
+	// midnight alternate between.
+	visitorSaltDays = 2
+
+	visitorFlushBatch = 100
+)
+
+// RedisVisitorCounter counts unique visitors in one Redis HyperLogLog per
+// link and UTC day, and periodically saves the sketches to the database,
+// merged with what was saved before, so the counts survive Redis evicting
+// or losing them.
+//
+// Visitors are fingerprinted with an HMAC of their IP address and user
+// agent, keyed with a random salt shared by all instances through Redis and
+// replaced every day. Neither is stored, and once the salt expires a
+// fingerprint can no longer be linked to a visitor.
+type RedisVisitorCounter struct {
+	client   redis.UniversalClient
+	keys     *cachekey.Builder
+	sketches domain.VisitorSketchStore
+	interval time.Duration
+	logger   *zap.Logger
+	dirtyKey string
+
+	mu    sync.Mutex
+	salts map[string][]byte
+}
+
+func NewRedisVisitorCounter(client redis.UniversalClient, keys *cachekey.Builder, sketches domain.VisitorSketchStore, interval time.Duration, logger *zap.Logger) *RedisVisitorCounter {
+	if interval <= 0 {
+		interval = defaultVisitorFlushInterval
+	}
+
+	return &RedisVisitorCounter{
+		client:   client,
+		keys:     keys,
+		sketches: sketches,
+		interval: interval,
+		logger:   logger,
+		dirtyKey: keys.Counter("visitors:dirty"),
+		salts:    make(map[string][]byte),
+	}
+}
+
+func (c *RedisVisitorCounter) Add(ctx context.Context, clicks []*domain.Analytics) error {
+	fingerprints := make(map[string][]interface{})
+	for _, click := range clicks {
+		day := click.ClickedAt.UTC().Format(visitorDayLayout)
+
+		salt, err := c.daySalt(ctx, day)
+		if err != nil {
+			return err
+		}
+
+		mac := hmac.New(sha256.New, salt)
+		mac.Write([]byte(click.IPAddress))
+		mac.Write([]byte{0})
+		mac.Write([]byte(click.UserAgent))
+
+		// Days have a fixed length, so the member can be split again.
+		member := day + click.ShortCode
+		fingerprints[member] = append(fingerprints[member], hex.EncodeToString(mac.Sum(nil)[:16]))
+	}
+
+	pipe := c.client.Pipeline()
+	for member, values := range fingerprints {
+		key := c.sketchKey(member[len(visitorDayLayout):], member[:len(visitorDayLayout)])
+		pipe.PFAdd(ctx, key, values...)
+		pipe.Expire(ctx, key, visitorSketchTTL)
+		pipe.SAdd(ctx, c.dirtyKey, member)
+	}
+	_, err := pipe.Exec(ctx)
+
+	return err
+}
+
+// daySalt returns the salt of day, creating it if this instance is the
+// first to need it.
+func (c *RedisVisitorCounter) daySalt(ctx context.Context, day string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if salt, ok := c.salts[day]; ok {
+		return salt, nil
+	}
+
+	salt := make([]byte, visitorSaltBytes)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	key := c.keys.Counter("visitors:salt:" + day)
+	if err := c.client.SetNX(ctx, key, salt, visitorSaltTTL).Err(); err != nil {
+		return nil, err
+	}
+	stored, err := c.client.Get(ctx, key).Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	c.salts[day] = stored
+	if len(c.salts) > visitorSaltDays {
+		oldest := day
+		for saltDay := range c.salts {
+			if saltDay < oldest {
+				oldest = saltDay
+			}
+		}
+		delete(c.salts, oldest)
+	}
+
+	return stored, nil
+}
+
+// Run saves the sketches every interval until ctx is done.
+func (c *RedisVisitorCounter) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := c.Flush(ctx); err != nil && ctx.Err() == nil {
+				c.logger.Error("failed to save unique visitors", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Flush saves the sketches that changed since the last flush.
+func (c *RedisVisitorCounter) Flush(ctx context.Context) error {
+	for {
+		members, err := c.client.SPopN(ctx, c.dirtyKey, visitorFlushBatch).Result()
+		if err != nil {
+			return err
+		}
+		if len(members) == 0 {
+			return nil
+		}
+
+		for i, member := range members {
+			if len(member) <= len(visitorDayLayout) {
+				continue
+			}
+			if err := c.save(ctx, member[len(visitorDayLayout):], member[:len(visitorDayLayout)]); err != nil {
+				// Put back what was not saved, for the next flush.
+				unsaved := make([]interface{}, 0, len(members)-i)
+				for _, m := range members[i:] {
+					unsaved = append(unsaved, m)
+				}
+				c.client.SAdd(ctx, c.dirtyKey, unsaved...)
+
+				return err
+			}
+		}
+	}
+}
+
+// save merges the saved sketch into the live one, which holds everything
+// since unless Redis lost it, and saves the result.
+func (c *RedisVisitorCounter) save(ctx context.Context, shortCode, day string) error {
+	date, err := time.Parse(visitorDayLayout, day)
+	if err != nil {
+		return err
+	}
+
+	key := c.sketchKey(shortCode, day)
+	saved, err := c.sketches.LoadVisitorSketch(ctx, shortCode, date)
+	if err != nil {
+		return err
+	}
+	if saved != nil {
+		// The scratch key shares the hash tag of the live one, as PFMERGE
+		// needs both on the same Redis Cluster node.
+		scratch := key + ":saved"
+		pipe := c.client.TxPipeline()
+		pipe.Set(ctx, scratch, saved, time.Minute)
+		pipe.PFMerge(ctx, key, key, scratch)
+		pipe.Del(ctx, scratch)
+		pipe.Expire(ctx, key, visitorSketchTTL)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+	}
+
+	sketch, err := c.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	visitors, err := c.client.PFCount(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+
+	return c.sketches.SaveVisitorSketch(ctx, shortCode, date, sketch, visitors)
+}
+
+func (c *RedisVisitorCounter) sketchKey(shortCode, day string) string {
+	return c.keys.Counter("visitors:{" + shortCode + "}:" + day)
+}
@@ -0,0 +1,81 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"go.uber.org/zap"
+)
+
+const publishTimeout = time.Second
+
+// SyncedCodeFilter keeps the code filters of all instances in step by
+// broadcasting local adds and removes. A missed add would make another
+// instance reject a live code, so filters should also be rebuilt
+// periodically.
+type SyncedCodeFilter struct {
+	filter  domain.CodeFilter
+	adds    *RedisBroadcaster
+	removes *RedisBroadcaster
+	logger  *zap.Logger
+}
+
+func NewSyncedCodeFilter(filter domain.CodeFilter, adds, removes *RedisBroadcaster, logger *zap.Logger) *SyncedCodeFilter {
+	return &SyncedCodeFilter{
+		filter:  filter,
+		adds:    adds,
+		removes: removes,
+		logger:  logger,
+	}
+}
+
+// Run applies adds and removes published by other instances until ctx is
+// done.
+func (f *SyncedCodeFilter) Run(ctx context.Context) error {
+	errs := make(chan error, 2)
+
+	go func() {
+		errs <- f.adds.Listen(ctx, func(codes []string) {
+			for _, code := range codes {
+				f.filter.Add(code)
+			}
+		})
+	}()
+	go func() {
+		errs <- f.removes.Listen(ctx, func(codes []string) {
+			for _, code := range codes {
+				f.filter.Remove(code)
+			}
+		})
+	}()
+
+	return <-errs
+}
+
+func (f *SyncedCodeFilter) Add(shortCode string) {
+	f.filter.Add(shortCode)
+	f.publish(f.adds, shortCode)
+}
+
+func (f *SyncedCodeFilter) Remove(shortCode string) {
+	f.filter.Remove(shortCode)
+	f.publish(f.removes, shortCode)
+}
+
+func (f *SyncedCodeFilter) MayContain(shortCode string) bool {
+	return f.filter.MayContain(shortCode)
+}
+
+func (f *SyncedCodeFilter) Ready() bool {
+	return f.filter.Ready()
+}
+
+func (f *SyncedCodeFilter) publish(broadcaster *RedisBroadcaster, shortCode string) {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	if err := broadcaster.Publish(ctx, shortCode); err != nil {
+		f.logger.Warn("failed to broadcast code filter change", zap.String("short_code", shortCode), zap.Error(err))
+	}
+}
@@ -0,0 +1,136 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"go.uber.org/zap"
+)
+
+// TieredCache serves reads from an in-process LRU and falls back to the
+// shared cache behind it. Deletes are broadcast so every instance drops its
+// local copy, while writes only reach the local tier of the writer; other
+// instances pick the new value up from the shared cache on their next miss.
+type TieredCache struct {
+	local       *MemoryCache
+	remote      domain.CacheRepository
+	invalidator *RedisBroadcaster
+	logger      *zap.Logger
+}
+
+// NewTieredCache wraps remote with local. local may be nil, in which case the
+// cache only forwards to remote and broadcasts deletes for other instances.
+func NewTieredCache(local *MemoryCache, remote domain.CacheRepository, invalidator *RedisBroadcaster, logger *zap.Logger) *TieredCache {
+	return &TieredCache{
+		local:       local,
+		remote:      remote,
+		invalidator: invalidator,
+		logger:      logger,
+	}
+}
+
+// Run applies invalidations published by other instances until ctx is done.
+func (c *TieredCache) Run(ctx context.Context) error {
+	if c.local == nil {
+		<-ctx.Done()
+
+		return nil
+	}
+
+	return c.invalidator.Listen(ctx, func(keys []string) {
+		for _, key := range keys {
+			c.local.Delete(ctx, key)
+		}
+	})
+}
+
+func (c *TieredCache) Set(ctx context.Context, key string, value interface{}) error {
+	if err := c.remote.Set(ctx, key, value); err != nil {
+		return err
+	}
+	if c.local != nil {
+		c.local.Set(ctx, key, value)
+	}
+
+	return nil
+}
+
+func (c *TieredCache) SetWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	if err := c.remote.SetWithTTL(ctx, key, value, ttl); err != nil {
+		return err
+	}
+	if c.local != nil {
+		c.local.SetWithTTL(ctx, key, value, ttl)
+	}
+
+	return nil
+}
+
+func (c *TieredCache) SetMany(ctx context.Context, entries []domain.CacheEntry) error {
+	if err := c.remote.SetMany(ctx, entries); err != nil {
+		return err
+	}
+	if c.local != nil {
+		c.local.SetMany(ctx, entries)
+	}
+
+	return nil
+}
+
+func (c *TieredCache) SetNewer(ctx context.Context, key, value string, version int64, ttl time.Duration) error {
+	if err := c.remote.SetNewer(ctx, key, value, version, ttl); err != nil {
+		return err
+	}
+	if c.local != nil {
+		c.local.SetNewer(ctx, key, value, version, ttl)
+	}
+
+	return nil
+}
+
+func (c *TieredCache) Get(ctx context.Context, key string) (string, error) {
+	if c.local != nil {
+		if value, err := c.local.Get(ctx, key); err == nil {
+			return value, nil
+		}
+	}
+
+	value, err := c.remote.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	if c.local != nil {
+		c.local.Set(ctx, key, value)
+	}
+
+	return value, nil
+}
+
+// Delete broadcasts the invalidation even when the shared entry could not be
+// deleted, so other instances still drop their local copies. A lost
+// broadcast only leaves them stale for their local TTL.
+func (c *TieredCache) Delete(ctx context.Context, key string) error {
+	if c.local != nil {
+		c.local.Delete(ctx, key)
+	}
+
+	err := c.remote.Delete(ctx, key)
+
+	if err := c.invalidator.Publish(ctx, key); err != nil {
+		c.logger.Warn("failed to broadcast cache invalidation", zap.String("key", key), zap.Error(err))
+	}
+
+	return err
+}
+
+func (c *TieredCache) Exists(ctx context.Context, key string) (bool, error) {
+	if c.local != nil {
+		if exists, _ := c.local.Exists(ctx, key); exists {
+			return true, nil
+		}
+	}
+
+	return c.remote.Exists(ctx, key)
+}
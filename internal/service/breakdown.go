@@ -0,0 +1,92 @@
+package service
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/bajdzun/go-url-shortener/internal/analytics"
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultBreakdownLimit  = 10
+	maxBreakdownLimit      = 100
+	defaultBreakdownPeriod = 30 * 24 * time.Hour
+)
+
+type BreakdownRequest struct {
+	ShortCode string
+	Dimension domain.BreakdownDimension
+	// From and To default to the last 30 days.
+	From        *time.Time
+	To          *time.Time
+	Limit       int
+	IncludeBots bool
+}
+
+// GetBreakdown returns the most common referrers, browsers, operating
+// systems, device classes or countries among the clicks of a link.
+func (s *URLService) GetBreakdown(ctx context.Context, req BreakdownRequest) (*domain.Breakdown, error) {
+	switch req.Dimension {
+	case domain.DimensionReferrer, domain.DimensionBrowser, domain.DimensionOS, domain.DimensionDevice, domain.DimensionCountry:
+	default:
+		return nil, domain.ErrInvalidDimension
+	}
+
+	to := time.Now()
+	if req.To != nil {
+		to = *req.To
+	}
+	from := to.Add(-defaultBreakdownPeriod)
+	if req.From != nil {
+		from = *req.From
+	}
+	if !from.Before(to) {
+		return nil, domain.ErrInvalidTimeRange
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultBreakdownLimit
+	} else if limit > maxBreakdownLimit {
+		limit = maxBreakdownLimit
+	}
+
+	items, total, err := s.analyticsRepo.GetBreakdown(ctx, domain.BreakdownQuery{
+		ShortCode:   req.ShortCode,
+		Dimension:   req.Dimension,
+		From:        from,
+		To:          to,
+		Limit:       limit,
+		IncludeBots: req.IncludeBots,
+	})
+	if err != nil {
+		if err != domain.ErrURLNotFound {
+			s.logger.Error("failed to get breakdown", zap.String("short_code", req.ShortCode), zap.Error(err))
+		}
+
+		return nil, err
+	}
+
+	for i := range items {
+		items[i].Percentage = math.Round(float64(items[i].Clicks)/float64(total)*10000) / 100
+	}
+
+	return &domain.Breakdown{
+		ShortCode: req.ShortCode,
+		Dimension: req.Dimension,
+		From:      from,
+		To:        to,
+		Total:     total,
+		Items:     items,
+	}, nil
+}
+
+// BackfillClickDetails enriches clicks recorded before browsers, devices and
+// referrers were derived at ingest, batchSize at a time. It returns how many
+// clicks were updated, and can be stopped and resumed at any point.
+func (s *URLService) BackfillClickDetails(ctx context.Context, batchSize int, progress func(updated int)) (int, error) {
+	return analytics.EnrichClicks(ctx, s.analyticsRepo, s.botClassifier, batchSize, progress)
+}
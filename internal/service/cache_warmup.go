@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultWarmupSize = 1000
+	warmupBatchSize   = 500
+)
+
+var (
+	cacheWarmupLinks = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cache_warmup_links_loaded",
+		Help: "Links cached so far by the current or last cache warm-up",
+	})
+	cacheWarmupDuration = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cache_warmup_duration_seconds",
+		Help: "Duration of the last completed cache warm-up",
+	})
+	cacheWarmupRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_warmup_runs_total",
+		Help: "Cache warm-ups by result",
+	}, []string{"result"})
+)
+
+type WarmupResult struct {
+	Loaded     int   `json:"loaded"`
+	DurationMs int64 `json:"duration_ms"`
+}
+
+// WarmCache loads the most clicked links into the cache, so the first
+// requests after a restart or flush do not all reach the database. A limit
+// of zero uses the configured warm-up size. Only one warm-up runs at a time.
+func (s *URLService) WarmCache(ctx context.Context, limit int) (*WarmupResult, error) {
+	if !s.warming.CompareAndSwap(false, true) {
+		return nil, domain.ErrWarmupInProgress
+	}
+	defer s.warming.Store(false)
+
+	if limit <= 0 {
+		limit = s.warmupSize
+	}
+
+	start := time.Now()
+	cacheWarmupLinks.Set(0)
+
+	result, err := s.warmCache(ctx, limit)
+	result.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		cacheWarmupRuns.WithLabelValues("error").Inc()
+		s.logger.Error("cache warm-up failed", zap.Int("loaded", result.Loaded), zap.Error(err))
+
+		return nil, err
+	}
+
+	cacheWarmupRuns.WithLabelValues("success").Inc()
+	cacheWarmupDuration.Set(time.Since(start).Seconds())
+	s.logger.Info("cache warm-up finished", zap.Int("loaded", result.Loaded), zap.Duration("duration", time.Since(start)))
+
+	return result, nil
+}
+
+func (s *URLService) warmCache(ctx context.Context, limit int) (*WarmupResult, error) {
+	result := &WarmupResult{}
+
+	var clickedSince *time.Time
+	if s.warmupWindow > 0 {
+		since := time.Now().Add(-s.warmupWindow)
+		clickedSince = &since
+	}
+
+	urls, err := s.urlRepo.TopURLs(ctx, limit, clickedSince)
+	if err != nil {
+		return result, err
+	}
+
+	s.logger.Info("cache warm-up started", zap.Int("links", len(urls)))
+
+	for start := 0; start < len(urls); start += warmupBatchSize {
+		end := start + warmupBatchSize
+		if end > len(urls) {
+			end = len(urls)
+		}
+
+		entries := make([]domain.CacheEntry, 0, end-start)
+		for _, urlEntity := range urls[start:end] {
+			link := newCachedLink(urlEntity)
+			if ttl, ok := s.linkCacheTTL(link); ok {
+				entries = append(entries, domain.CacheEntry{Key: s.cacheKeys.Link(urlEntity.ShortCode), Value: link.encode(), TTL: ttl})
+			}
+		}
+
+		if err := s.cacheRepo.SetMany(ctx, entries); err != nil {
+			return result, err
+		}
+
+		result.Loaded += len(entries)
+		cacheWarmupLinks.Set(float64(result.Loaded))
+		s.logger.Info("cache warm-up progress", zap.Int("loaded", result.Loaded), zap.Int("total", len(urls)))
+	}
+
+	return result, nil
+}
@@ -0,0 +1,60 @@
+package service
+
+import (
+	"context"
+	"strings"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"github.com/bajdzun/go-url-shortener/internal/privacy"
+	"go.uber.org/zap"
+)
+
+type EraseClicksRequest struct {
+	IP string `json:"ip"`
+	// VisitorHash is an IP address as stored in hash mode.
+	VisitorHash string `json:"visitor_hash"`
+	// Network is any IP address of a network whose clicks stored in
+	// truncate mode are all erased, whoever made them.
+	Network string `json:"network"`
+}
+
+// EraseClicks deletes the recorded clicks of a visitor, found by IP address
+// in full or hashed, or by its hash. Clicks stored truncated are only erased
+// for a whole network, when that is asked for explicitly. Clicks
+// still queued for writing are not affected, and neither are the rollups,
+// which hold nothing that identifies the visitor.
+func (s *URLService) EraseClicks(ctx context.Context, req EraseClicksRequest) (int64, error) {
+	var addresses []string
+	if req.IP != "" {
+		forms, ok := s.privacy.StoredIPs(req.IP)
+		if !ok {
+			return 0, domain.ErrInvalidErasure
+		}
+		addresses = append(addresses, forms...)
+	}
+	if hash := strings.ToLower(strings.TrimSpace(req.VisitorHash)); hash != "" {
+		addresses = append(addresses, hash)
+	}
+	if req.Network != "" {
+		network, ok := privacy.StoredNetwork(req.Network)
+		if !ok {
+			return 0, domain.ErrInvalidErasure
+		}
+		addresses = append(addresses, network)
+	}
+	if len(addresses) == 0 {
+		return 0, domain.ErrInvalidErasure
+	}
+
+	erased, err := s.analyticsRepo.EraseClicks(ctx, addresses)
+	if err != nil {
+		s.logger.Error("failed to erase clicks", zap.Error(err))
+
+		return 0, err
+	}
+
+	// The address itself is not logged, or erasing it would leave a trace.
+	s.logger.Info("erased clicks of a visitor", zap.Int64("clicks", erased))
+
+	return erased, nil
+}
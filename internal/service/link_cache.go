@@ -0,0 +1,174 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"go.uber.org/zap"
+)
+
+const (
+	refreshKeyPrefix = "refresh:"
+	refreshTimeout   = 5 * time.Second
+)
+
+// cachedLink is the record stored in the cache for a short code. It carries
+// everything a redirect needs so cache hits never have to touch Postgres.
+type cachedLink struct {
+	OriginalURL  string     `json:"u"`
+	RedirectType int        `json:"r,omitempty"`
+	ExpiresAt    *time.Time `json:"e,omitempty"`
+	Disabled     bool       `json:"d,omitempty"`
+	// Version is the link's update time in microseconds. A lookup that read
+	// the link before an update never replaces the record the update cached.
+	Version int64 `json:"v,omitempty"`
+	// CacheExpiresAt (Unix milliseconds) and LoadTime (microseconds) drive
+	// early refresh and are only recorded when it is enabled.
+	CacheExpiresAt int64 `json:"x,omitempty"`
+	LoadTime       int64 `json:"t,omitempty"`
+}
+
+func newCachedLink(urlEntity *domain.URL) cachedLink {
+	return cachedLink{
+		OriginalURL:  urlEntity.OriginalURL,
+		RedirectType: urlEntity.RedirectType,
+		ExpiresAt:    urlEntity.ExpiresAt,
+		Disabled:     urlEntity.Status == domain.LinkStatusDisabled,
+		Version:      linkVersion(urlEntity),
+	}
+}
+
+func linkVersion(urlEntity *domain.URL) int64 {
+	if urlEntity.UpdatedAt.IsZero() {
+		return 0
+	}
+
+	return urlEntity.UpdatedAt.UnixMicro()
+}
+
+// check reports why the link must not redirect at now, if anything.
+func (l cachedLink) check(now time.Time) error {
+	if l.Disabled {
+		return domain.ErrURLDisabled
+	}
+	if l.ExpiresAt != nil && now.After(*l.ExpiresAt) {
+		return domain.ErrExpiredURL
+	}
+
+	return nil
+}
+
+func (l cachedLink) encode() string {
+	data, _ := json.Marshal(l)
+
+	return string(data)
+}
+
+// decodeCachedLink parses a cached record. Values written by older versions
+// (the bare destination URL) fail to parse and are treated as a cache miss.
+func decodeCachedLink(value string) (cachedLink, bool) {
+	var link cachedLink
+	if err := json.Unmarshal([]byte(value), &link); err != nil || link.OriginalURL == "" {
+		return cachedLink{}, false
+	}
+
+	return link, true
+}
+
+// lookupLink resolves a short code through the cache, the negative cache and
+// the database. Concurrent lookups of the same code share a single trip, so
+// a hot link whose cache entry lapses reaches the database only once.
+func (s *URLService) lookupLink(ctx context.Context, shortCode string) (cachedLink, error) {
+	// The shared lookup must not fail for everyone when the request that
+	// started it goes away.
+	result, err, _ := s.lookups.Do(shortCode, func() (interface{}, error) {
+		return s.loadLink(context.WithoutCancel(ctx), shortCode)
+	})
+	if err != nil {
+		return cachedLink{}, err
+	}
+
+	return result.(cachedLink), nil
+}
+
+func (s *URLService) loadLink(ctx context.Context, shortCode string) (cachedLink, error) {
+	cachedValue, err := s.cacheRepo.Get(ctx, s.cacheKeys.Link(shortCode))
+	if err == nil && cachedValue != "" {
+		if link, ok := decodeCachedLink(cachedValue); ok {
+			if s.shouldRefresh(link, time.Now()) {
+				go s.refreshLink(shortCode)
+			}
+
+			return link, nil
+		}
+	}
+
+	if missing, _ := s.cacheRepo.Exists(ctx, s.cacheKeys.Negative(shortCode)); missing {
+		return cachedLink{}, domain.ErrURLNotFound
+	}
+
+	return s.fetchLink(ctx, shortCode)
+}
+
+// fetchLink loads the link from the database and caches the result, including
+// a miss.
+func (s *URLService) fetchLink(ctx context.Context, shortCode string) (cachedLink, error) {
+	start := time.Now()
+
+	urlEntity, err := s.urlRepo.GetByShortCode(ctx, shortCode)
+	if err != nil {
+		if errors.Is(err, domain.ErrURLNotFound) {
+			if err := s.cacheRepo.SetWithTTL(ctx, s.cacheKeys.Negative(shortCode), "1", s.negativeCacheTTL); err != nil {
+				s.logger.Warn("failed to cache missing code", zap.Error(err))
+			}
+
+			return cachedLink{}, domain.ErrURLNotFound
+		}
+
+		s.logger.Error("failed to get URL", zap.Error(err))
+
+		return cachedLink{}, err
+	}
+
+	link := newCachedLink(urlEntity)
+	if s.earlyRefreshBeta > 0 {
+		link.LoadTime = time.Since(start).Microseconds()
+	}
+
+	if err = s.cacheLink(ctx, shortCode, link); err != nil {
+		s.logger.Warn("failed to update cache", zap.Error(err))
+	}
+
+	return link, nil
+}
+
+// refreshLink reloads a cached link in the background. Refreshes of the same
+// code are coalesced like lookups.
+func (s *URLService) refreshLink(shortCode string) {
+	s.lookups.Do(refreshKeyPrefix+shortCode, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+		defer cancel()
+
+		return s.fetchLink(ctx, shortCode)
+	})
+}
+
+// shouldRefresh implements probabilistic early expiration ("XFetch"): the
+// closer the entry is to expiring, and the longer it took to load, the more
+// likely a hit triggers a refresh, so hot links are reloaded before they
+// lapse while cold ones are left to expire.
+func (s *URLService) shouldRefresh(link cachedLink, now time.Time) bool {
+	if s.earlyRefreshBeta <= 0 || link.CacheExpiresAt == 0 || link.LoadTime <= 0 {
+		return false
+	}
+
+	loadTime := float64(link.LoadTime) * float64(time.Microsecond)
+	gap := time.Duration(loadTime * s.earlyRefreshBeta * -math.Log(1-rand.Float64()))
+
+	return now.Add(gap).After(time.UnixMilli(link.CacheExpiresAt))
+}
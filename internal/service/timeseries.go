@@ -0,0 +1,157 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultTimeSeriesBuckets is how far back a time series starts when no
+	// start is given.
+	defaultTimeSeriesBuckets = 30
+	maxTimeSeriesBuckets     = 5000
+)
+
+type TimeSeriesRequest struct {
+	ShortCode string
+	// From and To default to the last defaultTimeSeriesBuckets intervals.
+	From     *time.Time
+	To       *time.Time
+	Interval domain.TimeInterval
+	// Timezone is an IANA name; empty means UTC.
+	Timezone    string
+	Unique      bool
+	IncludeBots bool
+}
+
+// GetTimeSeries counts the clicks of a link per interval. Buckets without
+// clicks are included with zero counts, and the first bucket starts at the
+// beginning of the interval containing From.
+func (s *URLService) GetTimeSeries(ctx context.Context, req TimeSeriesRequest) (*domain.TimeSeries, error) {
+	interval := req.Interval
+	if interval == "" {
+		interval = domain.IntervalDay
+	}
+	switch interval {
+	case domain.IntervalMinute, domain.IntervalHour, domain.IntervalDay, domain.IntervalWeek, domain.IntervalMonth:
+	default:
+		return nil, domain.ErrInvalidInterval
+	}
+
+	if req.Unique && (interval == domain.IntervalMinute || interval == domain.IntervalHour) {
+		return nil, domain.ErrUniqueInterval
+	}
+
+	location := time.UTC
+	if req.Timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(req.Timezone); err != nil {
+			return nil, domain.ErrInvalidTimezone
+		}
+	}
+
+	to := time.Now()
+	if req.To != nil {
+		to = *req.To
+	}
+	from := stepInterval(to, interval, -defaultTimeSeriesBuckets)
+	if req.From != nil {
+		from = *req.From
+	}
+	if !from.Before(to) {
+		return nil, domain.ErrInvalidTimeRange
+	}
+	from = truncateToInterval(from, interval, location)
+
+	buckets := []time.Time{}
+	for start := from; start.Before(to); start = stepInterval(start, interval, 1) {
+		if len(buckets) == maxTimeSeriesBuckets {
+			return nil, domain.ErrInvalidTimeRange
+		}
+		buckets = append(buckets, start)
+	}
+
+	points, err := s.analyticsRepo.GetTimeSeries(ctx, domain.TimeSeriesQuery{
+		ShortCode:   req.ShortCode,
+		From:        from,
+		To:          to,
+		Interval:    interval,
+		Location:    location,
+		Unique:      req.Unique,
+		IncludeBots: req.IncludeBots,
+	})
+	if err != nil {
+		if err != domain.ErrURLNotFound {
+			s.logger.Error("failed to get time series", zap.String("short_code", req.ShortCode), zap.Error(err))
+		}
+
+		return nil, err
+	}
+
+	found := make(map[int64]domain.TimeSeriesPoint, len(points))
+	for _, point := range points {
+		found[point.Start.Unix()] = point
+	}
+
+	series := &domain.TimeSeries{
+		ShortCode: req.ShortCode,
+		Interval:  interval,
+		Timezone:  location.String(),
+		From:      from,
+		To:        to.In(location),
+		Points:    make([]domain.TimeSeriesPoint, len(buckets)),
+	}
+	for i, start := range buckets {
+		point := found[start.Unix()]
+		point.Start = start
+		if req.Unique && point.UniqueVisitors == nil {
+			point.UniqueVisitors = new(int64)
+		}
+
+		series.Points[i] = point
+		series.Total += point.Clicks
+	}
+
+	return series, nil
+}
+
+// truncateToInterval returns the start of the interval containing t, in
+// location. It matches PostgreSQL's date_trunc.
+func truncateToInterval(t time.Time, interval domain.TimeInterval, location *time.Location) time.Time {
+	t = t.In(location)
+	year, month, day := t.Date()
+
+	switch interval {
+	case domain.IntervalMinute:
+		return time.Date(year, month, day, t.Hour(), t.Minute(), 0, 0, location)
+	case domain.IntervalHour:
+		return time.Date(year, month, day, t.Hour(), 0, 0, 0, location)
+	case domain.IntervalWeek:
+		sinceMonday := (int(t.Weekday()) + 6) % 7
+		return time.Date(year, month, day-sinceMonday, 0, 0, 0, 0, location)
+	case domain.IntervalMonth:
+		return time.Date(year, month, 1, 0, 0, 0, 0, location)
+	default:
+		return time.Date(year, month, day, 0, 0, 0, 0, location)
+	}
+}
+
+// stepInterval moves t by n intervals. Days, weeks and months follow the
+// calendar of t's location, so they stay aligned across DST changes.
+func stepInterval(t time.Time, interval domain.TimeInterval, n int) time.Time {
+	switch interval {
+	case domain.IntervalMinute:
+		return t.Add(time.Duration(n) * time.Minute)
+	case domain.IntervalHour:
+		return t.Add(time.Duration(n) * time.Hour)
+	case domain.IntervalWeek:
+		return t.AddDate(0, 0, 7*n)
+	case domain.IntervalMonth:
+		return t.AddDate(0, n, 0)
+	default:
+		return t.AddDate(0, 0, n)
+	}
+}
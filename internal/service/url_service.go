@@ -2,37 +2,166 @@ package service
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/base64"
 	"errors"
+	"fmt"
+	"io"
+	"net/http"
 	"net/url"
+	"sync/atomic"
 	"time"
 
+	"github.com/bajdzun/go-url-shortener/internal/cachekey"
+	"github.com/bajdzun/go-url-shortener/internal/clickinfo"
 	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"github.com/bajdzun/go-url-shortener/internal/privacy"
+	"github.com/bajdzun/go-url-shortener/internal/transfer"
 	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
 )
 
+const (
+	defaultListLimit = 50
+	maxListLimit     = 100
+	maxBatchSize     = 1000
+
+	defaultMaxCodeRetries   = 5
+	defaultNegativeCacheTTL = 30 * time.Second
+)
+
+type Config struct {
+	BaseURL string
+	// MaxCodeRetries bounds how many generated codes are tried before giving up.
+	MaxCodeRetries int
+	// CodeValidator checks custom codes and filters generated ones. Optional.
+	CodeValidator domain.ShortCodeValidator
+	// DefaultRedirectType is used for links without their own redirect type.
+	DefaultRedirectType int
+	// RedirectCacheMaxAge is how long clients and CDNs may cache a redirect.
+	// Zero forbids caching, so every click reaches the service.
+	RedirectCacheMaxAge time.Duration
+	// CacheTTL is the cache's default lifetime for link records. Records of
+	// expiring links are cached for at most the time left until expiry.
+	CacheTTL time.Duration
+	// NegativeCacheTTL is how long unknown codes are remembered as missing.
+	NegativeCacheTTL time.Duration
+	// CodeFilter lets lookups and code generation skip codes that certainly
+	// do not exist. Optional.
+	CodeFilter domain.CodeFilter
+	// EarlyRefreshBeta enables probabilistic early refresh of cached links
+	// when positive; higher values refresh earlier. Needs CacheTTL.
+	EarlyRefreshBeta float64
+	// CacheKeys names cache entries; defaults to the default prefix.
+	CacheKeys *cachekey.Builder
+	// CacheGenerations shares cache flushes with other instances. Without
+	// it, FlushCache only affects this instance.
+	CacheGenerations domain.CacheGenerationStore
+	// WarmupSize is how many links WarmCache loads by default.
+	WarmupSize int
+	// WarmupWindow ranks links for warm-up by their clicks in this window
+	// instead of their all-time click count.
+	WarmupWindow time.Duration
+	// ClickRecorder receives a click for every redirect. Clicks are not
+	// recorded without it.
+	ClickRecorder domain.ClickRecorder
+	// ClickCounter holds clicks counted but not yet persisted, which GetStats
+	// adds to the stored click count.
+	ClickCounter domain.ClickCounter
+	// BotClassifier enriches clicks in BackfillClickDetails. It defaults to
+	// the built-in bot patterns.
+	BotClassifier *clickinfo.Classifier
+	// Privacy tells EraseClicks how IP addresses were stored. It defaults
+	// to storing them in full.
+	Privacy *privacy.Policy
+}
+
+type Redirect struct {
+	URL        string
+	StatusCode int
+	MaxAge     time.Duration
+}
+
 type URLService struct {
-	urlRepo       domain.URLRepository
-	cacheRepo     domain.CacheRepository
-	analyticsRepo domain.AnalyticsRepository
-	logger        *zap.Logger
-	baseURL       string
+	urlRepo        domain.URLRepository
+	cacheRepo      domain.CacheRepository
+	analyticsRepo  domain.AnalyticsRepository
+	codeGenerator  domain.ShortCodeGenerator
+	codeValidator  domain.ShortCodeValidator
+	logger         *zap.Logger
+	baseURL        string
+	maxCodeRetries int
+
+	defaultRedirectType int
+	redirectCacheMaxAge time.Duration
+	cacheTTL            time.Duration
+	negativeCacheTTL    time.Duration
+	codeFilter          domain.CodeFilter
+	earlyRefreshBeta    float64
+	cacheKeys           *cachekey.Builder
+	cacheGenerations    domain.CacheGenerationStore
+	warmupSize          int
+	warmupWindow        time.Duration
+	clickRecorder       domain.ClickRecorder
+	clickCounter        domain.ClickCounter
+	botClassifier       *clickinfo.Classifier
+	privacy             *privacy.Policy
+	lookups             singleflight.Group
+	warming             atomic.Bool
 }
 
 func NewURLService(
 	urlRepo domain.URLRepository,
 	cacheRepo domain.CacheRepository,
 	analyticsRepo domain.AnalyticsRepository,
+	codeGenerator domain.ShortCodeGenerator,
 	logger *zap.Logger,
-	baseURL string,
+	cfg Config,
 ) *URLService {
+	if cfg.MaxCodeRetries <= 0 {
+		cfg.MaxCodeRetries = defaultMaxCodeRetries
+	}
+	if cfg.DefaultRedirectType == 0 {
+		cfg.DefaultRedirectType = http.StatusFound
+	}
+	if cfg.NegativeCacheTTL <= 0 {
+		cfg.NegativeCacheTTL = defaultNegativeCacheTTL
+	}
+	if cfg.CacheKeys == nil {
+		cfg.CacheKeys = cachekey.New("")
+	}
+	if cfg.WarmupSize <= 0 {
+		cfg.WarmupSize = defaultWarmupSize
+	}
+	if cfg.BotClassifier == nil {
+		cfg.BotClassifier, _ = clickinfo.NewClassifier(nil, nil)
+	}
+	if cfg.Privacy == nil {
+		cfg.Privacy, _ = privacy.NewPolicy(privacy.Options{})
+	}
+
 	return &URLService{
-		urlRepo:       urlRepo,
-		cacheRepo:     cacheRepo,
-		analyticsRepo: analyticsRepo,
-		logger:        logger,
-		baseURL:       baseURL,
+		urlRepo:        urlRepo,
+		cacheRepo:      cacheRepo,
+		analyticsRepo:  analyticsRepo,
+		codeGenerator:  codeGenerator,
+		codeValidator:  cfg.CodeValidator,
+		logger:         logger,
+		baseURL:        cfg.BaseURL,
+		maxCodeRetries: cfg.MaxCodeRetries,
+
+		defaultRedirectType: cfg.DefaultRedirectType,
+		redirectCacheMaxAge: cfg.RedirectCacheMaxAge,
+		cacheTTL:            cfg.CacheTTL,
+		negativeCacheTTL:    cfg.NegativeCacheTTL,
+		codeFilter:          cfg.CodeFilter,
+		earlyRefreshBeta:    cfg.EarlyRefreshBeta,
+		cacheKeys:           cfg.CacheKeys,
+		cacheGenerations:    cfg.CacheGenerations,
+		warmupSize:          cfg.WarmupSize,
+		warmupWindow:        cfg.WarmupWindow,
+		clickRecorder:       cfg.ClickRecorder,
+		clickCounter:        cfg.ClickCounter,
+		botClassifier:       cfg.BotClassifier,
+		privacy:             cfg.Privacy,
 	}
 }
 
@@ -41,6 +170,39 @@ type CreateURLRequest struct {
 	CustomCode  string                 `json:"custom_code,omitempty"`
 	ExpiresIn   *int64                 `json:"expires_in,omitempty"` // seconds
 	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	// RedirectType is 301, 302, 307 or 308; omitted uses the service default.
+	RedirectType int `json:"redirect_type,omitempty"`
+}
+
+type BatchCreateRequest struct {
+	Items  []CreateURLRequest `json:"items"`
+	Atomic bool               `json:"atomic,omitempty"`
+}
+
+type BatchItemError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type BatchItemResult struct {
+	Index  int                `json:"index"`
+	Result *CreateURLResponse `json:"result,omitempty"`
+	Error  *BatchItemError    `json:"error,omitempty"`
+}
+
+type BatchCreateResponse struct {
+	Created int               `json:"created"`
+	Failed  int               `json:"failed"`
+	Items   []BatchItemResult `json:"items"`
+}
+
+type UpdateURLRequest struct {
+	OriginalURL *string                `json:"original_url,omitempty"`
+	ExpiresIn   *int64                 `json:"expires_in,omitempty"` // seconds, 0 removes the expiry
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`   // merged, null values remove keys
+	// RedirectType 0 reverts the link to the service default.
+	RedirectType *int               `json:"redirect_type,omitempty"`
+	Status       *domain.LinkStatus `json:"status,omitempty"`
 }
 
 type CreateURLResponse struct {
@@ -50,129 +212,500 @@ type CreateURLResponse struct {
 	CreatedAt   time.Time              `json:"created_at"`
 	ExpiresAt   *time.Time             `json:"expires_at,omitempty"`
 	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	// RedirectType is the status the link redirects with, default included.
+	RedirectType int               `json:"redirect_type"`
+	Status       domain.LinkStatus `json:"status"`
 }
 
 func (s *URLService) CreateShortURL(ctx context.Context, req *CreateURLRequest) (*CreateURLResponse, error) {
 	if !s.isValidURL(req.OriginalURL) {
 		return nil, domain.ErrInvalidURL
 	}
+	if !isValidRedirectType(req.RedirectType) {
+		return nil, domain.ErrInvalidRedirect
+	}
 
-	var shortCode string
+	var urlEntity *domain.URL
 	var err error
 
+	// The unique constraint on short_code is the only authority on whether a
+	// code is free; checking first would race with concurrent requests.
 	if req.CustomCode != "" {
-		shortCode = req.CustomCode
-		existing, _ := s.urlRepo.GetByShortCode(ctx, shortCode)
-		if existing != nil {
-			return nil, domain.ErrShortCodeExists
+		if err = s.validateCode(req.CustomCode); err != nil {
+			return nil, err
 		}
+
+		urlEntity = newURLEntity(req, req.CustomCode)
+		err = s.urlRepo.Create(ctx, urlEntity)
 	} else {
-		shortCode = s.generateShortCode(req.OriginalURL)
-		for {
-			existing, _ := s.urlRepo.GetByShortCode(ctx, shortCode)
-			if existing == nil {
-				break
-			}
+		urlEntity, err = s.createWithGeneratedCode(ctx, req)
+	}
 
-			shortCode = s.generateShortCode(req.OriginalURL + time.Now().String())
+	if err != nil {
+		if !errors.Is(err, domain.ErrShortCodeExists) && !errors.Is(err, domain.ErrCodeGeneration) {
+			s.logger.Error("failed to create URL", zap.Error(err))
 		}
+
+		return nil, err
 	}
 
-	var expiresAt *time.Time
-	if req.ExpiresIn != nil && *req.ExpiresIn > 0 {
-		expTime := time.Now().Add(time.Duration(*req.ExpiresIn) * time.Second)
-		expiresAt = &expTime
+	s.addToFilter(urlEntity.ShortCode)
+
+	// Lookups check the record before the negative cache, so this also hides
+	// any earlier "not found" for a custom code.
+	if err = s.cacheLink(ctx, urlEntity.ShortCode, newCachedLink(urlEntity)); err != nil {
+		s.logger.Warn("failed to cache URL", zap.Error(err))
 	}
 
-	urlEntity := &domain.URL{
-		ShortCode:   shortCode,
-		OriginalURL: req.OriginalURL,
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
-		ExpiresAt:   expiresAt,
-		ClickCount:  0,
-		Metadata:    req.Metadata,
+	return s.toResponse(urlEntity), nil
+}
+
+func (s *URLService) CreateShortURLBatch(ctx context.Context, req *BatchCreateRequest) (*BatchCreateResponse, error) {
+	if len(req.Items) == 0 {
+		return nil, domain.ErrEmptyBatch
+	}
+	if len(req.Items) > maxBatchSize {
+		return nil, domain.ErrBatchTooLarge
 	}
 
-	if err = s.urlRepo.Create(ctx, urlEntity); err != nil {
-		s.logger.Error("failed to create URL", zap.Error(err))
+	results := make([]BatchItemResult, len(req.Items))
+	entities := make([]*domain.URL, len(req.Items))
+	generated := make([]bool, len(req.Items))
+	customCodes := make(map[string]bool)
 
-		return nil, err
+	for i := range req.Items {
+		item := &req.Items[i]
+		results[i].Index = i
+
+		if !s.isValidURL(item.OriginalURL) {
+			results[i].Error = newBatchItemError(domain.ErrInvalidURL)
+			continue
+		}
+		if !isValidRedirectType(item.RedirectType) {
+			results[i].Error = newBatchItemError(domain.ErrInvalidRedirect)
+			continue
+		}
+
+		shortCode := item.CustomCode
+		if shortCode == "" {
+			code, err := s.generateCode(ctx)
+			if err != nil {
+				return nil, err
+			}
+			shortCode = code
+			generated[i] = true
+		} else if err := s.validateCode(shortCode); err != nil {
+			results[i].Error = newBatchItemError(err)
+			continue
+		} else if customCodes[shortCode] {
+			results[i].Error = newBatchItemError(domain.ErrShortCodeExists)
+			continue
+		} else {
+			customCodes[shortCode] = true
+		}
+
+		entities[i] = newURLEntity(item, shortCode)
 	}
 
-	if err = s.cacheRepo.Set(ctx, shortCode, req.OriginalURL); err != nil {
-		s.logger.Warn("failed to cache URL", zap.Error(err))
+	if req.Atomic && batchHasErrors(results) {
+		return s.abortBatch(results), nil
 	}
 
-	return &CreateURLResponse{
-		ShortCode:   shortCode,
-		ShortURL:    s.baseURL + "/" + shortCode,
-		OriginalURL: req.OriginalURL,
-		CreatedAt:   urlEntity.CreatedAt,
-		ExpiresAt:   expiresAt,
-		Metadata:    req.Metadata,
-	}, nil
-}
+	pending := make([]int, 0, len(entities))
+	for i, entity := range entities {
+		if entity != nil {
+			pending = append(pending, i)
+		}
+	}
+
+	// Generated codes that collide are regenerated and retried; an atomic
+	// batch is rolled back on conflict, so it is retried as a whole.
+	for attempt := 0; len(pending) > 0; attempt++ {
+		batch := make([]*domain.URL, len(pending))
+		for j, i := range pending {
+			batch[j] = entities[i]
+		}
+
+		itemErrs, err := s.urlRepo.CreateBatch(ctx, batch, req.Atomic)
+		if err != nil {
+			s.logger.Error("failed to create URL batch", zap.Error(err))
+
+			return nil, err
+		}
 
-func (s *URLService) GetOriginalURL(ctx context.Context, shortCode string, analytics *domain.Analytics) (string, error) {
-	cachedURL, err := s.cacheRepo.Get(ctx, shortCode)
-	if err == nil && cachedURL != "" {
-		go func() {
-			analytics.ShortCode = shortCode
-			if err := s.analyticsRepo.RecordClick(context.Background(), analytics); err != nil {
-				s.logger.Error("failed to record analytics", zap.Error(err))
+		var retry []int
+		for j, i := range pending {
+			itemErr := itemErrs[j]
+			if errors.Is(itemErr, domain.ErrShortCodeExists) && generated[i] {
+				if attempt+1 >= s.maxCodeRetries {
+					itemErr = domain.ErrCodeGeneration
+				} else {
+					code, err := s.generateCode(ctx)
+					if err != nil {
+						return nil, err
+					}
+					entities[i].ShortCode = code
+					retry = append(retry, i)
+					continue
+				}
 			}
-			if err := s.urlRepo.IncrementClickCount(context.Background(), shortCode); err != nil {
-				s.logger.Error("failed to increment click count", zap.Error(err))
+			if itemErr != nil && !errors.Is(itemErr, domain.ErrBatchAborted) {
+				results[i].Error = newBatchItemError(itemErr)
 			}
-		}()
+		}
 
-		return cachedURL, nil
+		if !req.Atomic {
+			pending = retry
+			continue
+		}
+		if batchHasErrors(results) {
+			return s.abortBatch(results), nil
+		}
+		if len(retry) == 0 {
+			break
+		}
 	}
 
-	urlEntity, err := s.urlRepo.GetByShortCode(ctx, shortCode)
-	if err != nil {
-		if errors.Is(err, domain.ErrURLNotFound) {
-			return "", domain.ErrURLNotFound
+	entries := make([]domain.CacheEntry, 0, len(entities))
+	response := &BatchCreateResponse{Items: results}
+	for i, entity := range entities {
+		if results[i].Error != nil {
+			response.Failed++
+			continue
+		}
+
+		results[i].Result = s.toResponse(entity)
+		response.Created++
+		s.addToFilter(entity.ShortCode)
+
+		link := newCachedLink(entity)
+		if ttl, ok := s.linkCacheTTL(link); ok {
+			entries = append(entries, domain.CacheEntry{Key: s.cacheKeys.Link(entity.ShortCode), Value: link.encode(), TTL: ttl})
+		}
+	}
+
+	if err := s.cacheRepo.SetMany(ctx, entries); err != nil {
+		s.logger.Warn("failed to cache URL batch", zap.Error(err))
+	}
+
+	return response, nil
+}
+
+func (s *URLService) abortBatch(results []BatchItemResult) *BatchCreateResponse {
+	response := &BatchCreateResponse{Items: results}
+	for i := range results {
+		results[i].Result = nil
+		if results[i].Error == nil {
+			results[i].Error = newBatchItemError(domain.ErrBatchAborted)
+		}
+		response.Failed++
+	}
+
+	return response
+}
+
+func batchHasErrors(results []BatchItemResult) bool {
+	for _, result := range results {
+		if result.Error != nil {
+			return true
 		}
+	}
 
-		s.logger.Error("failed to get URL", zap.Error(err))
+	return false
+}
 
-		return "", err
+func newBatchItemError(err error) *BatchItemError {
+	code := "internal_error"
+	message := "internal server error"
+
+	switch {
+	case errors.Is(err, domain.ErrInvalidURL):
+		code, message = "invalid_url", err.Error()
+	case errors.Is(err, domain.ErrInvalidShortCode):
+		code, message = "invalid_short_code", err.Error()
+	case errors.Is(err, domain.ErrInvalidRedirect):
+		code, message = "invalid_redirect_type", err.Error()
+	case errors.Is(err, domain.ErrShortCodeExists):
+		code, message = "code_taken", err.Error()
+	case errors.Is(err, domain.ErrBatchAborted):
+		code, message = "aborted", err.Error()
+	case errors.Is(err, domain.ErrCodeGeneration):
+		code, message = "code_generation_failed", err.Error()
 	}
 
-	if urlEntity.ExpiresAt != nil && time.Now().After(*urlEntity.ExpiresAt) {
-		return "", domain.ErrExpiredURL
+	return &BatchItemError{Code: code, Message: message}
+}
+
+func (s *URLService) GetOriginalURL(ctx context.Context, shortCode string, analytics *domain.Analytics) (*Redirect, error) {
+	if s.codeFilter != nil && !s.codeFilter.MayContain(shortCode) {
+		return nil, domain.ErrURLNotFound
+	}
+
+	link, err := s.lookupLink(ctx, shortCode)
+	if err != nil {
+		return nil, err
 	}
 
-	if err = s.cacheRepo.Set(ctx, shortCode, urlEntity.OriginalURL); err != nil {
-		s.logger.Warn("failed to update cache", zap.Error(err))
+	return s.follow(shortCode, link, analytics)
+}
+
+// follow applies the same validity rules to cached and freshly loaded links
+// and records the click for those that redirect.
+func (s *URLService) follow(shortCode string, link cachedLink, analytics *domain.Analytics) (*Redirect, error) {
+	if err := link.check(time.Now()); err != nil {
+		return nil, err
 	}
 
-	go func() {
-		analytics.ShortCode = shortCode
-		if err := s.analyticsRepo.RecordClick(context.Background(), analytics); err != nil {
-			s.logger.Error("failed to record analytics", zap.Error(err))
+	s.recordClick(shortCode, analytics)
+
+	return s.newRedirect(link), nil
+}
+
+// cacheLink stores the link record, keeping it no longer than the link is
+// valid. Disabled links are cached too so they are refused without a query.
+func (s *URLService) cacheLink(ctx context.Context, shortCode string, link cachedLink) error {
+	ttl, ok := s.linkCacheTTL(link)
+	if !ok {
+		return nil
+	}
+	if s.earlyRefreshBeta > 0 {
+		lifetime := ttl
+		if lifetime == 0 {
+			lifetime = s.cacheTTL
+		}
+		if lifetime > 0 {
+			link.CacheExpiresAt = time.Now().Add(lifetime).UnixMilli()
 		}
-		if err := s.urlRepo.IncrementClickCount(context.Background(), shortCode); err != nil {
-			s.logger.Error("failed to increment click count", zap.Error(err))
+	}
+
+	// A lookup that read the link before an update must not replace the
+	// updated record.
+	return s.cacheRepo.SetNewer(ctx, s.cacheKeys.Link(shortCode), link.encode(), link.Version, ttl)
+}
+
+// linkCacheTTL returns the smaller of the configured cache TTL and the time
+// left until the link expires, or zero for the cache default. It reports
+// false for links that have already expired and must not be cached.
+func (s *URLService) linkCacheTTL(link cachedLink) (time.Duration, bool) {
+	if link.ExpiresAt == nil {
+		return 0, true
+	}
+
+	remaining := time.Until(*link.ExpiresAt)
+	if remaining <= 0 {
+		return 0, false
+	}
+	if s.cacheTTL > 0 && s.cacheTTL < remaining {
+		return s.cacheTTL, true
+	}
+
+	return remaining, true
+}
+
+func (s *URLService) recordClick(shortCode string, analytics *domain.Analytics) {
+	if s.clickRecorder == nil || analytics == nil {
+		return
+	}
+
+	analytics.ShortCode = shortCode
+	if analytics.ClickedAt.IsZero() {
+		analytics.ClickedAt = time.Now()
+	}
+	s.clickRecorder.Record(analytics)
+}
+
+// newRedirect resolves the status code and how long clients may cache the
+// redirect. Links with an expiry are never cacheable past it.
+func (s *URLService) newRedirect(link cachedLink) *Redirect {
+	maxAge := s.redirectCacheMaxAge
+	if link.ExpiresAt != nil {
+		if remaining := time.Until(*link.ExpiresAt); remaining < maxAge {
+			maxAge = remaining.Truncate(time.Second)
 		}
-	}()
+	}
+	if maxAge < 0 {
+		maxAge = 0
+	}
 
-	return urlEntity.OriginalURL, nil
+	return &Redirect{
+		URL:        link.OriginalURL,
+		StatusCode: s.redirectType(link.RedirectType),
+		MaxAge:     maxAge,
+	}
 }
 
-func (s *URLService) GetStats(ctx context.Context, shortCode string) (*domain.URLStats, error) {
-	stats, err := s.analyticsRepo.GetStats(ctx, shortCode)
+// GetStats leaves clicks by bots out of the click count unless includeBots
+// is set.
+func (s *URLService) GetStats(ctx context.Context, shortCode string, includeBots bool) (*domain.URLStats, error) {
+	stats, err := s.analyticsRepo.GetStats(ctx, shortCode, includeBots)
 	if err != nil {
 		s.logger.Error("failed to get stats", zap.Error(err))
 
 		return nil, err
 	}
 
+	if s.clickCounter != nil {
+		pending, err := s.clickCounter.Pending(ctx, shortCode)
+		if err != nil {
+			s.logger.Warn("failed to get pending clicks", zap.String("short_code", shortCode), zap.Error(err))
+		}
+		stats.ClickCount += pending
+	}
+
 	return stats, nil
 }
 
+func (s *URLService) ListURLs(ctx context.Context, filter domain.URLFilter) (*domain.URLPage, error) {
+	switch filter.SortBy {
+	case "":
+		filter.SortBy = domain.SortByCreatedAt
+	case domain.SortByCreatedAt, domain.SortByClickCount:
+	default:
+		return nil, domain.ErrInvalidFilter
+	}
+
+	switch filter.Expiry {
+	case domain.ExpiryAny, domain.ExpiryActive, domain.ExpiryExpired, domain.ExpiryNever:
+	default:
+		return nil, domain.ErrInvalidFilter
+	}
+
+	if filter.Limit <= 0 {
+		filter.Limit = defaultListLimit
+	} else if filter.Limit > maxListLimit {
+		filter.Limit = maxListLimit
+	}
+
+	if filter.MetadataValue != nil && filter.MetadataKey == "" {
+		return nil, domain.ErrInvalidFilter
+	}
+
+	page, err := s.urlRepo.List(ctx, filter)
+	if err != nil {
+		if !errors.Is(err, domain.ErrInvalidCursor) {
+			s.logger.Error("failed to list URLs", zap.Error(err))
+		}
+
+		return nil, err
+	}
+
+	return page, nil
+}
+
+func (s *URLService) ExportURLs(ctx context.Context, w io.Writer, format transfer.Format) error {
+	encoder, err := transfer.NewEncoder(w, format)
+	if err != nil {
+		return err
+	}
+
+	if err := s.urlRepo.ForEach(ctx, encoder.Encode); err != nil {
+		s.logger.Error("failed to export URLs", zap.Error(err))
+
+		return err
+	}
+
+	return encoder.Flush()
+}
+
+func (s *URLService) ImportURLs(ctx context.Context, r io.Reader, format transfer.Format, policy domain.ConflictPolicy) (*domain.ImportResult, error) {
+	switch policy {
+	case domain.ConflictSkip, domain.ConflictOverwrite, domain.ConflictFail:
+	default:
+		return nil, domain.ErrInvalidPolicy
+	}
+
+	decoder, err := transfer.NewDecoder(r, format)
+	if err != nil {
+		if errors.Is(err, transfer.ErrUnsupportedFormat) {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("%w: %v", domain.ErrInvalidImport, err)
+	}
+
+	// Invalid records are reported back instead of aborting the import,
+	// unless the caller asked to fail on the first problem.
+	var rejected []domain.ImportRejection
+	record := 0
+	next := func() (*domain.URL, error) {
+		for {
+			record++
+
+			urlEntity, err := decoder.Decode()
+			if errors.Is(err, io.EOF) {
+				return nil, io.EOF
+			}
+
+			reason := ""
+			switch {
+			case err != nil:
+				var recordErr *transfer.RecordError
+				if !errors.As(err, &recordErr) {
+					return nil, fmt.Errorf("%w: record %d: %v", domain.ErrInvalidImport, record, err)
+				}
+				reason = recordErr.Error()
+			case urlEntity.ShortCode == "":
+				reason = "short code is required"
+			case !s.isValidURL(urlEntity.OriginalURL):
+				reason = domain.ErrInvalidURL.Error()
+			case !isValidRedirectType(urlEntity.RedirectType):
+				reason = domain.ErrInvalidRedirect.Error()
+			case urlEntity.Status != "" && !isValidStatus(urlEntity.Status):
+				reason = domain.ErrInvalidStatus.Error()
+			default:
+				if codeErr := s.validateCode(urlEntity.ShortCode); codeErr != nil {
+					reason = codeErr.Error()
+				}
+			}
+
+			if reason != "" {
+				if policy == domain.ConflictFail {
+					return nil, fmt.Errorf("%w: record %d: %s", domain.ErrInvalidImport, record, reason)
+				}
+				rejected = append(rejected, domain.ImportRejection{Record: record, Reason: reason})
+				continue
+			}
+
+			// Added up front; codes the import ends up skipping only cost a
+			// false positive.
+			s.addToFilter(urlEntity.ShortCode)
+
+			now := time.Now()
+			if urlEntity.CreatedAt.IsZero() {
+				urlEntity.CreatedAt = now
+			}
+			if urlEntity.UpdatedAt.IsZero() {
+				urlEntity.UpdatedAt = now
+			}
+
+			return urlEntity, nil
+		}
+	}
+
+	result, err := s.urlRepo.Import(ctx, next, policy)
+	if err != nil {
+		if !errors.Is(err, domain.ErrShortCodeExists) && !errors.Is(err, domain.ErrInvalidImport) {
+			s.logger.Error("failed to import URLs", zap.Error(err))
+		}
+
+		return nil, err
+	}
+	result.Rejected = rejected
+
+	for _, shortCode := range result.UpdatedCodes {
+		if err := s.cacheRepo.Delete(ctx, s.cacheKeys.Link(shortCode)); err != nil {
+			s.logger.Warn("failed to delete from cache", zap.String("short_code", shortCode), zap.Error(err))
+		}
+	}
+	for _, shortCode := range result.CreatedCodes {
+		if err := s.cacheRepo.Delete(ctx, s.cacheKeys.Negative(shortCode)); err != nil {
+			s.logger.Warn("failed to delete from cache", zap.String("short_code", shortCode), zap.Error(err))
+		}
+	}
+
+	return result, nil
+}
+
 func (s *URLService) DeleteURL(ctx context.Context, shortCode string) error {
 	if err := s.urlRepo.Delete(ctx, shortCode); err != nil {
 		s.logger.Error("failed to delete URL", zap.Error(err))
@@ -180,18 +713,236 @@ func (s *URLService) DeleteURL(ctx context.Context, shortCode string) error {
 		return err
 	}
 
-	if err := s.cacheRepo.Delete(ctx, shortCode); err != nil {
+	if s.codeFilter != nil {
+		s.codeFilter.Remove(shortCode)
+	}
+
+	if err := s.cacheRepo.Delete(ctx, s.cacheKeys.Link(shortCode)); err != nil {
 		s.logger.Warn("failed to delete from cache", zap.Error(err))
 	}
 
 	return nil
 }
 
-func (s *URLService) generateShortCode(originalURL string) string {
-	hash := sha256.Sum256([]byte(originalURL + time.Now().String()))
-	encoded := base64.URLEncoding.EncodeToString(hash[:])
+// FlushCache starts a new cache generation, which makes every cached link
+// and negative entry unreachable without touching other data in the cache.
+// It returns the new generation.
+func (s *URLService) FlushCache(ctx context.Context) (int64, error) {
+	generation := s.cacheKeys.Generation() + 1
+	if s.cacheGenerations != nil {
+		var err error
+		if generation, err = s.cacheGenerations.Bump(ctx); err != nil {
+			s.logger.Error("failed to bump cache generation", zap.Error(err))
+
+			return 0, err
+		}
+	}
+
+	s.cacheKeys.SetGeneration(generation)
+	s.logger.Info("cache flushed", zap.Int64("generation", generation))
+
+	return generation, nil
+}
+
+func (s *URLService) UpdateURL(ctx context.Context, shortCode string, req *UpdateURLRequest) (*CreateURLResponse, error) {
+	if req.OriginalURL != nil && !s.isValidURL(*req.OriginalURL) {
+		return nil, domain.ErrInvalidURL
+	}
+	if req.RedirectType != nil && !isValidRedirectType(*req.RedirectType) {
+		return nil, domain.ErrInvalidRedirect
+	}
+	if req.Status != nil && !isValidStatus(*req.Status) {
+		return nil, domain.ErrInvalidStatus
+	}
+
+	urlEntity, err := s.urlRepo.Update(ctx, shortCode, func(urlEntity *domain.URL) error {
+		applyUpdate(urlEntity, req)
+
+		return nil
+	})
+	if err != nil {
+		if !errors.Is(err, domain.ErrURLNotFound) {
+			s.logger.Error("failed to update URL", zap.Error(err))
+		}
+
+		return nil, err
+	}
+
+	// Deleting the cached record also drops the copies other instances hold
+	// in memory. The new record is cached right away rather than left to the
+	// next lookup, and lookups that read the link before the update cannot
+	// replace it with the older version. The update is
+	// committed, so cache failures are only logged, and the cache replays
+	// the deletes it missed once it is back.
+	s.lookups.Forget(shortCode)
+	if err = s.cacheRepo.Delete(ctx, s.cacheKeys.Link(shortCode)); err != nil {
+		s.logger.Warn("failed to invalidate cache after update", zap.Error(err))
+	}
+	if err = s.cacheLink(ctx, shortCode, newCachedLink(urlEntity)); err != nil {
+		s.logger.Warn("failed to cache updated URL", zap.Error(err))
+	}
+
+	return s.toResponse(urlEntity), nil
+}
+
+// applyUpdate applies the fields set in req to urlEntity. Metadata keys set
+// to null are removed, and other keys are left alone.
+func applyUpdate(urlEntity *domain.URL, req *UpdateURLRequest) {
+	if req.OriginalURL != nil {
+		urlEntity.OriginalURL = *req.OriginalURL
+	}
+	if req.RedirectType != nil {
+		urlEntity.RedirectType = *req.RedirectType
+	}
+	if req.Status != nil {
+		urlEntity.Status = *req.Status
+	}
+
+	if req.ExpiresIn != nil {
+		if *req.ExpiresIn > 0 {
+			expTime := time.Now().Add(time.Duration(*req.ExpiresIn) * time.Second)
+			urlEntity.ExpiresAt = &expTime
+		} else {
+			urlEntity.ExpiresAt = nil
+		}
+	}
+
+	if req.Metadata != nil {
+		if urlEntity.Metadata == nil {
+			urlEntity.Metadata = make(map[string]interface{}, len(req.Metadata))
+		}
+		for key, value := range req.Metadata {
+			if value == nil {
+				delete(urlEntity.Metadata, key)
+				continue
+			}
+			urlEntity.Metadata[key] = value
+		}
+	}
+
+	urlEntity.UpdatedAt = time.Now()
+}
+
+func newURLEntity(req *CreateURLRequest, shortCode string) *domain.URL {
+	var expiresAt *time.Time
+	if req.ExpiresIn != nil && *req.ExpiresIn > 0 {
+		expTime := time.Now().Add(time.Duration(*req.ExpiresIn) * time.Second)
+		expiresAt = &expTime
+	}
+
+	return &domain.URL{
+		ShortCode:   shortCode,
+		OriginalURL: req.OriginalURL,
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+		ExpiresAt:   expiresAt,
+		ClickCount:  0,
+		Metadata:    req.Metadata,
+
+		RedirectType: req.RedirectType,
+		Status:       domain.LinkStatusActive,
+	}
+}
+
+func (s *URLService) toResponse(urlEntity *domain.URL) *CreateURLResponse {
+	return &CreateURLResponse{
+		ShortCode:   urlEntity.ShortCode,
+		ShortURL:    s.baseURL + "/" + urlEntity.ShortCode,
+		OriginalURL: urlEntity.OriginalURL,
+		CreatedAt:   urlEntity.CreatedAt,
+		ExpiresAt:   urlEntity.ExpiresAt,
+		Metadata:    urlEntity.Metadata,
+
+		RedirectType: s.redirectType(urlEntity.RedirectType),
+		Status:       urlEntity.Status,
+	}
+}
+
+func (s *URLService) redirectType(redirectType int) int {
+	if redirectType == 0 {
+		return s.defaultRedirectType
+	}
+
+	return redirectType
+}
+
+func isValidRedirectType(redirectType int) bool {
+	switch redirectType {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	default:
+		return false
+	}
+}
+
+func isValidStatus(status domain.LinkStatus) bool {
+	return status == domain.LinkStatusActive || status == domain.LinkStatusDisabled
+}
+
+// createWithGeneratedCode inserts the URL under freshly generated codes until
+// one is accepted, giving up with ErrCodeGeneration after maxCodeRetries
+// conflicts.
+func (s *URLService) createWithGeneratedCode(ctx context.Context, req *CreateURLRequest) (*domain.URL, error) {
+	for attempt := 0; attempt < s.maxCodeRetries; attempt++ {
+		shortCode, err := s.generateCode(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		urlEntity := newURLEntity(req, shortCode)
+		err = s.urlRepo.Create(ctx, urlEntity)
+		if err == nil {
+			return urlEntity, nil
+		}
+		if !errors.Is(err, domain.ErrShortCodeExists) {
+			return nil, err
+		}
+	}
+
+	s.logger.Error("short code generation retries exhausted", zap.Int("attempts", s.maxCodeRetries))
+
+	return nil, domain.ErrCodeGeneration
+}
+
+// generateCode returns the next generated code that passes validation, so
+// strategies never hand out reserved or blocked words.
+func (s *URLService) generateCode(ctx context.Context) (string, error) {
+	for attempt := 0; attempt < s.maxCodeRetries; attempt++ {
+		shortCode, err := s.codeGenerator.Generate(ctx)
+		if err != nil {
+			s.logger.Error("failed to generate short code", zap.Error(err))
+
+			return "", err
+		}
+
+		if s.validateCode(shortCode) != nil {
+			continue
+		}
+
+		// A code the filter knows about is almost always taken, so draw
+		// again instead of paying for the failed insert.
+		if s.codeFilter != nil && s.codeFilter.Ready() && s.codeFilter.MayContain(shortCode) {
+			continue
+		}
+
+		return shortCode, nil
+	}
+
+	return "", domain.ErrCodeGeneration
+}
+
+func (s *URLService) addToFilter(shortCode string) {
+	if s.codeFilter != nil {
+		s.codeFilter.Add(shortCode)
+	}
+}
+
+func (s *URLService) validateCode(shortCode string) error {
+	if s.codeValidator == nil {
+		return nil
+	}
 
-	return encoded[:7]
+	return s.codeValidator.Validate(shortCode)
 }
 
 func (s *URLService) isValidURL(urlStr string) bool {
@@ -1,17 +1,43 @@
 package service
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/bajdzun/go-url-shortener/internal/bloom"
+	"github.com/bajdzun/go-url-shortener/internal/cachekey"
 	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"github.com/bajdzun/go-url-shortener/internal/privacy"
+	"github.com/bajdzun/go-url-shortener/internal/shortcode"
+	"github.com/bajdzun/go-url-shortener/internal/transfer"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 )
 
+var testConfig = Config{BaseURL: "http://localhost:8080"}
+
+// testKeys matches the keys of services built without Config.CacheKeys.
+var testKeys = cachekey.New("")
+
+// cachedURL matches a cached link record of any version redirecting to
+// originalURL.
+func cachedURL(originalURL string) interface{} {
+	return mock.MatchedBy(func(value string) bool {
+		link, ok := decodeCachedLink(value)
+
+		return ok && link.OriginalURL == originalURL
+	})
+}
+
 type MockURLRepository struct {
 	mock.Mock
 }
@@ -22,6 +48,15 @@ func (m *MockURLRepository) Create(ctx context.Context, url *domain.URL) error {
 	return args.Error(0)
 }
 
+func (m *MockURLRepository) CreateBatch(ctx context.Context, urls []*domain.URL, atomic bool) ([]error, error) {
+	args := m.Called(ctx, urls, atomic)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+
+	return args.Get(0).([]error), args.Error(1)
+}
+
 func (m *MockURLRepository) GetByShortCode(ctx context.Context, shortCode string) (*domain.URL, error) {
 	args := m.Called(ctx, shortCode)
 	if args.Get(0) == nil {
@@ -31,10 +66,19 @@ func (m *MockURLRepository) GetByShortCode(ctx context.Context, shortCode string
 	return args.Get(0).(*domain.URL), args.Error(1)
 }
 
-func (m *MockURLRepository) Update(ctx context.Context, url *domain.URL) error {
-	args := m.Called(ctx, url)
+// Update applies the change to the URL the expectation returns.
+func (m *MockURLRepository) Update(ctx context.Context, shortCode string, apply func(url *domain.URL) error) (*domain.URL, error) {
+	args := m.Called(ctx, shortCode)
+	if err := args.Error(1); err != nil {
+		return nil, err
+	}
 
-	return args.Error(0)
+	url := args.Get(0).(*domain.URL)
+	if err := apply(url); err != nil {
+		return nil, err
+	}
+
+	return url, nil
 }
 
 func (m *MockURLRepository) Delete(ctx context.Context, shortCode string) error {
@@ -43,12 +87,92 @@ func (m *MockURLRepository) Delete(ctx context.Context, shortCode string) error
 	return args.Error(0)
 }
 
-func (m *MockURLRepository) IncrementClickCount(ctx context.Context, shortCode string) error {
-	args := m.Called(ctx, shortCode)
+func (m *MockURLRepository) IncrementClickCounts(ctx context.Context, deltas map[string]int64) error {
+	args := m.Called(ctx, deltas)
 
 	return args.Error(0)
 }
 
+func (m *MockURLRepository) ApplyClickCounts(ctx context.Context, flushID string, deltas map[string]int64) (bool, error) {
+	args := m.Called(ctx, flushID, deltas)
+
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockURLRepository) List(ctx context.Context, filter domain.URLFilter) (*domain.URLPage, error) {
+	args := m.Called(ctx, filter)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+
+	return args.Get(0).(*domain.URLPage), args.Error(1)
+}
+
+func (m *MockURLRepository) TopURLs(ctx context.Context, limit int, clickedSince *time.Time) ([]*domain.URL, error) {
+	args := m.Called(ctx, limit, clickedSince)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+
+	return args.Get(0).([]*domain.URL), args.Error(1)
+}
+
+func (m *MockURLRepository) ForEachShortCode(ctx context.Context, fn func(shortCode string) error) error {
+	args := m.Called(ctx, fn)
+	if codes, ok := args.Get(0).([]string); ok {
+		for _, code := range codes {
+			if err := fn(code); err != nil {
+				return err
+			}
+		}
+	}
+
+	return args.Error(1)
+}
+
+func (m *MockURLRepository) ForEach(ctx context.Context, fn func(url *domain.URL) error) error {
+	args := m.Called(ctx, fn)
+	if urls, ok := args.Get(0).([]*domain.URL); ok {
+		for _, url := range urls {
+			if err := fn(url); err != nil {
+				return err
+			}
+		}
+	}
+
+	return args.Error(1)
+}
+
+func (m *MockURLRepository) Import(ctx context.Context, next func() (*domain.URL, error), policy domain.ConflictPolicy) (*domain.ImportResult, error) {
+	args := m.Called(ctx, next, policy)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+
+	// Drain the iterator like the real repository would, treating every
+	// record as an overwrite of an existing link, or as a new one unless
+	// overwriting.
+	result := args.Get(0).(*domain.ImportResult)
+	for {
+		url, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if policy != domain.ConflictOverwrite {
+			result.Created++
+			result.CreatedCodes = append(result.CreatedCodes, url.ShortCode)
+			continue
+		}
+		result.Updated++
+		result.UpdatedCodes = append(result.UpdatedCodes, url.ShortCode)
+	}
+
+	return result, args.Error(1)
+}
+
 type MockCacheRepository struct {
 	mock.Mock
 }
@@ -59,6 +183,24 @@ func (m *MockCacheRepository) Set(ctx context.Context, key string, value interfa
 	return args.Error(0)
 }
 
+func (m *MockCacheRepository) SetWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	args := m.Called(ctx, key, value, ttl)
+
+	return args.Error(0)
+}
+
+func (m *MockCacheRepository) SetMany(ctx context.Context, entries []domain.CacheEntry) error {
+	args := m.Called(ctx, entries)
+
+	return args.Error(0)
+}
+
+func (m *MockCacheRepository) SetNewer(ctx context.Context, key, value string, version int64, ttl time.Duration) error {
+	args := m.Called(ctx, key, value, ttl)
+
+	return args.Error(0)
+}
+
 func (m *MockCacheRepository) Get(ctx context.Context, key string) (string, error) {
 	args := m.Called(ctx, key)
 
@@ -77,18 +219,58 @@ func (m *MockCacheRepository) Exists(ctx context.Context, key string) (bool, err
 	return args.Bool(0), args.Error(1)
 }
 
-type MockAnalyticsRepository struct {
+type MockClickRecorder struct {
+	mock.Mock
+}
+
+func (m *MockClickRecorder) Record(click *domain.Analytics) {
+	m.Called(click)
+}
+
+type MockClickCounter struct {
 	mock.Mock
 }
 
-func (m *MockAnalyticsRepository) RecordClick(ctx context.Context, analytics *domain.Analytics) error {
-	args := m.Called(ctx, analytics)
+func (m *MockClickCounter) Add(ctx context.Context, deltas map[string]int64) error {
+	args := m.Called(ctx, deltas)
 
 	return args.Error(0)
 }
 
-func (m *MockAnalyticsRepository) GetStats(ctx context.Context, shortCode string) (*domain.URLStats, error) {
+func (m *MockClickCounter) Pending(ctx context.Context, shortCode string) (int64, error) {
 	args := m.Called(ctx, shortCode)
+
+	return args.Get(0).(int64), args.Error(1)
+}
+
+type MockCacheGenerationStore struct {
+	mock.Mock
+}
+
+func (m *MockCacheGenerationStore) Current(ctx context.Context) (int64, error) {
+	args := m.Called(ctx)
+
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockCacheGenerationStore) Bump(ctx context.Context) (int64, error) {
+	args := m.Called(ctx)
+
+	return args.Get(0).(int64), args.Error(1)
+}
+
+type MockAnalyticsRepository struct {
+	mock.Mock
+}
+
+func (m *MockAnalyticsRepository) RecordClicks(ctx context.Context, clicks []*domain.Analytics) error {
+	args := m.Called(ctx, clicks)
+
+	return args.Error(0)
+}
+
+func (m *MockAnalyticsRepository) GetStats(ctx context.Context, shortCode string, includeBots bool) (*domain.URLStats, error) {
+	args := m.Called(ctx, shortCode, includeBots)
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
 	}
@@ -96,21 +278,71 @@ func (m *MockAnalyticsRepository) GetStats(ctx context.Context, shortCode string
 	return args.Get(0).(*domain.URLStats), args.Error(1)
 }
 
+func (m *MockAnalyticsRepository) GetTimeSeries(ctx context.Context, query domain.TimeSeriesQuery) ([]domain.TimeSeriesPoint, error) {
+	args := m.Called(ctx, query)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+
+	return args.Get(0).([]domain.TimeSeriesPoint), args.Error(1)
+}
+
+func (m *MockAnalyticsRepository) GetBreakdown(ctx context.Context, query domain.BreakdownQuery) ([]domain.BreakdownItem, int64, error) {
+	args := m.Called(ctx, query)
+	if args.Get(0) == nil {
+		return nil, args.Get(1).(int64), args.Error(2)
+	}
+
+	return args.Get(0).([]domain.BreakdownItem), args.Get(1).(int64), args.Error(2)
+}
+
+func (m *MockAnalyticsRepository) ListUnenrichedClicks(ctx context.Context, afterID int64, limit int) ([]*domain.Analytics, error) {
+	args := m.Called(ctx, afterID, limit)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+
+	return args.Get(0).([]*domain.Analytics), args.Error(1)
+}
+
+func (m *MockAnalyticsRepository) UpdateClickDetails(ctx context.Context, clicks []*domain.Analytics) error {
+	args := m.Called(ctx, clicks)
+
+	return args.Error(0)
+}
+
+func (m *MockAnalyticsRepository) RollUpClicks(ctx context.Context, limit int) (int64, error) {
+	args := m.Called(ctx, limit)
+
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockAnalyticsRepository) ExpireClicks(ctx context.Context, cutoff time.Time, limit int) (int64, error) {
+	args := m.Called(ctx, cutoff, limit)
+
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockAnalyticsRepository) EraseClicks(ctx context.Context, ipAddresses []string) (int64, error) {
+	args := m.Called(ctx, ipAddresses)
+
+	return args.Get(0).(int64), args.Error(1)
+}
+
 func TestCreateShortURL_Success(t *testing.T) {
 	mockURLRepo := new(MockURLRepository)
 	mockCacheRepo := new(MockCacheRepository)
 	mockAnalyticsRepo := new(MockAnalyticsRepository)
 	logger := zap.NewNop()
 
-	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, logger, "http://localhost:8080")
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
 
 	req := &CreateURLRequest{
 		OriginalURL: "https://www.example.com",
 	}
 
-	mockURLRepo.On("GetByShortCode", mock.Anything, mock.Anything).Return(nil, domain.ErrURLNotFound)
 	mockURLRepo.On("Create", mock.Anything, mock.AnythingOfType("*domain.URL")).Return(nil)
-	mockCacheRepo.On("Set", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockCacheRepo.On("SetNewer", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
 
 	resp, err := service.CreateShortURL(context.Background(), req)
 
@@ -130,7 +362,7 @@ func TestCreateShortURL_InvalidURL(t *testing.T) {
 	mockAnalyticsRepo := new(MockAnalyticsRepository)
 	logger := zap.NewNop()
 
-	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, logger, "http://localhost:8080")
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
 
 	req := &CreateURLRequest{
 		OriginalURL: "invalid-url",
@@ -149,7 +381,7 @@ func TestCreateShortURL_CustomCode(t *testing.T) {
 	mockAnalyticsRepo := new(MockAnalyticsRepository)
 	logger := zap.NewNop()
 
-	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, logger, "http://localhost:8080")
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
 
 	customCode := "custom123"
 	req := &CreateURLRequest{
@@ -157,9 +389,8 @@ func TestCreateShortURL_CustomCode(t *testing.T) {
 		CustomCode:  customCode,
 	}
 
-	mockURLRepo.On("GetByShortCode", mock.Anything, customCode).Return(nil, domain.ErrURLNotFound)
 	mockURLRepo.On("Create", mock.Anything, mock.AnythingOfType("*domain.URL")).Return(nil)
-	mockCacheRepo.On("Set", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockCacheRepo.On("SetNewer", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
 
 	resp, err := service.CreateShortURL(context.Background(), req)
 
@@ -171,35 +402,189 @@ func TestCreateShortURL_CustomCode(t *testing.T) {
 	mockCacheRepo.AssertExpectations(t)
 }
 
+func TestCreateShortURL_ReservedCustomCode(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	logger := zap.NewNop()
+
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, Config{
+		BaseURL:       "http://localhost:8080",
+		CodeValidator: shortcode.NewValidator(shortcode.Rules{Reserved: []string{"metrics"}}),
+	})
+
+	req := &CreateURLRequest{
+		OriginalURL: "https://www.example.com",
+		CustomCode:  "metrics",
+	}
+
+	resp, err := service.CreateShortURL(context.Background(), req)
+
+	assert.ErrorIs(t, err, domain.ErrInvalidShortCode)
+	assert.Nil(t, resp)
+
+	mockURLRepo.AssertNotCalled(t, "GetByShortCode", mock.Anything, mock.Anything)
+	mockURLRepo.AssertNotCalled(t, "Create", mock.Anything, mock.Anything)
+}
+
+type MockShortCodeGenerator struct {
+	mock.Mock
+}
+
+func (m *MockShortCodeGenerator) Generate(ctx context.Context) (string, error) {
+	args := m.Called(ctx)
+
+	return args.String(0), args.Error(1)
+}
+
+func TestCreateShortURL_GenerationRetriesExhausted(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	mockGenerator := new(MockShortCodeGenerator)
+	logger := zap.NewNop()
+
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, mockGenerator, logger, Config{
+		BaseURL:        "http://localhost:8080",
+		MaxCodeRetries: 3,
+	})
+
+	mockGenerator.On("Generate", mock.Anything).Return("taken00", nil)
+	mockURLRepo.On("Create", mock.Anything, mock.AnythingOfType("*domain.URL")).Return(domain.ErrShortCodeExists)
+
+	resp, err := service.CreateShortURL(context.Background(), &CreateURLRequest{
+		OriginalURL: "https://www.example.com",
+	})
+
+	assert.Error(t, err)
+	assert.Equal(t, domain.ErrCodeGeneration, err)
+	assert.Nil(t, resp)
+
+	mockGenerator.AssertNumberOfCalls(t, "Generate", 3)
+	mockURLRepo.AssertNumberOfCalls(t, "Create", 3)
+	mockCacheRepo.AssertNotCalled(t, "SetNewer", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestCreateShortURL_RetriesGeneratedCodeOnConflict(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	mockGenerator := new(MockShortCodeGenerator)
+	logger := zap.NewNop()
+
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, mockGenerator, logger, testConfig)
+
+	mockGenerator.On("Generate", mock.Anything).Return("taken00", nil).Once()
+	mockGenerator.On("Generate", mock.Anything).Return("free000", nil).Once()
+	mockURLRepo.On("Create", mock.Anything, mock.MatchedBy(func(u *domain.URL) bool {
+		return u.ShortCode == "taken00"
+	})).Return(domain.ErrShortCodeExists)
+	mockURLRepo.On("Create", mock.Anything, mock.MatchedBy(func(u *domain.URL) bool {
+		return u.ShortCode == "free000"
+	})).Return(nil)
+	mockCacheRepo.On("SetNewer", mock.Anything, testKeys.Link("free000"), cachedURL("https://www.example.com"), mock.Anything).Return(nil)
+
+	resp, err := service.CreateShortURL(context.Background(), &CreateURLRequest{
+		OriginalURL: "https://www.example.com",
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "free000", resp.ShortCode)
+
+	mockGenerator.AssertExpectations(t)
+	mockURLRepo.AssertExpectations(t)
+	mockURLRepo.AssertNotCalled(t, "GetByShortCode", mock.Anything, mock.Anything)
+	mockCacheRepo.AssertExpectations(t)
+}
+
+func TestCreateShortURL_ConcurrentCustomCode(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	logger := zap.NewNop()
+
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
+
+	// Like the unique constraint, only the first insert of the code succeeds.
+	mockURLRepo.On("Create", mock.Anything, mock.AnythingOfType("*domain.URL")).Return(nil).Once()
+	mockURLRepo.On("Create", mock.Anything, mock.AnythingOfType("*domain.URL")).Return(domain.ErrShortCodeExists)
+	mockCacheRepo.On("SetNewer", mock.Anything, testKeys.Link("campaign"), mock.Anything, mock.Anything).Return(nil)
+
+	const workers = 20
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	start := make(chan struct{})
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+
+			_, err := service.CreateShortURL(context.Background(), &CreateURLRequest{
+				OriginalURL: "https://www.example.com",
+				CustomCode:  "campaign",
+			})
+			errs <- err
+		}()
+	}
+
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	succeeded, conflicted := 0, 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case errors.Is(err, domain.ErrShortCodeExists):
+			conflicted++
+		default:
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	assert.Equal(t, 1, succeeded)
+	assert.Equal(t, workers-1, conflicted)
+
+	mockURLRepo.AssertNumberOfCalls(t, "Create", workers)
+	mockURLRepo.AssertNotCalled(t, "GetByShortCode", mock.Anything, mock.Anything)
+	mockCacheRepo.AssertNumberOfCalls(t, "SetNewer", 1)
+}
+
 func TestGetOriginalURL_FromCache(t *testing.T) {
 	mockURLRepo := new(MockURLRepository)
 	mockCacheRepo := new(MockCacheRepository)
 	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	mockClicks := new(MockClickRecorder)
 	logger := zap.NewNop()
 
-	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, logger, "http://localhost:8080")
+	cfg := testConfig
+	cfg.ClickRecorder = mockClicks
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, cfg)
 
 	shortCode := "abc123"
 	expectedURL := "https://www.example.com"
 
-	mockCacheRepo.On("Get", mock.Anything, shortCode).Return(expectedURL, nil)
-	mockAnalyticsRepo.On("RecordClick", mock.Anything, mock.AnythingOfType("*domain.Analytics")).Return(nil)
-	mockURLRepo.On("IncrementClickCount", mock.Anything, shortCode).Return(nil)
+	mockCacheRepo.On("Get", mock.Anything, testKeys.Link(shortCode)).Return(`{"u":"https://www.example.com"}`, nil)
+	mockClicks.On("Record", mock.MatchedBy(func(click *domain.Analytics) bool {
+		return click.ShortCode == shortCode && click.IPAddress == "127.0.0.1" && !click.ClickedAt.IsZero()
+	})).Return()
 
 	analytics := &domain.Analytics{
 		IPAddress: "127.0.0.1",
 	}
 
-	url, err := service.GetOriginalURL(context.Background(), shortCode, analytics)
+	target, err := service.GetOriginalURL(context.Background(), shortCode, analytics)
 
 	assert.NoError(t, err)
-	assert.Equal(t, expectedURL, url)
-
-	// Wait for async goroutine to complete
-	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, expectedURL, target.URL)
+	assert.Equal(t, http.StatusFound, target.StatusCode)
 
 	mockCacheRepo.AssertExpectations(t)
-	mockAnalyticsRepo.AssertExpectations(t)
+	mockClicks.AssertExpectations(t)
 	mockURLRepo.AssertExpectations(t)
 }
 
@@ -209,7 +594,7 @@ func TestGetOriginalURL_FromDatabase(t *testing.T) {
 	mockAnalyticsRepo := new(MockAnalyticsRepository)
 	logger := zap.NewNop()
 
-	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, logger, "http://localhost:8080")
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
 
 	shortCode := "abc123"
 	expectedURL := "https://www.example.com"
@@ -222,89 +607,966 @@ func TestGetOriginalURL_FromDatabase(t *testing.T) {
 		UpdatedAt:   time.Now(),
 	}
 
-	mockCacheRepo.On("Get", mock.Anything, shortCode).Return("", errors.New("not found"))
+	mockCacheRepo.On("Get", mock.Anything, testKeys.Link(shortCode)).Return("", domain.ErrCacheMiss)
+	mockCacheRepo.On("Exists", mock.Anything, testKeys.Negative(shortCode)).Return(false, nil)
 	mockURLRepo.On("GetByShortCode", mock.Anything, shortCode).Return(urlEntity, nil)
-	mockCacheRepo.On("Set", mock.Anything, shortCode, expectedURL).Return(nil)
-	mockAnalyticsRepo.On("RecordClick", mock.Anything, mock.AnythingOfType("*domain.Analytics")).Return(nil)
-	mockURLRepo.On("IncrementClickCount", mock.Anything, shortCode).Return(nil)
+	mockCacheRepo.On("SetNewer", mock.Anything, testKeys.Link(shortCode), cachedURL("https://www.example.com"), mock.Anything).Return(nil)
 
 	analytics := &domain.Analytics{
 		IPAddress: "127.0.0.1",
 	}
 
-	url, err := service.GetOriginalURL(context.Background(), shortCode, analytics)
+	target, err := service.GetOriginalURL(context.Background(), shortCode, analytics)
 
 	assert.NoError(t, err)
-	assert.Equal(t, expectedURL, url)
-
-	// Wait for async goroutine to complete (analytics and increment)
-	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, expectedURL, target.URL)
+	assert.Equal(t, http.StatusFound, target.StatusCode)
 
 	mockCacheRepo.AssertExpectations(t)
 	mockURLRepo.AssertExpectations(t)
 	mockAnalyticsRepo.AssertExpectations(t)
 }
 
-func TestGetOriginalURL_NotFound(t *testing.T) {
+func TestGetOriginalURL_RedirectPolicy(t *testing.T) {
 	mockURLRepo := new(MockURLRepository)
 	mockCacheRepo := new(MockCacheRepository)
 	mockAnalyticsRepo := new(MockAnalyticsRepository)
 	logger := zap.NewNop()
 
-	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, logger, "http://localhost:8080")
+	cfg := testConfig
+	cfg.DefaultRedirectType = http.StatusMovedPermanently
+	cfg.RedirectCacheMaxAge = time.Hour
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, cfg)
 
-	shortCode := "notfound"
+	expiresAt := time.Now().Add(10 * time.Minute)
+	cached := newCachedLink(&domain.URL{
+		OriginalURL:  "https://www.example.com",
+		RedirectType: http.StatusTemporaryRedirect,
+		ExpiresAt:    &expiresAt,
+	})
 
-	mockCacheRepo.On("Get", mock.Anything, shortCode).Return("", errors.New("not found"))
-	mockURLRepo.On("GetByShortCode", mock.Anything, shortCode).Return(nil, domain.ErrURLNotFound)
+	mockCacheRepo.On("Get", mock.Anything, testKeys.Link("temp")).Return(cached.encode(), nil)
+	mockCacheRepo.On("Get", mock.Anything, testKeys.Link("default")).Return(`{"u":"https://www.example.com"}`, nil)
 
-	analytics := &domain.Analytics{
-		IPAddress: "127.0.0.1",
-	}
+	target, err := service.GetOriginalURL(context.Background(), "temp", &domain.Analytics{})
 
-	url, err := service.GetOriginalURL(context.Background(), shortCode, analytics)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTemporaryRedirect, target.StatusCode)
+	assert.True(t, target.MaxAge > 9*time.Minute && target.MaxAge <= 10*time.Minute)
 
-	assert.Error(t, err)
-	assert.Equal(t, domain.ErrURLNotFound, err)
-	assert.Empty(t, url)
+	target, err = service.GetOriginalURL(context.Background(), "default", &domain.Analytics{})
 
-	mockCacheRepo.AssertExpectations(t)
-	mockURLRepo.AssertExpectations(t)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMovedPermanently, target.StatusCode)
+	assert.Equal(t, time.Hour, target.MaxAge)
 }
 
-func TestGetOriginalURL_Expired(t *testing.T) {
+func TestCreateShortURL_InvalidRedirectType(t *testing.T) {
 	mockURLRepo := new(MockURLRepository)
 	mockCacheRepo := new(MockCacheRepository)
 	mockAnalyticsRepo := new(MockAnalyticsRepository)
 	logger := zap.NewNop()
 
-	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, logger, "http://localhost:8080")
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
 
-	shortCode := "expired"
-	expiresAt := time.Now().Add(-1 * time.Hour)
+	req := &CreateURLRequest{
+		OriginalURL:  "https://www.example.com",
+		RedirectType: http.StatusOK,
+	}
+
+	resp, err := service.CreateShortURL(context.Background(), req)
+
+	assert.ErrorIs(t, err, domain.ErrInvalidRedirect)
+	assert.Nil(t, resp)
+	mockURLRepo.AssertNotCalled(t, "Create", mock.Anything, mock.Anything)
+}
+
+func TestGetOriginalURL_CachedRecordHonorsExpiryAndStatus(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	mockClicks := new(MockClickRecorder)
+	logger := zap.NewNop()
+
+	cfg := testConfig
+	cfg.ClickRecorder = mockClicks
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, cfg)
+
+	expiredAt := time.Now().Add(-time.Minute)
+	expired := newCachedLink(&domain.URL{OriginalURL: "https://www.example.com", ExpiresAt: &expiredAt})
+	disabled := newCachedLink(&domain.URL{OriginalURL: "https://www.example.com", Status: domain.LinkStatusDisabled})
+
+	mockCacheRepo.On("Get", mock.Anything, testKeys.Link("expired")).Return(expired.encode(), nil)
+	mockCacheRepo.On("Get", mock.Anything, testKeys.Link("disabled")).Return(disabled.encode(), nil)
+
+	target, err := service.GetOriginalURL(context.Background(), "expired", &domain.Analytics{})
+
+	assert.Equal(t, domain.ErrExpiredURL, err)
+	assert.Nil(t, target)
+
+	target, err = service.GetOriginalURL(context.Background(), "disabled", &domain.Analytics{})
 
+	assert.Equal(t, domain.ErrURLDisabled, err)
+	assert.Nil(t, target)
+
+	mockURLRepo.AssertNotCalled(t, "GetByShortCode", mock.Anything, mock.Anything)
+	mockClicks.AssertNotCalled(t, "Record", mock.Anything)
+}
+
+func TestGetOriginalURL_CacheTTLCappedAtExpiry(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	logger := zap.NewNop()
+
+	cfg := testConfig
+	cfg.CacheTTL = 24 * time.Hour
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, cfg)
+
+	expiresAt := time.Now().Add(time.Minute)
 	urlEntity := &domain.URL{
-		ID:          1,
-		ShortCode:   shortCode,
+		ShortCode:   "soon",
 		OriginalURL: "https://www.example.com",
-		CreatedAt:   time.Now().Add(-2 * time.Hour),
-		UpdatedAt:   time.Now().Add(-2 * time.Hour),
 		ExpiresAt:   &expiresAt,
 	}
 
-	mockCacheRepo.On("Get", mock.Anything, shortCode).Return("", errors.New("not found"))
-	mockURLRepo.On("GetByShortCode", mock.Anything, shortCode).Return(urlEntity, nil)
-
-	analytics := &domain.Analytics{
-		IPAddress: "127.0.0.1",
-	}
+	mockCacheRepo.On("Get", mock.Anything, testKeys.Link("soon")).Return("", domain.ErrCacheMiss)
+	mockCacheRepo.On("Exists", mock.Anything, testKeys.Negative("soon")).Return(false, nil)
+	mockURLRepo.On("GetByShortCode", mock.Anything, "soon").Return(urlEntity, nil)
+	mockCacheRepo.On("SetNewer", mock.Anything, testKeys.Link("soon"), mock.Anything, mock.MatchedBy(func(ttl time.Duration) bool {
+		return ttl > 0 && ttl <= time.Minute
+	})).Return(nil)
 
-	url, err := service.GetOriginalURL(context.Background(), shortCode, analytics)
+	target, err := service.GetOriginalURL(context.Background(), "soon", &domain.Analytics{})
 
-	assert.Error(t, err)
-	assert.Equal(t, domain.ErrExpiredURL, err)
-	assert.Empty(t, url)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://www.example.com", target.URL)
 
 	mockCacheRepo.AssertExpectations(t)
-	mockURLRepo.AssertExpectations(t)
+}
+
+func TestGetOriginalURL_CodeFilterAndNegativeCache(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	logger := zap.NewNop()
+
+	filter := bloom.New(100, 0.01)
+	require.NoError(t, filter.Rebuild(context.Background(), func(ctx context.Context, add func(string)) error {
+		add("probed")
+
+		return nil
+	}))
+
+	cfg := testConfig
+	cfg.CodeFilter = filter
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, cfg)
+
+	mockCacheRepo.On("Get", mock.Anything, testKeys.Link("probed")).Return("", domain.ErrCacheMiss)
+	mockCacheRepo.On("Exists", mock.Anything, testKeys.Negative("probed")).Return(true, nil)
+
+	_, err := service.GetOriginalURL(context.Background(), "absent", &domain.Analytics{})
+	assert.Equal(t, domain.ErrURLNotFound, err)
+
+	_, err = service.GetOriginalURL(context.Background(), "probed", &domain.Analytics{})
+	assert.Equal(t, domain.ErrURLNotFound, err)
+
+	// Codes the filter does not hold never reach the cache or the database.
+	mockCacheRepo.AssertNotCalled(t, "Get", mock.Anything, testKeys.Link("absent"))
+	mockCacheRepo.AssertNotCalled(t, "Exists", mock.Anything, testKeys.Negative("absent"))
+	mockURLRepo.AssertNotCalled(t, "GetByShortCode", mock.Anything, mock.Anything)
+}
+
+func TestCreateShortURL_SkipsCodesInFilter(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	mockGenerator := new(MockShortCodeGenerator)
+	logger := zap.NewNop()
+
+	filter := bloom.New(100, 0.01)
+	require.NoError(t, filter.Rebuild(context.Background(), func(ctx context.Context, add func(string)) error {
+		add("taken00")
+
+		return nil
+	}))
+
+	cfg := testConfig
+	cfg.CodeFilter = filter
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, mockGenerator, logger, cfg)
+
+	mockGenerator.On("Generate", mock.Anything).Return("taken00", nil).Once()
+	mockGenerator.On("Generate", mock.Anything).Return("free000", nil).Once()
+	mockURLRepo.On("Create", mock.Anything, mock.MatchedBy(func(u *domain.URL) bool {
+		return u.ShortCode == "free000"
+	})).Return(nil)
+	mockCacheRepo.On("SetNewer", mock.Anything, testKeys.Link("free000"), mock.Anything, mock.Anything).Return(nil)
+
+	resp, err := service.CreateShortURL(context.Background(), &CreateURLRequest{OriginalURL: "https://www.example.com"})
+
+	require.NoError(t, err)
+	assert.Equal(t, "free000", resp.ShortCode)
+	assert.True(t, filter.MayContain("free000"))
+	mockURLRepo.AssertNumberOfCalls(t, "Create", 1)
+}
+
+func TestGetOriginalURL_CoalescesConcurrentMisses(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	logger := zap.NewNop()
+
+	mockClicks := new(MockClickRecorder)
+	cfg := testConfig
+	cfg.ClickRecorder = mockClicks
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, cfg)
+
+	shortCode := "hot"
+	release := make(chan time.Time)
+
+	mockCacheRepo.On("Get", mock.Anything, testKeys.Link(shortCode)).Return("", domain.ErrCacheMiss)
+	mockCacheRepo.On("Exists", mock.Anything, testKeys.Negative(shortCode)).Return(false, nil)
+	mockURLRepo.On("GetByShortCode", mock.Anything, shortCode).
+		WaitUntil(release).
+		Return(&domain.URL{ShortCode: shortCode, OriginalURL: "https://www.example.com"}, nil)
+	mockCacheRepo.On("SetNewer", mock.Anything, testKeys.Link(shortCode), mock.Anything, mock.Anything).Return(nil)
+	mockClicks.On("Record", mock.Anything).Return()
+
+	const workers = 20
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+
+			target, err := service.GetOriginalURL(context.Background(), shortCode, &domain.Analytics{})
+			assert.NoError(t, err)
+			assert.Equal(t, "https://www.example.com", target.URL)
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	mockURLRepo.AssertNumberOfCalls(t, "GetByShortCode", 1)
+	mockClicks.AssertNumberOfCalls(t, "Record", workers)
+}
+
+func TestShouldRefresh_NearExpiry(t *testing.T) {
+	cfg := testConfig
+	cfg.EarlyRefreshBeta = 1
+	service := NewURLService(nil, nil, nil, nil, zap.NewNop(), cfg)
+
+	now := time.Now()
+	link := cachedLink{OriginalURL: "https://www.example.com", LoadTime: time.Second.Microseconds()}
+
+	link.CacheExpiresAt = now.Add(time.Hour).UnixMilli()
+	assert.False(t, service.shouldRefresh(link, now))
+
+	link.CacheExpiresAt = now.Add(-time.Millisecond).UnixMilli()
+	assert.True(t, service.shouldRefresh(link, now))
+
+	link.LoadTime = 0
+	assert.False(t, service.shouldRefresh(link, now))
+}
+
+func TestGetOriginalURL_NotFound(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	logger := zap.NewNop()
+
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
+
+	shortCode := "notfound"
+
+	mockCacheRepo.On("Get", mock.Anything, testKeys.Link(shortCode)).Return("", domain.ErrCacheMiss)
+	mockCacheRepo.On("Exists", mock.Anything, testKeys.Negative(shortCode)).Return(false, nil)
+	mockURLRepo.On("GetByShortCode", mock.Anything, shortCode).Return(nil, domain.ErrURLNotFound)
+	mockCacheRepo.On("SetWithTTL", mock.Anything, testKeys.Negative(shortCode), "1", 30*time.Second).Return(nil)
+
+	analytics := &domain.Analytics{
+		IPAddress: "127.0.0.1",
+	}
+
+	target, err := service.GetOriginalURL(context.Background(), shortCode, analytics)
+
+	assert.Error(t, err)
+	assert.Equal(t, domain.ErrURLNotFound, err)
+	assert.Nil(t, target)
+
+	mockCacheRepo.AssertExpectations(t)
+	mockURLRepo.AssertExpectations(t)
+}
+
+func TestGetOriginalURL_Expired(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	logger := zap.NewNop()
+
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
+
+	shortCode := "expired"
+	expiresAt := time.Now().Add(-1 * time.Hour)
+
+	urlEntity := &domain.URL{
+		ID:          1,
+		ShortCode:   shortCode,
+		OriginalURL: "https://www.example.com",
+		CreatedAt:   time.Now().Add(-2 * time.Hour),
+		UpdatedAt:   time.Now().Add(-2 * time.Hour),
+		ExpiresAt:   &expiresAt,
+	}
+
+	mockCacheRepo.On("Get", mock.Anything, testKeys.Link(shortCode)).Return("", domain.ErrCacheMiss)
+	mockCacheRepo.On("Exists", mock.Anything, testKeys.Negative(shortCode)).Return(false, nil)
+	mockURLRepo.On("GetByShortCode", mock.Anything, shortCode).Return(urlEntity, nil)
+
+	analytics := &domain.Analytics{
+		IPAddress: "127.0.0.1",
+	}
+
+	target, err := service.GetOriginalURL(context.Background(), shortCode, analytics)
+
+	assert.Error(t, err)
+	assert.Equal(t, domain.ErrExpiredURL, err)
+	assert.Nil(t, target)
+
+	mockCacheRepo.AssertExpectations(t)
+	mockURLRepo.AssertExpectations(t)
+}
+
+func TestUpdateURL_Success(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	logger := zap.NewNop()
+
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
+
+	shortCode := "abc123"
+	expiresAt := time.Now().Add(time.Hour)
+
+	urlEntity := &domain.URL{
+		ID:          1,
+		ShortCode:   shortCode,
+		OriginalURL: "https://www.example.com",
+		CreatedAt:   time.Now().Add(-time.Hour),
+		UpdatedAt:   time.Now().Add(-time.Hour),
+		ExpiresAt:   &expiresAt,
+		Metadata: map[string]interface{}{
+			"campaign": "summer-sale",
+			"owner":    "marketing",
+		},
+	}
+
+	newURL := "https://www.example.org"
+	noExpiry := int64(0)
+	req := &UpdateURLRequest{
+		OriginalURL: &newURL,
+		ExpiresIn:   &noExpiry,
+		Metadata: map[string]interface{}{
+			"campaign": "winter-sale",
+			"owner":    nil,
+		},
+	}
+
+	mockURLRepo.On("Update", mock.Anything, shortCode).Return(urlEntity, nil)
+	mockCacheRepo.On("Delete", mock.Anything, testKeys.Link(shortCode)).Return(nil)
+	mockCacheRepo.On("SetNewer", mock.Anything, testKeys.Link(shortCode), cachedURL(newURL), mock.Anything).Return(nil)
+
+	resp, err := service.UpdateURL(context.Background(), shortCode, req)
+
+	assert.NoError(t, err)
+	assert.NotNil(t, resp)
+	assert.Equal(t, newURL, resp.OriginalURL)
+	assert.Nil(t, resp.ExpiresAt)
+	assert.Equal(t, map[string]interface{}{"campaign": "winter-sale"}, resp.Metadata)
+
+	mockURLRepo.AssertExpectations(t)
+	mockCacheRepo.AssertExpectations(t)
+}
+
+func TestGetOriginalURL_CachesVersionOfWhatItRead(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	logger := zap.NewNop()
+
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
+
+	shortCode := "abc123"
+	readAt := time.Now().Add(-time.Second)
+
+	// The cache keeps whatever record is newer than the one read, such as
+	// one cached by an update committed in the meantime.
+	mockCacheRepo.On("Get", mock.Anything, testKeys.Link(shortCode)).Return("", domain.ErrCacheMiss)
+	mockCacheRepo.On("Exists", mock.Anything, testKeys.Negative(shortCode)).Return(false, nil)
+	mockURLRepo.On("GetByShortCode", mock.Anything, shortCode).
+		Return(&domain.URL{ShortCode: shortCode, OriginalURL: "https://www.example.com", UpdatedAt: readAt}, nil)
+	mockCacheRepo.On("SetNewer", mock.Anything, testKeys.Link(shortCode), mock.MatchedBy(func(value string) bool {
+		link, ok := decodeCachedLink(value)
+
+		return ok && link.Version == readAt.UnixMicro()
+	}), time.Duration(0)).Return(nil)
+
+	target, err := service.GetOriginalURL(context.Background(), shortCode, &domain.Analytics{})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "https://www.example.com", target.URL)
+	mockCacheRepo.AssertExpectations(t)
+}
+
+func TestUpdateURL_CacheUnavailableAfterCommit(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	logger := zap.NewNop()
+
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
+
+	disabled := domain.LinkStatusDisabled
+	mockURLRepo.On("Update", mock.Anything, "abc123").Return(&domain.URL{ShortCode: "abc123", OriginalURL: "https://www.example.com"}, nil)
+	mockCacheRepo.On("Delete", mock.Anything, testKeys.Link("abc123")).Return(domain.ErrCacheUnavailable)
+	mockCacheRepo.On("SetNewer", mock.Anything, testKeys.Link("abc123"), mock.Anything, mock.Anything).Return(domain.ErrCacheUnavailable)
+
+	resp, err := service.UpdateURL(context.Background(), "abc123", &UpdateURLRequest{Status: &disabled})
+
+	require.NoError(t, err)
+	assert.Equal(t, domain.LinkStatusDisabled, resp.Status)
+	mockURLRepo.AssertExpectations(t)
+}
+
+func TestUpdateURL_InvalidURL(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	logger := zap.NewNop()
+
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
+
+	shortCode := "abc123"
+	invalidURL := "invalid-url"
+	req := &UpdateURLRequest{
+		OriginalURL: &invalidURL,
+	}
+
+	resp, err := service.UpdateURL(context.Background(), shortCode, req)
+
+	assert.Error(t, err)
+	assert.Equal(t, domain.ErrInvalidURL, err)
+	assert.Nil(t, resp)
+
+	mockURLRepo.AssertNotCalled(t, "Update", mock.Anything, mock.Anything)
+	mockCacheRepo.AssertNotCalled(t, "Delete", mock.Anything, mock.Anything)
+}
+
+func TestUpdateURL_NotFound(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	logger := zap.NewNop()
+
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
+
+	shortCode := "notfound"
+
+	mockURLRepo.On("Update", mock.Anything, shortCode).Return(nil, domain.ErrURLNotFound)
+
+	resp, err := service.UpdateURL(context.Background(), shortCode, &UpdateURLRequest{})
+
+	assert.Error(t, err)
+	assert.Equal(t, domain.ErrURLNotFound, err)
+	assert.Nil(t, resp)
+
+	mockURLRepo.AssertExpectations(t)
+}
+
+func TestListURLs_AppliesDefaults(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	logger := zap.NewNop()
+
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
+
+	page := &domain.URLPage{
+		Items:      []*domain.URL{{ShortCode: "abc123", OriginalURL: "https://www.example.com"}},
+		NextCursor: "next",
+	}
+
+	mockURLRepo.On("List", mock.Anything, domain.URLFilter{
+		SortBy: domain.SortByCreatedAt,
+		Limit:  defaultListLimit,
+	}).Return(page, nil)
+
+	result, err := service.ListURLs(context.Background(), domain.URLFilter{})
+
+	assert.NoError(t, err)
+	assert.Equal(t, page, result)
+
+	mockURLRepo.AssertExpectations(t)
+}
+
+func TestListURLs_InvalidFilter(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	logger := zap.NewNop()
+
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
+
+	result, err := service.ListURLs(context.Background(), domain.URLFilter{SortBy: "original_url"})
+
+	assert.Error(t, err)
+	assert.Equal(t, domain.ErrInvalidFilter, err)
+	assert.Nil(t, result)
+
+	mockURLRepo.AssertNotCalled(t, "List", mock.Anything, mock.Anything)
+}
+
+func TestCreateShortURLBatch_PartialSuccess(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	logger := zap.NewNop()
+
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
+
+	req := &BatchCreateRequest{
+		Items: []CreateURLRequest{
+			{OriginalURL: "https://www.example.com/a", CustomCode: "taken"},
+			{OriginalURL: "invalid-url"},
+			{OriginalURL: "https://www.example.com/b"},
+		},
+	}
+
+	mockURLRepo.On("CreateBatch", mock.Anything, mock.MatchedBy(func(urls []*domain.URL) bool {
+		return len(urls) == 2
+	}), false).Return([]error{domain.ErrShortCodeExists, nil}, nil)
+	mockCacheRepo.On("SetMany", mock.Anything, mock.MatchedBy(func(entries []domain.CacheEntry) bool {
+		if len(entries) != 1 {
+			return false
+		}
+		link, ok := decodeCachedLink(entries[0].Value.(string))
+
+		return ok && link.OriginalURL == "https://www.example.com/b"
+	})).Return(nil)
+
+	resp, err := service.CreateShortURLBatch(context.Background(), req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, resp.Created)
+	assert.Equal(t, 2, resp.Failed)
+	assert.Equal(t, "code_taken", resp.Items[0].Error.Code)
+	assert.Equal(t, "invalid_url", resp.Items[1].Error.Code)
+	assert.Nil(t, resp.Items[2].Error)
+	assert.Equal(t, "https://www.example.com/b", resp.Items[2].Result.OriginalURL)
+
+	mockURLRepo.AssertExpectations(t)
+	mockCacheRepo.AssertExpectations(t)
+}
+
+func TestCreateShortURLBatch_AtomicAbortsOnInvalidItem(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	logger := zap.NewNop()
+
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
+
+	req := &BatchCreateRequest{
+		Items: []CreateURLRequest{
+			{OriginalURL: "https://www.example.com/a"},
+			{OriginalURL: "invalid-url"},
+		},
+		Atomic: true,
+	}
+
+	resp, err := service.CreateShortURLBatch(context.Background(), req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 0, resp.Created)
+	assert.Equal(t, 2, resp.Failed)
+	assert.Equal(t, "aborted", resp.Items[0].Error.Code)
+	assert.Equal(t, "invalid_url", resp.Items[1].Error.Code)
+
+	mockURLRepo.AssertNotCalled(t, "CreateBatch", mock.Anything, mock.Anything, mock.Anything)
+	mockCacheRepo.AssertNotCalled(t, "SetMany", mock.Anything, mock.Anything)
+}
+
+func TestCreateShortURLBatch_TooLarge(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	logger := zap.NewNop()
+
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
+
+	req := &BatchCreateRequest{
+		Items: make([]CreateURLRequest, maxBatchSize+1),
+	}
+
+	resp, err := service.CreateShortURLBatch(context.Background(), req)
+
+	assert.Error(t, err)
+	assert.Equal(t, domain.ErrBatchTooLarge, err)
+	assert.Nil(t, resp)
+}
+
+func TestExportURLs_CSV(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	logger := zap.NewNop()
+
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
+
+	createdAt := time.Date(2024, 2, 22, 10, 30, 0, 0, time.UTC)
+	urls := []*domain.URL{
+		{
+			ShortCode:   "abc123",
+			OriginalURL: "https://www.example.com",
+			CreatedAt:   createdAt,
+			UpdatedAt:   createdAt,
+			ClickCount:  42,
+			Metadata:    map[string]interface{}{"campaign": "summer-sale"},
+		},
+	}
+
+	mockURLRepo.On("ForEach", mock.Anything, mock.Anything).Return(urls, nil)
+
+	var buf bytes.Buffer
+	err := service.ExportURLs(context.Background(), &buf, transfer.FormatCSV)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "short_code,original_url,created_at,updated_at,expires_at,click_count,metadata,redirect_type,status\n"+
+		"abc123,https://www.example.com,2024-02-22T10:30:00Z,2024-02-22T10:30:00Z,,42,\"{\"\"campaign\"\":\"\"summer-sale\"\"}\",,\n", buf.String())
+
+	mockURLRepo.AssertExpectations(t)
+}
+
+func TestImportURLs_BitlyRejectsInvalidRecords(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	logger := zap.NewNop()
+
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
+
+	input := "link,long_url,title,created_at,clicks\n" +
+		"https://bit.ly/abc123,https://www.example.com,Example,2024-02-22 10:30:00,17\n" +
+		"https://bit.ly/bad,not-a-url,Broken,2024-02-22 10:30:00,3\n"
+
+	mockURLRepo.On("Import", mock.Anything, mock.Anything, domain.ConflictOverwrite).Return(&domain.ImportResult{}, nil)
+	mockCacheRepo.On("Delete", mock.Anything, testKeys.Link("abc123")).Return(nil)
+
+	result, err := service.ImportURLs(context.Background(), strings.NewReader(input), transfer.FormatBitly, domain.ConflictOverwrite)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.Updated)
+	assert.Equal(t, []domain.ImportRejection{{Record: 2, Reason: domain.ErrInvalidURL.Error()}}, result.Rejected)
+
+	mockURLRepo.AssertExpectations(t)
+	mockCacheRepo.AssertExpectations(t)
+}
+
+func TestImportURLs_ForgetsCodesCachedAsMissing(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	logger := zap.NewNop()
+
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
+
+	input := "link,long_url,title,created_at,clicks\n" +
+		"https://bit.ly/abc123,https://www.example.com,Example,2024-02-22 10:30:00,17\n"
+
+	mockURLRepo.On("Import", mock.Anything, mock.Anything, domain.ConflictSkip).Return(&domain.ImportResult{}, nil)
+	mockCacheRepo.On("Delete", mock.Anything, testKeys.Negative("abc123")).Return(nil)
+
+	result, err := service.ImportURLs(context.Background(), strings.NewReader(input), transfer.FormatBitly, domain.ConflictSkip)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.Created)
+
+	mockURLRepo.AssertExpectations(t)
+	mockCacheRepo.AssertExpectations(t)
+}
+
+func TestFlushCache_MovesLinksToNewGeneration(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	mockGenerations := new(MockCacheGenerationStore)
+	logger := zap.NewNop()
+
+	keys := cachekey.New("test")
+	cfg := testConfig
+	cfg.CacheKeys = keys
+	cfg.CacheGenerations = mockGenerations
+	service := NewURLService(mockURLRepo, mockCacheRepo, mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, cfg)
+
+	mockGenerations.On("Bump", mock.Anything).Return(int64(7), nil)
+	mockCacheRepo.On("Get", mock.Anything, "test:link:v1:g7:abc123").Return(`{"u":"https://www.example.com"}`, nil)
+
+	generation, err := service.FlushCache(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), generation)
+
+	target, err := service.GetOriginalURL(context.Background(), "abc123", &domain.Analytics{})
+	require.NoError(t, err)
+	assert.Equal(t, "https://www.example.com", target.URL)
+
+	mockGenerations.AssertExpectations(t)
+	mockCacheRepo.AssertExpectations(t)
+}
+
+func TestFlushCache_StoreUnavailable(t *testing.T) {
+	mockGenerations := new(MockCacheGenerationStore)
+	logger := zap.NewNop()
+
+	keys := cachekey.New("")
+	cfg := testConfig
+	cfg.CacheKeys = keys
+	cfg.CacheGenerations = mockGenerations
+	service := NewURLService(new(MockURLRepository), new(MockCacheRepository), new(MockAnalyticsRepository), shortcode.NewRandom(shortcode.Base62, 7), logger, cfg)
+
+	mockGenerations.On("Bump", mock.Anything).Return(int64(0), errors.New("redis down"))
+
+	_, err := service.FlushCache(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, int64(0), keys.Generation())
+}
+
+func TestWarmCache_LoadsTopLinks(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	logger := zap.NewNop()
+
+	cfg := testConfig
+	cfg.WarmupSize = 3
+	cfg.WarmupWindow = time.Hour
+	service := NewURLService(mockURLRepo, mockCacheRepo, new(MockAnalyticsRepository), shortcode.NewRandom(shortcode.Base62, 7), logger, cfg)
+
+	soon := time.Now().Add(time.Minute)
+	mockURLRepo.On("TopURLs", mock.Anything, 3, mock.MatchedBy(func(since *time.Time) bool {
+		return since != nil && time.Since(*since) >= time.Hour
+	})).Return([]*domain.URL{
+		{ShortCode: "hot", OriginalURL: "https://www.example.com/hot"},
+		{ShortCode: "soon", OriginalURL: "https://www.example.com/soon", ExpiresAt: &soon},
+	}, nil)
+	mockCacheRepo.On("SetMany", mock.Anything, mock.MatchedBy(func(entries []domain.CacheEntry) bool {
+		return len(entries) == 2 &&
+			entries[0].Key == testKeys.Link("hot") && entries[0].TTL == 0 &&
+			entries[1].Key == testKeys.Link("soon") && entries[1].TTL > 0 && entries[1].TTL <= time.Minute
+	})).Return(nil)
+
+	result, err := service.WarmCache(context.Background(), 0)
+
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Loaded)
+	mockURLRepo.AssertExpectations(t)
+	mockCacheRepo.AssertExpectations(t)
+}
+
+func TestWarmCache_CacheFailure(t *testing.T) {
+	mockURLRepo := new(MockURLRepository)
+	mockCacheRepo := new(MockCacheRepository)
+	logger := zap.NewNop()
+
+	service := NewURLService(mockURLRepo, mockCacheRepo, new(MockAnalyticsRepository), shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
+
+	mockURLRepo.On("TopURLs", mock.Anything, defaultWarmupSize, (*time.Time)(nil)).Return([]*domain.URL{
+		{ShortCode: "hot", OriginalURL: "https://www.example.com/hot"},
+	}, nil)
+	mockCacheRepo.On("SetMany", mock.Anything, mock.Anything).Return(domain.ErrCacheUnavailable)
+
+	_, err := service.WarmCache(context.Background(), 0)
+	assert.ErrorIs(t, err, domain.ErrCacheUnavailable)
+
+	// A failed warm-up must not block the next one.
+	_, err = service.WarmCache(context.Background(), 0)
+	assert.ErrorIs(t, err, domain.ErrCacheUnavailable)
+}
+
+func TestGetStats_AddsPendingClicks(t *testing.T) {
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	mockCounter := new(MockClickCounter)
+	logger := zap.NewNop()
+
+	cfg := testConfig
+	cfg.ClickCounter = mockCounter
+	service := NewURLService(new(MockURLRepository), new(MockCacheRepository), mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, cfg)
+
+	mockAnalyticsRepo.On("GetStats", mock.Anything, "abc123", false).Return(&domain.URLStats{ShortCode: "abc123", ClickCount: 10}, nil).Once()
+	mockAnalyticsRepo.On("GetStats", mock.Anything, "abc123", false).Return(&domain.URLStats{ShortCode: "abc123", ClickCount: 10}, nil).Once()
+	mockCounter.On("Pending", mock.Anything, "abc123").Return(int64(4), nil).Once()
+	mockCounter.On("Pending", mock.Anything, "abc123").Return(int64(0), errors.New("redis down")).Once()
+
+	stats, err := service.GetStats(context.Background(), "abc123", false)
+	require.NoError(t, err)
+	assert.Equal(t, int64(14), stats.ClickCount)
+
+	// Without Redis the persisted count is still served.
+	stats, err = service.GetStats(context.Background(), "abc123", false)
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), stats.ClickCount)
+}
+
+func TestGetTimeSeries_ZeroFillsBucketsInTimezone(t *testing.T) {
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	logger := zap.NewNop()
+
+	service := NewURLService(new(MockURLRepository), new(MockCacheRepository), mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+
+	// The clocks went back on 2023-10-29, which makes that day 25 hours long.
+	from := time.Date(2023, 10, 28, 15, 0, 0, 0, berlin)
+	to := time.Date(2023, 10, 31, 0, 0, 0, 0, berlin)
+	visitors := int64(2)
+
+	mockAnalyticsRepo.On("GetTimeSeries", mock.Anything, mock.MatchedBy(func(query domain.TimeSeriesQuery) bool {
+		return query.ShortCode == "abc123" && query.Interval == domain.IntervalDay && query.Unique &&
+			query.From.Equal(time.Date(2023, 10, 28, 0, 0, 0, 0, berlin)) && query.To.Equal(to) &&
+			query.Location.String() == "Europe/Berlin"
+	})).Return([]domain.TimeSeriesPoint{
+		{Start: time.Date(2023, 10, 29, 0, 0, 0, 0, berlin).UTC(), Clicks: 3, UniqueVisitors: &visitors},
+	}, nil)
+
+	series, err := service.GetTimeSeries(context.Background(), TimeSeriesRequest{
+		ShortCode: "abc123",
+		From:      &from,
+		To:        &to,
+		Interval:  domain.IntervalDay,
+		Timezone:  "Europe/Berlin",
+		Unique:    true,
+	})
+	require.NoError(t, err)
+
+	require.Len(t, series.Points, 3)
+	assert.Equal(t, int64(3), series.Total)
+	assert.True(t, series.Points[2].Start.Equal(time.Date(2023, 10, 30, 0, 0, 0, 0, berlin)))
+	assert.Equal(t, []int64{0, 3, 0}, []int64{series.Points[0].Clicks, series.Points[1].Clicks, series.Points[2].Clicks})
+	assert.Equal(t, int64(2), *series.Points[1].UniqueVisitors)
+	assert.Equal(t, int64(0), *series.Points[0].UniqueVisitors)
+}
+
+func TestGetTimeSeries_InvalidQuery(t *testing.T) {
+	logger := zap.NewNop()
+	service := NewURLService(new(MockURLRepository), new(MockCacheRepository), new(MockAnalyticsRepository), shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
+
+	now := time.Now()
+	yearAgo := now.AddDate(-1, 0, 0)
+
+	_, err := service.GetTimeSeries(context.Background(), TimeSeriesRequest{ShortCode: "abc123", Interval: "second"})
+	assert.ErrorIs(t, err, domain.ErrInvalidInterval)
+
+	_, err = service.GetTimeSeries(context.Background(), TimeSeriesRequest{ShortCode: "abc123", Interval: domain.IntervalHour, Unique: true})
+	assert.ErrorIs(t, err, domain.ErrUniqueInterval)
+
+	_, err = service.GetTimeSeries(context.Background(), TimeSeriesRequest{ShortCode: "abc123", Timezone: "Mars/Olympus"})
+	assert.ErrorIs(t, err, domain.ErrInvalidTimezone)
+
+	_, err = service.GetTimeSeries(context.Background(), TimeSeriesRequest{ShortCode: "abc123", From: &now, To: &yearAgo})
+	assert.ErrorIs(t, err, domain.ErrInvalidTimeRange)
+
+	_, err = service.GetTimeSeries(context.Background(), TimeSeriesRequest{ShortCode: "abc123", From: &yearAgo, Interval: domain.IntervalMinute})
+	assert.ErrorIs(t, err, domain.ErrInvalidTimeRange)
+}
+
+func TestTruncateToInterval_WeekStartsOnMonday(t *testing.T) {
+	sunday := time.Date(2024, 3, 10, 18, 30, 0, 0, time.UTC)
+
+	assert.Equal(t, time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC), truncateToInterval(sunday, domain.IntervalWeek, time.UTC))
+	assert.Equal(t, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), truncateToInterval(sunday, domain.IntervalMonth, time.UTC))
+}
+
+func TestGetBreakdown_ComputesPercentages(t *testing.T) {
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	logger := zap.NewNop()
+
+	service := NewURLService(new(MockURLRepository), new(MockCacheRepository), mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
+
+	mockAnalyticsRepo.On("GetBreakdown", mock.Anything, mock.MatchedBy(func(query domain.BreakdownQuery) bool {
+		return query.Dimension == domain.DimensionReferrer && query.Limit == maxBreakdownLimit &&
+			query.To.Sub(query.From) == defaultBreakdownPeriod
+	})).Return([]domain.BreakdownItem{
+		{Value: "twitter.com", Clicks: 2},
+		{Value: "(direct)", Clicks: 1},
+	}, int64(3), nil)
+
+	breakdown, err := service.GetBreakdown(context.Background(), BreakdownRequest{
+		ShortCode: "abc123",
+		Dimension: domain.DimensionReferrer,
+		Limit:     1000,
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(3), breakdown.Total)
+	assert.Equal(t, 66.67, breakdown.Items[0].Percentage)
+	assert.Equal(t, 33.33, breakdown.Items[1].Percentage)
+
+	_, err = service.GetBreakdown(context.Background(), BreakdownRequest{ShortCode: "abc123", Dimension: "language"})
+	assert.ErrorIs(t, err, domain.ErrInvalidDimension)
+}
+
+func TestBackfillClickDetails_EnrichesInBatches(t *testing.T) {
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	logger := zap.NewNop()
+
+	service := NewURLService(new(MockURLRepository), new(MockCacheRepository), mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, testConfig)
+
+	mockAnalyticsRepo.On("ListUnenrichedClicks", mock.Anything, int64(0), 2).Return([]*domain.Analytics{
+		{ID: 1, UserAgent: "curl/8.0.1"},
+		{ID: 5, Referer: "https://www.reddit.com/r/golang"},
+	}, nil)
+	mockAnalyticsRepo.On("ListUnenrichedClicks", mock.Anything, int64(5), 2).Return([]*domain.Analytics{}, nil)
+	mockAnalyticsRepo.On("UpdateClickDetails", mock.Anything, mock.MatchedBy(func(clicks []*domain.Analytics) bool {
+		return clicks[0].IsBot && clicks[0].Device == "bot" && clicks[1].ReferrerDomain == "reddit.com"
+	})).Return(nil)
+
+	updated, err := service.BackfillClickDetails(context.Background(), 2, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, updated)
+	mockAnalyticsRepo.AssertExpectations(t)
+}
+
+func TestEraseClicks_MatchesEveryStoredForm(t *testing.T) {
+	mockAnalyticsRepo := new(MockAnalyticsRepository)
+	logger := zap.NewNop()
+
+	policy, err := privacy.NewPolicy(privacy.Options{IPMode: privacy.IPHash, HashKey: "secret"})
+	require.NoError(t, err)
+	hashed, _ := policy.StoredIPs("81.2.69.160")
+
+	cfg := testConfig
+	cfg.Privacy = policy
+	service := NewURLService(new(MockURLRepository), new(MockCacheRepository), mockAnalyticsRepo, shortcode.NewRandom(shortcode.Base62, 7), logger, cfg)
+
+	mockAnalyticsRepo.On("EraseClicks", mock.Anything, append(hashed, "abcdef")).Return(int64(3), nil)
+
+	erased, err := service.EraseClicks(context.Background(), EraseClicksRequest{IP: "81.2.69.160", VisitorHash: "ABCDEF"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), erased)
+
+	// Neighbours' truncated clicks only go when the network is asked for.
+	assert.NotContains(t, hashed, "81.2.69.0")
+	mockAnalyticsRepo.On("EraseClicks", mock.Anything, []string{"81.2.69.0"}).Return(int64(5), nil)
+	erased, err = service.EraseClicks(context.Background(), EraseClicksRequest{Network: "81.2.69.160"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), erased)
+
+	_, err = service.EraseClicks(context.Background(), EraseClicksRequest{IP: "not an ip"})
+	assert.Equal(t, domain.ErrInvalidErasure, err)
+	_, err = service.EraseClicks(context.Background(), EraseClicksRequest{Network: "not an ip"})
+	assert.Equal(t, domain.ErrInvalidErasure, err)
+	_, err = service.EraseClicks(context.Background(), EraseClicksRequest{})
+	assert.Equal(t, domain.ErrInvalidErasure, err)
+
+	mockAnalyticsRepo.AssertExpectations(t)
 }
@@ -0,0 +1,32 @@
+package shortcode
+
+import (
+	"context"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+)
+
+// Counter encodes the next value of a database sequence, so codes are short,
+// dense and never collide with each other.
+type Counter struct {
+	seq       domain.SequenceRepository
+	alphabet  string
+	minLength int
+}
+
+func NewCounter(seq domain.SequenceRepository, alphabet string, minLength int) *Counter {
+	return &Counter{
+		seq:       seq,
+		alphabet:  alphabet,
+		minLength: minLength,
+	}
+}
+
+func (g *Counter) Generate(ctx context.Context) (string, error) {
+	n, err := g.seq.NextValue(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return encode(uint64(n), g.alphabet, g.minLength), nil
+}
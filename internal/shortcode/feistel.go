@@ -0,0 +1,102 @@
+package shortcode
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+)
+
+const feistelRounds = 4
+
+var ErrCodeSpaceExhausted = errors.New("sequence value does not fit in the code space")
+
+// Feistel turns sequence values into fixed-length codes that look random.
+// A keyed Feistel network is a bijection, so distinct sequence values always
+// map to distinct codes; cycle walking keeps results inside alphabet^length.
+type Feistel struct {
+	seq      domain.SequenceRepository
+	key      []byte
+	alphabet string
+	length   int
+	space    uint64
+	halfBits uint
+}
+
+func NewFeistel(seq domain.SequenceRepository, key []byte, alphabet string, length int) (*Feistel, error) {
+	space := uint64(1)
+	for i := 0; i < length; i++ {
+		hi, lo := bits.Mul64(space, uint64(len(alphabet)))
+		if hi != 0 || lo > math.MaxInt64 {
+			return nil, errors.New("code space is too large for the feistel strategy")
+		}
+		space = lo
+	}
+
+	width := uint(bits.Len64(space - 1))
+	halfBits := (width + 1) / 2
+
+	return &Feistel{
+		seq:      seq,
+		key:      key,
+		alphabet: alphabet,
+		length:   length,
+		space:    space,
+		halfBits: halfBits,
+	}, nil
+}
+
+func (g *Feistel) Generate(ctx context.Context) (string, error) {
+	n, err := g.seq.NextValue(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	code, err := g.Encode(uint64(n))
+	if err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+// Encode maps n to its obfuscated code without consuming a sequence value.
+func (g *Feistel) Encode(n uint64) (string, error) {
+	if n >= g.space {
+		return "", ErrCodeSpaceExhausted
+	}
+
+	x := g.permute(n)
+	for x >= g.space {
+		x = g.permute(x)
+	}
+
+	return encode(x, g.alphabet, g.length), nil
+}
+
+func (g *Feistel) permute(x uint64) uint64 {
+	mask := uint64(1)<<g.halfBits - 1
+	left, right := x>>g.halfBits, x&mask
+
+	for round := 0; round < feistelRounds; round++ {
+		left, right = right, left^(g.round(round, right)&mask)
+	}
+
+	return left<<g.halfBits | right
+}
+
+func (g *Feistel) round(round int, value uint64) uint64 {
+	var buf [9]byte
+	buf[0] = byte(round)
+	binary.BigEndian.PutUint64(buf[1:], value)
+
+	mac := hmac.New(sha256.New, g.key)
+	mac.Write(buf[:])
+
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
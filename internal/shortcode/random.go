@@ -0,0 +1,30 @@
+package shortcode
+
+import (
+	"context"
+)
+
+type Random struct {
+	alphabet string
+	length   int
+}
+
+func NewRandom(alphabet string, length int) *Random {
+	return &Random{
+		alphabet: alphabet,
+		length:   length,
+	}
+}
+
+func (g *Random) Generate(ctx context.Context) (string, error) {
+	code := make([]byte, g.length)
+	for i := range code {
+		idx, err := randomIndex(len(g.alphabet))
+		if err != nil {
+			return "", err
+		}
+		code[i] = g.alphabet[idx]
+	}
+
+	return string(code), nil
+}
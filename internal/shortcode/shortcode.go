@@ -0,0 +1,113 @@
+package shortcode
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+)
+
+const (
+	Base62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	StrategyRandom  = "random"
+	StrategyCounter = "counter"
+	StrategyFeistel = "feistel"
+	StrategyWords   = "words"
+
+	defaultLength    = 7
+	defaultWordCount = 2
+)
+
+var ErrInvalidAlphabet = errors.New("alphabet must contain at least two distinct characters")
+
+type Options struct {
+	Strategy string
+	Length   int
+	Alphabet string
+	// Secret keys the Feistel permutation. Changing it changes every future code.
+	Secret    string
+	WordCount int
+	Separator string
+}
+
+func New(opts Options, seq domain.SequenceRepository) (domain.ShortCodeGenerator, error) {
+	if opts.Alphabet == "" {
+		opts.Alphabet = Base62
+	}
+	if opts.Length <= 0 {
+		opts.Length = defaultLength
+	}
+	if err := validateAlphabet(opts.Alphabet); err != nil {
+		return nil, err
+	}
+
+	switch opts.Strategy {
+	case "", StrategyRandom:
+		return NewRandom(opts.Alphabet, opts.Length), nil
+	case StrategyCounter:
+		return NewCounter(seq, opts.Alphabet, opts.Length), nil
+	case StrategyFeistel:
+		if opts.Secret == "" {
+			return nil, errors.New("feistel strategy requires a secret")
+		}
+
+		return NewFeistel(seq, []byte(opts.Secret), opts.Alphabet, opts.Length)
+	case StrategyWords:
+		if opts.WordCount <= 0 {
+			opts.WordCount = defaultWordCount
+		}
+
+		return NewWords(opts.WordCount, opts.Separator), nil
+	default:
+		return nil, fmt.Errorf("unknown short code strategy %q", opts.Strategy)
+	}
+}
+
+func validateAlphabet(alphabet string) error {
+	seen := make(map[rune]bool, len(alphabet))
+	for _, c := range alphabet {
+		if c > math.MaxInt8 || seen[c] {
+			return ErrInvalidAlphabet
+		}
+		seen[c] = true
+	}
+
+	if len(seen) < 2 {
+		return ErrInvalidAlphabet
+	}
+
+	return nil
+}
+
+// encode writes n in the given alphabet, left-padded to at least minLength.
+func encode(n uint64, alphabet string, minLength int) string {
+	base := uint64(len(alphabet))
+
+	var buf []byte
+	for n > 0 {
+		buf = append(buf, alphabet[n%base])
+		n /= base
+	}
+	for len(buf) < minLength {
+		buf = append(buf, alphabet[0])
+	}
+
+	for i, j := 0, len(buf)-1; i < j; i, j = i+1, j-1 {
+		buf[i], buf[j] = buf[j], buf[i]
+	}
+
+	return string(buf)
+}
+
+func randomIndex(n int) (int, error) {
+	idx, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+
+	return int(idx.Int64()), nil
+}
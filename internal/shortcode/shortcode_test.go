@@ -0,0 +1,119 @@
+package shortcode
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSequence struct {
+	value int64
+}
+
+func (s *fakeSequence) NextValue(ctx context.Context) (int64, error) {
+	return atomic.AddInt64(&s.value, 1), nil
+}
+
+func TestRandom_UsesAlphabetAndLength(t *testing.T) {
+	generator := NewRandom("abc", 12)
+
+	for i := 0; i < 100; i++ {
+		code, err := generator.Generate(context.Background())
+
+		require.NoError(t, err)
+		assert.Len(t, code, 12)
+		assert.Empty(t, strings.Trim(code, "abc"))
+	}
+}
+
+func TestCounter_EncodesSequence(t *testing.T) {
+	generator := NewCounter(&fakeSequence{value: 61}, Base62, 3)
+
+	first, err := generator.Generate(context.Background())
+	require.NoError(t, err)
+	second, err := generator.Generate(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, "010", first)
+	assert.Equal(t, "011", second)
+}
+
+func TestFeistel_IsBijective(t *testing.T) {
+	generator, err := NewFeistel(&fakeSequence{}, []byte("secret"), "0123456789", 3)
+	require.NoError(t, err)
+
+	seen := make(map[string]bool)
+	for n := uint64(0); n < 1000; n++ {
+		code, err := generator.Encode(n)
+		require.NoError(t, err)
+		assert.Len(t, code, 3)
+		seen[code] = true
+	}
+
+	assert.Len(t, seen, 1000)
+
+	_, err = generator.Encode(1000)
+	assert.ErrorIs(t, err, ErrCodeSpaceExhausted)
+}
+
+func TestWords_JoinsWords(t *testing.T) {
+	generator := NewWords(3, "-")
+
+	code, err := generator.Generate(context.Background())
+
+	require.NoError(t, err)
+	assert.Len(t, strings.Split(code, "-"), 3)
+}
+
+func TestNew_RejectsInvalidOptions(t *testing.T) {
+	_, err := New(Options{Alphabet: "aa"}, nil)
+	assert.ErrorIs(t, err, ErrInvalidAlphabet)
+
+	_, err = New(Options{Strategy: StrategyFeistel}, &fakeSequence{})
+	assert.Error(t, err)
+
+	_, err = New(Options{Strategy: "uuid"}, nil)
+	assert.Error(t, err)
+}
+
+func TestValidator_Rules(t *testing.T) {
+	validator := NewValidator(Rules{
+		MinLength: 4,
+		MaxLength: 10,
+		Reserved:  []string{"admin"},
+		Denied:    []string{"spam"},
+	})
+	validator.Reserve("health", "api")
+
+	tests := []struct {
+		code  string
+		valid bool
+	}{
+		{"promo-2024", true},
+		{"abc", false},
+		{"waytoolongcode", false},
+		{"with/slash", false},
+		{"café", false},
+		{"Health", false},
+		{"admin", false},
+		{"nospam", false},
+		{"n0sp4m", false},
+	}
+
+	for _, tt := range tests {
+		err := validator.Validate(tt.code)
+		if tt.valid {
+			assert.NoError(t, err, tt.code)
+			continue
+		}
+
+		var codeErr *domain.ShortCodeError
+		assert.ErrorAs(t, err, &codeErr, tt.code)
+		assert.ErrorIs(t, err, domain.ErrInvalidShortCode, tt.code)
+	}
+}
@@ -0,0 +1,129 @@
+package shortcode
+
+import (
+	_ "embed"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+)
+
+const (
+	// CustomAlphabet is the default set of characters allowed in custom codes.
+	CustomAlphabet = Base62 + "-_"
+
+	defaultMinLength = 3
+	// Matches the width of the short_code column.
+	defaultMaxLength = 32
+)
+
+//go:embed denylist.txt
+var defaultDenyList string
+
+var leetReplacer = strings.NewReplacer("0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s")
+
+type Rules struct {
+	MinLength int
+	MaxLength int
+	Alphabet  string
+	Reserved  []string
+	// Denied words are rejected anywhere inside a code, case-insensitively
+	// and after undoing common digit-for-letter substitutions. The built-in
+	// list is always included.
+	Denied []string
+}
+
+type Validator struct {
+	mu        sync.RWMutex
+	minLength int
+	maxLength int
+	allowed   map[rune]bool
+	reserved  map[string]bool
+	denied    []string
+}
+
+func NewValidator(rules Rules) *Validator {
+	if rules.MinLength <= 0 {
+		rules.MinLength = defaultMinLength
+	}
+	if rules.MaxLength <= 0 || rules.MaxLength > defaultMaxLength {
+		rules.MaxLength = defaultMaxLength
+	}
+	if rules.Alphabet == "" {
+		rules.Alphabet = CustomAlphabet
+	}
+
+	v := &Validator{
+		minLength: rules.MinLength,
+		maxLength: rules.MaxLength,
+		allowed:   make(map[rune]bool, len(rules.Alphabet)),
+		reserved:  make(map[string]bool),
+	}
+
+	for _, c := range rules.Alphabet {
+		v.allowed[c] = true
+	}
+
+	for _, word := range append(strings.Fields(defaultDenyList), rules.Denied...) {
+		if word = strings.ToLower(strings.TrimSpace(word)); word != "" {
+			v.denied = append(v.denied, word)
+		}
+	}
+
+	v.Reserve(rules.Reserved...)
+
+	return v
+}
+
+// Reserve blocks the given words as codes, e.g. top-level route segments
+// that would otherwise be shadowed by or shadow a short link.
+func (v *Validator) Reserve(words ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for _, word := range words {
+		if word = strings.ToLower(strings.TrimSpace(word)); word != "" {
+			v.reserved[word] = true
+		}
+	}
+}
+
+func (v *Validator) Validate(code string) error {
+	length := len([]rune(code))
+	if length < v.minLength {
+		return invalid(code, fmt.Sprintf("must be at least %d characters long", v.minLength))
+	}
+	if length > v.maxLength {
+		return invalid(code, fmt.Sprintf("must be at most %d characters long", v.maxLength))
+	}
+
+	for _, c := range code {
+		if !v.allowed[c] {
+			return invalid(code, fmt.Sprintf("contains the character %q which is not allowed", c))
+		}
+	}
+
+	lower := strings.ToLower(code)
+
+	v.mu.RLock()
+	reserved := v.reserved[lower]
+	v.mu.RUnlock()
+
+	if reserved {
+		return invalid(code, "is reserved")
+	}
+
+	normalized := leetReplacer.Replace(lower)
+	for _, word := range v.denied {
+		if strings.Contains(lower, word) || strings.Contains(normalized, word) {
+			return invalid(code, "contains a blocked word")
+		}
+	}
+
+	return nil
+}
+
+func invalid(code string, reason string) error {
+	return &domain.ShortCodeError{Code: code, Reason: reason}
+}
@@ -0,0 +1,38 @@
+package shortcode
+
+import (
+	"context"
+	_ "embed"
+	"strings"
+)
+
+//go:embed words.txt
+var wordList string
+
+// Words builds memorable codes such as "calm-river" from a fixed word list.
+type Words struct {
+	words     []string
+	count     int
+	separator string
+}
+
+func NewWords(count int, separator string) *Words {
+	return &Words{
+		words:     strings.Fields(wordList),
+		count:     count,
+		separator: separator,
+	}
+}
+
+func (g *Words) Generate(ctx context.Context) (string, error) {
+	parts := make([]string, g.count)
+	for i := range parts {
+		idx, err := randomIndex(len(g.words))
+		if err != nil {
+			return "", err
+		}
+		parts[i] = g.words[idx]
+	}
+
+	return strings.Join(parts, g.separator), nil
+}
@@ -0,0 +1,370 @@
+package transfer
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bajdzun/go-url-shortener/internal/domain"
+)
+
+type Format string
+
+const (
+	FormatCSV    Format = "csv"
+	FormatNDJSON Format = "ndjson"
+	// FormatBitly reads the CSV export produced by Bitly. Import only.
+	FormatBitly Format = "bitly"
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported format")
+
+// RecordError reports a record that could not be converted. Decoding can
+// continue with the next record after it.
+type RecordError struct {
+	Err error
+}
+
+func (e *RecordError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+var csvColumns = []string{"short_code", "original_url", "created_at", "updated_at", "expires_at", "click_count", "metadata", "redirect_type", "status"}
+
+// Column aliases accepted when importing, keyed by our own column name.
+var (
+	nativeAliases = map[string][]string{
+		"short_code":    {"short_code"},
+		"original_url":  {"original_url"},
+		"created_at":    {"created_at"},
+		"updated_at":    {"updated_at"},
+		"expires_at":    {"expires_at"},
+		"click_count":   {"click_count"},
+		"metadata":      {"metadata"},
+		"redirect_type": {"redirect_type"},
+		"status":        {"status"},
+	}
+
+	bitlyAliases = map[string][]string{
+		"short_code":   {"link", "bitlink", "id"},
+		"original_url": {"long_url"},
+		"created_at":   {"created_at", "created"},
+		"click_count":  {"clicks", "total_clicks"},
+		"title":        {"title"},
+		"tags":         {"tags"},
+	}
+)
+
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05 -0700 MST",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+func ContentType(format Format) string {
+	if format == FormatNDJSON {
+		return "application/x-ndjson"
+	}
+
+	return "text/csv"
+}
+
+type Encoder interface {
+	Encode(url *domain.URL) error
+	Flush() error
+}
+
+type Decoder interface {
+	// Decode returns the next record, or io.EOF once the input is exhausted.
+	Decode() (*domain.URL, error)
+}
+
+func NewEncoder(w io.Writer, format Format) (Encoder, error) {
+	switch format {
+	case FormatNDJSON:
+		return &ndjsonEncoder{enc: json.NewEncoder(w)}, nil
+	case FormatCSV:
+		return &csvEncoder{w: csv.NewWriter(w)}, nil
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+}
+
+func NewDecoder(r io.Reader, format Format) (Decoder, error) {
+	switch format {
+	case FormatNDJSON:
+		return &ndjsonDecoder{dec: json.NewDecoder(r)}, nil
+	case FormatCSV:
+		return newCSVDecoder(r, nativeAliases)
+	case FormatBitly:
+		return newCSVDecoder(r, bitlyAliases)
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+}
+
+type ndjsonEncoder struct {
+	enc *json.Encoder
+}
+
+func (e *ndjsonEncoder) Encode(url *domain.URL) error {
+	return e.enc.Encode(url)
+}
+
+func (e *ndjsonEncoder) Flush() error {
+	return nil
+}
+
+type ndjsonDecoder struct {
+	dec *json.Decoder
+}
+
+func (d *ndjsonDecoder) Decode() (*domain.URL, error) {
+	var raw json.RawMessage
+	if err := d.dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	url := &domain.URL{}
+	if err := json.Unmarshal(raw, url); err != nil {
+		return nil, &RecordError{Err: err}
+	}
+	url.ID = 0
+
+	return url, nil
+}
+
+type csvEncoder struct {
+	w             *csv.Writer
+	headerWritten bool
+}
+
+func (e *csvEncoder) Encode(url *domain.URL) error {
+	if !e.headerWritten {
+		if err := e.w.Write(csvColumns); err != nil {
+			return err
+		}
+		e.headerWritten = true
+	}
+
+	var expiresAt, metadata, redirectType string
+	if url.ExpiresAt != nil {
+		expiresAt = url.ExpiresAt.UTC().Format(time.RFC3339Nano)
+	}
+	if url.Metadata != nil {
+		data, err := json.Marshal(url.Metadata)
+		if err != nil {
+			return err
+		}
+		metadata = string(data)
+	}
+	if url.RedirectType != 0 {
+		redirectType = strconv.Itoa(url.RedirectType)
+	}
+
+	return e.w.Write([]string{
+		url.ShortCode,
+		url.OriginalURL,
+		url.CreatedAt.UTC().Format(time.RFC3339Nano),
+		url.UpdatedAt.UTC().Format(time.RFC3339Nano),
+		expiresAt,
+		strconv.FormatInt(url.ClickCount, 10),
+		metadata,
+		redirectType,
+		string(url.Status),
+	})
+}
+
+func (e *csvEncoder) Flush() error {
+	if !e.headerWritten {
+		if err := e.w.Write(csvColumns); err != nil {
+			return err
+		}
+		e.headerWritten = true
+	}
+
+	e.w.Flush()
+
+	return e.w.Error()
+}
+
+type csvDecoder struct {
+	r       *csv.Reader
+	columns map[string]int
+}
+
+func newCSVDecoder(r io.Reader, aliases map[string][]string) (*csvDecoder, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read csv header: %w", err)
+	}
+
+	index := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		index[strings.ReplaceAll(name, " ", "_")] = i
+	}
+
+	columns := make(map[string]int)
+	for column, names := range aliases {
+		for _, name := range names {
+			if i, ok := index[name]; ok {
+				columns[column] = i
+				break
+			}
+		}
+	}
+
+	for _, required := range []string{"short_code", "original_url"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("csv header is missing the %s column", required)
+		}
+	}
+
+	return &csvDecoder{r: reader, columns: columns}, nil
+}
+
+func (d *csvDecoder) Decode() (*domain.URL, error) {
+	record, err := d.r.Read()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) && errors.Is(parseErr.Err, csv.ErrFieldCount) {
+			return nil, &RecordError{Err: err}
+		}
+
+		return nil, err
+	}
+
+	url, err := d.convert(record)
+	if err != nil {
+		return nil, &RecordError{Err: err}
+	}
+
+	return url, nil
+}
+
+func (d *csvDecoder) convert(record []string) (*domain.URL, error) {
+	var err error
+
+	field := func(column string) string {
+		i, ok := d.columns[column]
+		if !ok || i >= len(record) {
+			return ""
+		}
+
+		return strings.TrimSpace(record[i])
+	}
+
+	url := &domain.URL{
+		ShortCode:   shortCodeFromLink(field("short_code")),
+		OriginalURL: field("original_url"),
+	}
+
+	if url.CreatedAt, err = parseTime(field("created_at")); err != nil {
+		return nil, fmt.Errorf("invalid created_at: %w", err)
+	}
+	if url.UpdatedAt, err = parseTime(field("updated_at")); err != nil {
+		return nil, fmt.Errorf("invalid updated_at: %w", err)
+	}
+
+	if value := field("expires_at"); value != "" {
+		expiresAt, err := parseTime(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expires_at: %w", err)
+		}
+		url.ExpiresAt = &expiresAt
+	}
+
+	if value := field("click_count"); value != "" {
+		if url.ClickCount, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid click_count: %w", err)
+		}
+	}
+
+	if value := field("metadata"); value != "" {
+		if err := json.Unmarshal([]byte(value), &url.Metadata); err != nil {
+			return nil, fmt.Errorf("invalid metadata: %w", err)
+		}
+	}
+
+	if value := field("redirect_type"); value != "" {
+		if url.RedirectType, err = strconv.Atoi(value); err != nil {
+			return nil, fmt.Errorf("invalid redirect_type: %w", err)
+		}
+	}
+
+	url.Status = domain.LinkStatus(field("status"))
+
+	if value := field("title"); value != "" {
+		setMetadata(url, "title", value)
+	}
+
+	if value := field("tags"); value != "" {
+		var tags []string
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+		setMetadata(url, "tags", tags)
+	}
+
+	return url, nil
+}
+
+func setMetadata(url *domain.URL, key string, value interface{}) {
+	if url.Metadata == nil {
+		url.Metadata = make(map[string]interface{})
+	}
+	url.Metadata[key] = value
+}
+
+// shortCodeFromLink accepts either a bare code or a full short link such as
+// "https://bit.ly/abc123" or "bit.ly/abc123" and returns the code.
+func shortCodeFromLink(value string) string {
+	if !strings.Contains(value, "/") {
+		return value
+	}
+
+	if !strings.Contains(value, "://") {
+		value = "https://" + value
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return value
+	}
+
+	return strings.Trim(u.Path, "/")
+}
+
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	var err error
+	for _, layout := range timeLayouts {
+		var t time.Time
+		if t, err = time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, err
+}
@@ -1,28 +1,113 @@
 CREATE TABLE IF NOT EXISTS urls (
     id SERIAL PRIMARY KEY,
-    short_code VARCHAR(10) UNIQUE NOT NULL,
+    short_code VARCHAR(32) UNIQUE NOT NULL,
     original_url TEXT NOT NULL,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     expires_at TIMESTAMP WITH TIME ZONE,
     click_count BIGINT DEFAULT 0,
-    metadata JSONB
+    metadata JSONB,
+    redirect_type SMALLINT NOT NULL DEFAULT 0,
+    status VARCHAR(16) NOT NULL DEFAULT 'active'
 );
 
-CREATE INDEX idx_short_code ON urls(short_code);
-CREATE INDEX idx_created_at ON urls(created_at);
-CREATE INDEX idx_expires_at ON urls(expires_at);
+-- Bring tables created by earlier versions up to date. Every statement in
+-- this file can run again, so it also upgrades an existing database.
+ALTER TABLE urls
+    ALTER COLUMN short_code TYPE VARCHAR(32),
+    ADD COLUMN IF NOT EXISTS redirect_type SMALLINT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS status VARCHAR(16) NOT NULL DEFAULT 'active';
+
+CREATE INDEX IF NOT EXISTS idx_short_code ON urls(short_code);
+CREATE INDEX IF NOT EXISTS idx_created_at ON urls(created_at);
+CREATE INDEX IF NOT EXISTS idx_expires_at ON urls(expires_at);
+CREATE INDEX IF NOT EXISTS idx_click_count ON urls(click_count, id);
 
 CREATE TABLE IF NOT EXISTS url_analytics (
     id SERIAL PRIMARY KEY,
-    short_code VARCHAR(10) NOT NULL,
+    short_code VARCHAR(32) NOT NULL,
     clicked_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     ip_address VARCHAR(45),
     user_agent TEXT,
     referer TEXT,
     country VARCHAR(2),
+    region VARCHAR(128),
+    city VARCHAR(128),
+    -- Derived from user_agent and referer; NULL device marks rows recorded
+    -- before they were, until backfilled
+    browser VARCHAR(32),
+    os VARCHAR(32),
+    device VARCHAR(16),
+    is_bot BOOLEAN NOT NULL DEFAULT FALSE,
+    referrer_domain VARCHAR(255),
+    -- Set once the click is counted in the rollups
+    rolled_up BOOLEAN NOT NULL DEFAULT FALSE,
+    FOREIGN KEY (short_code) REFERENCES urls(short_code) ON DELETE CASCADE
+);
+
+-- Existing clicks get a NULL device, so the backfill enriches them.
+ALTER TABLE url_analytics
+    ALTER COLUMN short_code TYPE VARCHAR(32),
+    ADD COLUMN IF NOT EXISTS region VARCHAR(128),
+    ADD COLUMN IF NOT EXISTS city VARCHAR(128),
+    ADD COLUMN IF NOT EXISTS browser VARCHAR(32),
+    ADD COLUMN IF NOT EXISTS os VARCHAR(32),
+    ADD COLUMN IF NOT EXISTS device VARCHAR(16),
+    ADD COLUMN IF NOT EXISTS is_bot BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN IF NOT EXISTS referrer_domain VARCHAR(255),
+    ADD COLUMN IF NOT EXISTS rolled_up BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX IF NOT EXISTS idx_analytics_short_code ON url_analytics(short_code);
+CREATE INDEX IF NOT EXISTS idx_analytics_clicked_at ON url_analytics(clicked_at);
+CREATE INDEX IF NOT EXISTS idx_analytics_short_code_clicked_at ON url_analytics(short_code, clicked_at);
+CREATE INDEX IF NOT EXISTS idx_analytics_unenriched ON url_analytics(id) WHERE device IS NULL;
+CREATE INDEX IF NOT EXISTS idx_analytics_ip_address ON url_analytics(ip_address);
+CREATE INDEX IF NOT EXISTS idx_analytics_pending_rollup ON url_analytics(short_code, clicked_at) WHERE NOT rolled_up;
+
+-- Clicks per link, UTC hour or day, dimension and value. The "total"
+-- dimension counts all clicks, with an empty value.
+CREATE TABLE IF NOT EXISTS click_rollups_hourly (
+    short_code VARCHAR(32) NOT NULL,
+    bucket TIMESTAMP WITH TIME ZONE NOT NULL,
+    dimension VARCHAR(16) NOT NULL,
+    value VARCHAR(255) NOT NULL,
+    is_bot BOOLEAN NOT NULL,
+    clicks BIGINT NOT NULL,
+    last_clicked_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (short_code, dimension, bucket, value, is_bot),
     FOREIGN KEY (short_code) REFERENCES urls(short_code) ON DELETE CASCADE
 );
 
-CREATE INDEX idx_analytics_short_code ON url_analytics(short_code);
-CREATE INDEX idx_analytics_clicked_at ON url_analytics(clicked_at);
+CREATE TABLE IF NOT EXISTS click_rollups_daily (
+    short_code VARCHAR(32) NOT NULL,
+    bucket TIMESTAMP WITH TIME ZONE NOT NULL,
+    dimension VARCHAR(16) NOT NULL,
+    value VARCHAR(255) NOT NULL,
+    is_bot BOOLEAN NOT NULL,
+    clicks BIGINT NOT NULL,
+    last_clicked_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (short_code, dimension, bucket, value, is_bot),
+    FOREIGN KEY (short_code) REFERENCES urls(short_code) ON DELETE CASCADE
+);
+
+-- Estimated unique visitors per link and UTC day, with the HyperLogLog
+-- sketch they were counted in
+CREATE TABLE IF NOT EXISTS daily_unique_visitors (
+    short_code VARCHAR(32) NOT NULL,
+    day DATE NOT NULL,
+    visitors BIGINT NOT NULL,
+    sketch BYTEA NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (short_code, day),
+    FOREIGN KEY (short_code) REFERENCES urls(short_code) ON DELETE CASCADE
+);
+
+-- One row per click count flush from Redis, so a retried flush is not
+-- applied twice
+CREATE TABLE IF NOT EXISTS click_count_flushes (
+    flush_id VARCHAR(64) PRIMARY KEY,
+    flushed_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Drives the counter and feistel short code strategies
+CREATE SEQUENCE IF NOT EXISTS short_code_seq;